@@ -4,9 +4,12 @@ import (
 	"context"
 	"os"
 
+	"github.com/HELL0ANTHONY/payment-system/shared/idempotency"
 	"github.com/HELL0ANTHONY/payment-system/shared/publisher"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 
 	"github.com/HELL0ANTHONY/payment-system/lambdas/gateway-processor/internal/handler"
@@ -19,17 +22,25 @@ func main() {
 		panic(err)
 	}
 
+	db := dynamodb.NewFromConfig(cfg)
 	sqsClient := sqs.NewFromConfig(cfg)
-	pub := publisher.NewSQS(sqsClient)
+	rec := timeline.NewRecorder(db, os.Getenv("TIMELINE_TABLE"), "gateway-processor")
+	pub := timeline.NewPublisher(publisher.NewSQS(sqsClient), rec)
 
 	gateway := service.NewMockGateway(0.1)
 
 	svc := service.New(
+		db,
 		pub,
 		gateway,
+		os.Getenv("CANCELLATIONS_TABLE"),
+		os.Getenv("GATEWAY_RESULTS_TABLE"),
 		os.Getenv("WALLET_QUEUE_URL"),
+		os.Getenv("ORCHESTRATOR_QUEUE_URL"),
 	)
 
-	h := handler.New(svc)
+	guard := idempotency.NewGuard(db, os.Getenv("PROCESSED_EVENTS_TABLE"), "gateway-processor")
+
+	h := handler.New(svc, rec, guard)
 	lambda.Start(h.Handle)
 }
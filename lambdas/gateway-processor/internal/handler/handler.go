@@ -7,17 +7,21 @@ import (
 	"log/slog"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/idempotency"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
 	awsEvents "github.com/aws/aws-lambda-go/events"
 
 	"github.com/HELL0ANTHONY/payment-system/lambdas/gateway-processor/internal/service"
 )
 
 type Handler struct {
-	svc *service.Service
+	svc      *service.Service
+	recorder *timeline.Recorder
+	guard    *idempotency.Guard
 }
 
-func New(svc *service.Service) *Handler {
-	return &Handler{svc: svc}
+func New(svc *service.Service, recorder *timeline.Recorder, guard *idempotency.Guard) *Handler {
+	return &Handler{svc: svc, recorder: recorder, guard: guard}
 }
 
 func (h *Handler) Handle(ctx context.Context, sqsEvent awsEvents.SQSEvent) error {
@@ -43,7 +47,14 @@ func (h *Handler) processRecord(ctx context.Context, record *awsEvents.SQSMessag
 	}
 
 	slog.Info("processing event", "type", event.Type, "payment_id", event.PaymentID)
+	h.recorder.Observe(ctx, &event)
 
+	return h.guard.Process(ctx, &event, h.dispatch)
+}
+
+// dispatch runs the service operation for an event, once per event (see
+// idempotency.Guard).
+func (h *Handler) dispatch(ctx context.Context, event *events.Event) error {
 	switch event.Type {
 	case events.FundsReserved:
 		return h.svc.ProcessPayment(
@@ -53,7 +64,18 @@ func (h *Handler) processRecord(ctx context.Context, record *awsEvents.SQSMessag
 			event.ReservationID,
 			event.Amount,
 			event.Currency,
+			event.CaptureMode,
 		)
+	case events.PaymentCancelled:
+		return h.svc.MarkCancelled(ctx, event.PaymentID)
+	case events.CaptureRequested:
+		return h.svc.CapturePayment(ctx, event)
+	case events.PaymentVoided:
+		return h.svc.VoidPayment(ctx, event)
+	case events.RefundRequested:
+		return h.svc.ProcessRefund(ctx, event)
+	case events.ReversalRequested:
+		return h.svc.ReversePayment(ctx, event)
 	default:
 		slog.Warn("unknown event type", "type", event.Type)
 		return nil
@@ -2,28 +2,79 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 )
 
+// ErrReversalDeclined is returned when the gateway refuses to give back a
+// charge on a cancelled payment; the event ends up in the DLQ for review.
+var ErrReversalDeclined = errors.New("gateway declined the reversal")
+
+// cancellationTTL is how long a cancellation is remembered. It only has to
+// outlive the reservation events still in flight for the payment.
+const cancellationTTL = 24 * time.Hour
+
+// resultTTL is how long a gateway result is kept. SQS keeps a message for at
+// most 14 days, so no redelivery comes later.
+const resultTTL = 14 * 24 * time.Hour
+
+// DynamoDBClient defines the DynamoDB operations we need.
+type DynamoDBClient interface {
+	PutItem(
+		ctx context.Context,
+		params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.PutItemOutput, error)
+	GetItem(
+		ctx context.Context,
+		params *dynamodb.GetItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.GetItemOutput, error)
+}
+
 // EventPublisher defines the event publishing operations we need.
 type EventPublisher interface {
 	Publish(ctx context.Context, queueURL string, event *events.Event) error
 }
 
-// GatewayClient simulates external payment gateway.
+// GatewayClient simulates external payment gateway. ProcessPayment charges
+// at once; Authorize only holds the amount until Capture charges it or Void
+// drops it.
 type GatewayClient interface {
 	ProcessPayment(
 		ctx context.Context,
 		amount decimal.Decimal,
 		currency string,
 	) (*GatewayResponse, error)
+	Authorize(
+		ctx context.Context,
+		amount decimal.Decimal,
+		currency string,
+	) (*GatewayResponse, error)
+	Capture(
+		ctx context.Context,
+		reference string,
+		amount decimal.Decimal,
+		currency string,
+	) (*GatewayResponse, error)
+	Void(ctx context.Context, reference string) (*GatewayResponse, error)
+	Refund(
+		ctx context.Context,
+		reference string,
+		amount decimal.Decimal,
+		currency string,
+	) (*GatewayResponse, error)
 }
 
 type GatewayResponse struct {
@@ -34,28 +85,67 @@ type GatewayResponse struct {
 }
 
 type Service struct {
-	publisher      EventPublisher
-	gateway        GatewayClient
-	walletQueueURL string
+	db                   DynamoDBClient
+	publisher            EventPublisher
+	gateway              GatewayClient
+	cancellationsTable   string
+	resultsTable         string
+	walletQueueURL       string
+	orchestratorQueueURL string
 }
 
-func New(pub EventPublisher, gateway GatewayClient, walletQueueURL string) *Service {
+// New creates a service that keeps the gateway's answers in resultsTable, so
+// a request delivered again is answered from them instead of reaching the
+// gateway twice.
+func New(
+	db DynamoDBClient,
+	pub EventPublisher,
+	gateway GatewayClient,
+	cancellationsTable, resultsTable, walletQueueURL, orchestratorQueueURL string,
+) *Service {
 	return &Service{
-		publisher:      pub,
-		gateway:        gateway,
-		walletQueueURL: walletQueueURL,
+		db:                   db,
+		publisher:            pub,
+		gateway:              gateway,
+		cancellationsTable:   cancellationsTable,
+		resultsTable:         resultsTable,
+		walletQueueURL:       walletQueueURL,
+		orchestratorQueueURL: orchestratorQueueURL,
 	}
 }
 
+// ProcessPayment sends a payment to the gateway. In manual capture mode the
+// gateway is only asked to authorize it; captureMode is passed on so the
+// wallet and the orchestrator hold the funds instead of settling them. The
+// gateway is asked once per payment: a redelivery publishes the stored answer.
 func (s *Service) ProcessPayment(
 	ctx context.Context,
 	paymentID, userID, reservationID string,
 	amount decimal.Decimal,
-	currency string,
+	currency, captureMode string,
 ) error {
+	cancelled, err := s.isCancelled(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+
+	if cancelled {
+		// The wallet releases the reservation when it sees the cancellation.
+		slog.Info("skipping cancelled payment", "payment_id", paymentID)
+
+		return nil
+	}
+
 	slog.Info("processing payment with gateway", "payment_id", paymentID, "amount", amount.String())
 
-	resp, err := s.gateway.ProcessPayment(ctx, amount, currency)
+	charge := s.gateway.ProcessPayment
+	if captureMode == events.CaptureManual {
+		charge = s.gateway.Authorize
+	}
+
+	resp, err := s.callOnce(ctx, "charge#"+paymentID, func() (*GatewayResponse, error) {
+		return charge(ctx, amount, currency)
+	})
 	if err != nil {
 		slog.Error("gateway error", "error", err)
 
@@ -82,17 +172,17 @@ func (s *Service) ProcessPayment(
 		)
 	}
 
-	return s.publishApproved(ctx, paymentID, userID, reservationID, resp.Reference)
+	return s.publishApproved(ctx, paymentID, userID, reservationID, resp.Reference, captureMode)
 }
 
 func (s *Service) publishApproved(
 	ctx context.Context,
-	paymentID, userID, reservationID, gatewayRef string,
+	paymentID, userID, reservationID, gatewayRef, captureMode string,
 ) error {
 	event := events.New(events.GatewayPaymentApproved, paymentID, userID)
-	event.WithReservation(reservationID).WithGatewayRef(gatewayRef)
+	event.WithReservation(reservationID).WithGatewayRef(gatewayRef).WithCaptureMode(captureMode)
 
-	if err := s.publisher.Publish(ctx, s.walletQueueURL, &event); err != nil {
+	if err := s.publish(ctx, &event); err != nil {
 		return fmt.Errorf("publish approved event: %w", err)
 	}
 
@@ -108,7 +198,7 @@ func (s *Service) publishRejected(
 	event := events.New(events.GatewayPaymentRejected, paymentID, userID)
 	event.WithReservation(reservationID).WithReason(reason)
 
-	if err := s.publisher.Publish(ctx, s.walletQueueURL, &event); err != nil {
+	if err := s.publish(ctx, &event); err != nil {
 		return fmt.Errorf("publish rejected event: %w", err)
 	}
 
@@ -117,6 +207,258 @@ func (s *Service) publishRejected(
 	return nil
 }
 
+// CapturePayment charges an authorized payment for the amount requested. Once
+// the gateway captures it, the wallet is told to deduct that amount from the
+// reservation; a declined capture is published like a rejected payment, so
+// the wallet releases the reservation and the orchestrator fails the payment.
+// A payment is captured once; a redelivery publishes the stored answer.
+func (s *Service) CapturePayment(ctx context.Context, req *events.Event) error {
+	slog.Info("capturing payment with gateway", "payment_id", req.PaymentID, "amount", req.Amount.String())
+
+	resp, err := s.callOnce(ctx, "capture#"+req.PaymentID, func() (*GatewayResponse, error) {
+		return s.gateway.Capture(ctx, req.GatewayRef, req.Amount, req.Currency)
+	})
+	if err != nil {
+		slog.Error("gateway error", "error", err)
+
+		return s.publishRejected(ctx, req.PaymentID, req.UserID, req.ReservationID, "gateway_error", err.Error())
+	}
+
+	if !resp.Approved {
+		slog.Warn("capture rejected by gateway", "code", resp.ErrorCode)
+
+		return s.publishRejected(ctx, req.PaymentID, req.UserID, req.ReservationID, resp.ErrorCode, resp.Message)
+	}
+
+	event := events.New(events.CaptureCompleted, req.PaymentID, req.UserID)
+	event.WithAmount(req.Amount, req.Currency).
+		WithReservation(req.ReservationID).
+		WithGatewayRef(resp.Reference)
+
+	if err := s.publisher.Publish(ctx, s.walletQueueURL, &event); err != nil {
+		return fmt.Errorf("publish capture completed event: %w", err)
+	}
+
+	slog.Info("payment captured", "payment_id", req.PaymentID, "gateway_ref", resp.Reference)
+
+	return nil
+}
+
+// VoidPayment drops the authorization of a voided payment at the gateway. The
+// wallet releases the reservation on its own. An error is returned so the
+// event is retried; a void the gateway declines is only logged, since the
+// authorization lapses by itself.
+func (s *Service) VoidPayment(ctx context.Context, req *events.Event) error {
+	resp, err := s.gateway.Void(ctx, req.GatewayRef)
+	if err != nil {
+		return fmt.Errorf("void authorization: %w", err)
+	}
+
+	if !resp.Approved {
+		slog.Warn("void rejected by gateway", "payment_id", req.PaymentID, "code", resp.ErrorCode)
+
+		return nil
+	}
+
+	slog.Info("authorization voided", "payment_id", req.PaymentID, "gateway_ref", req.GatewayRef)
+
+	return nil
+}
+
+// ReversePayment gives back a charge the gateway made for a payment that was
+// cancelled, or whose reservation expired, meanwhile: an authorization is
+// voided and a sale refunded. The wallet released the reservation, or paid
+// back the deduction of a payment cancelled while it was being charged, so
+// nothing else is published. A payment is reversed once, however many times
+// it is requested. Errors are returned so the event is retried.
+func (s *Service) ReversePayment(ctx context.Context, req *events.Event) error {
+	slog.Warn("reversing charge", "payment_id", req.PaymentID, "gateway_ref", req.GatewayRef, "reason", req.Reason)
+
+	resp, err := s.callOnce(ctx, "reversal#"+req.PaymentID, func() (*GatewayResponse, error) {
+		if req.CaptureMode == events.CaptureManual {
+			return s.gateway.Void(ctx, req.GatewayRef)
+		}
+
+		return s.gateway.Refund(ctx, req.GatewayRef, req.Amount, req.Currency)
+	})
+	if err != nil {
+		return fmt.Errorf("reverse payment: %w", err)
+	}
+
+	if !resp.Approved {
+		return fmt.Errorf("%w: %s: %s", ErrReversalDeclined, req.PaymentID, resp.Message)
+	}
+
+	slog.Info("charge reversed", "payment_id", req.PaymentID, "gateway_ref", req.GatewayRef)
+
+	return nil
+}
+
+// MarkCancelled records that a payment was cancelled so that ProcessPayment
+// does not charge it if its reservation is still queued.
+func (s *Service) MarkCancelled(ctx context.Context, paymentID string) error {
+	_, err := s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.cancellationsTable),
+		Item: map[string]types.AttributeValue{
+			"payment_id": &types.AttributeValueMemberS{Value: paymentID},
+			"expires_at": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(cancellationTTL).Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("save cancellation: %w", err)
+	}
+
+	slog.Info("payment cancellation recorded", "payment_id", paymentID)
+
+	return nil
+}
+
+func (s *Service) isCancelled(ctx context.Context, paymentID string) (bool, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.cancellationsTable),
+		Key: map[string]types.AttributeValue{
+			"payment_id": &types.AttributeValueMemberS{Value: paymentID},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("get cancellation: %w", err)
+	}
+
+	return result.Item != nil, nil
+}
+
+// ProcessRefund returns amount of a captured payment through the gateway. A
+// completed refund goes to the wallet, which credits the user back; a failed
+// one goes straight to the orchestrator so the amount becomes refundable again.
+// A refund is sent once; a redelivery publishes the stored answer.
+func (s *Service) ProcessRefund(ctx context.Context, req *events.Event) error {
+	slog.Info("processing refund with gateway", "refund_id", req.RefundID, "amount", req.Amount.String())
+
+	resp, err := s.callOnce(ctx, "refund#"+req.RefundID, func() (*GatewayResponse, error) {
+		return s.gateway.Refund(ctx, req.GatewayRef, req.Amount, req.Currency)
+	})
+	if err != nil {
+		slog.Error("gateway error", "error", err)
+
+		return s.publishRefundFailed(ctx, req, err.Error())
+	}
+
+	if !resp.Approved {
+		slog.Warn("refund rejected by gateway", "code", resp.ErrorCode)
+
+		return s.publishRefundFailed(ctx, req, resp.Message)
+	}
+
+	event := events.New(events.GatewayRefundCompleted, req.PaymentID, req.UserID)
+	event.WithAmount(req.Amount, req.Currency).WithGatewayRef(resp.Reference).WithRefund(req.RefundID)
+
+	if err := s.publisher.Publish(ctx, s.walletQueueURL, &event); err != nil {
+		return fmt.Errorf("publish refund completed event: %w", err)
+	}
+
+	slog.Info("refund completed", "refund_id", req.RefundID, "gateway_ref", resp.Reference)
+
+	return nil
+}
+
+func (s *Service) publishRefundFailed(ctx context.Context, req *events.Event, reason string) error {
+	event := events.New(events.GatewayRefundFailed, req.PaymentID, req.UserID)
+	event.WithAmount(req.Amount, req.Currency).WithRefund(req.RefundID).WithReason(reason)
+
+	if err := s.publisher.Publish(ctx, s.orchestratorQueueURL, &event); err != nil {
+		return fmt.Errorf("publish refund failed event: %w", err)
+	}
+
+	slog.Warn("refund failed", "refund_id", req.RefundID, "reason", reason)
+
+	return nil
+}
+
+// callOnce returns the gateway's stored answer to the operation id, or makes
+// the call and stores its answer. Publishing the outcome can fail after the
+// gateway has charged or refunded; the redelivered request then finds the
+// answer here instead of charging or refunding again. Errors are not stored,
+// so a call that failed is made again. A failure to store is only logged:
+// the outcome can still be published, which settles the request.
+func (s *Service) callOnce(
+	ctx context.Context,
+	id string,
+	call func() (*GatewayResponse, error),
+) (*GatewayResponse, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.resultsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get gateway result: %w", err)
+	}
+
+	if result.Item != nil {
+		slog.Info("gateway result replayed", "id", id)
+
+		return storedResponse(result.Item), nil
+	}
+
+	resp, err := call()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.resultsTable),
+		Item: map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: id},
+			"approved":   &types.AttributeValueMemberBOOL{Value: resp.Approved},
+			"reference":  &types.AttributeValueMemberS{Value: resp.Reference},
+			"error_code": &types.AttributeValueMemberS{Value: resp.ErrorCode},
+			"message":    &types.AttributeValueMemberS{Value: resp.Message},
+			"expires_at": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(resultTTL).Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to store gateway result", "id", id, "error", err)
+	}
+
+	return resp, nil
+}
+
+// storedResponse reads a GatewayResponse stored by callOnce.
+func storedResponse(item map[string]types.AttributeValue) *GatewayResponse {
+	resp := &GatewayResponse{}
+
+	if v, ok := item["approved"].(*types.AttributeValueMemberBOOL); ok {
+		resp.Approved = v.Value
+	}
+
+	for name, field := range map[string]*string{
+		"reference":  &resp.Reference,
+		"error_code": &resp.ErrorCode,
+		"message":    &resp.Message,
+	} {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			*field = v.Value
+		}
+	}
+
+	return resp
+}
+
+// publish sends a gateway outcome to the wallet, which settles the reservation,
+// and to the orchestrator, which tracks the payment status.
+func (s *Service) publish(ctx context.Context, event *events.Event) error {
+	if err := s.publisher.Publish(ctx, s.walletQueueURL, event); err != nil {
+		return err
+	}
+
+	return s.publisher.Publish(ctx, s.orchestratorQueueURL, event)
+}
+
 // MockGateway simulates an external payment gateway for testing.
 type MockGateway struct {
 	FailRate float64
@@ -146,3 +488,42 @@ func (g *MockGateway) ProcessPayment(
 		Reference: fmt.Sprintf("GW-%s", uuid.New().String()[:8]),
 	}, nil
 }
+
+func (g *MockGateway) Authorize(
+	ctx context.Context,
+	amount decimal.Decimal,
+	currency string,
+) (*GatewayResponse, error) {
+	return g.ProcessPayment(ctx, amount, currency)
+}
+
+func (g *MockGateway) Capture(
+	_ context.Context,
+	reference string,
+	_ decimal.Decimal,
+	_ string,
+) (*GatewayResponse, error) {
+	time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+
+	return &GatewayResponse{Approved: true, Reference: reference}, nil
+}
+
+func (g *MockGateway) Void(_ context.Context, reference string) (*GatewayResponse, error) {
+	time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+
+	return &GatewayResponse{Approved: true, Reference: reference}, nil
+}
+
+func (g *MockGateway) Refund(
+	_ context.Context,
+	_ string,
+	_ decimal.Decimal,
+	_ string,
+) (*GatewayResponse, error) {
+	time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+
+	return &GatewayResponse{
+		Approved:  true,
+		Reference: fmt.Sprintf("RF-%s", uuid.New().String()[:8]),
+	}, nil
+}
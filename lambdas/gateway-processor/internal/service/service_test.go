@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -38,6 +40,87 @@ func (m *mockGateway) ProcessPayment(
 	return args.Get(0).(*GatewayResponse), args.Error(1)
 }
 
+func (m *mockGateway) Authorize(
+	ctx context.Context,
+	amount decimal.Decimal,
+	currency string,
+) (*GatewayResponse, error) {
+	args := m.Called(ctx, amount, currency)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*GatewayResponse), args.Error(1)
+}
+
+func (m *mockGateway) Capture(
+	ctx context.Context,
+	reference string,
+	amount decimal.Decimal,
+	currency string,
+) (*GatewayResponse, error) {
+	args := m.Called(ctx, reference, amount, currency)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*GatewayResponse), args.Error(1)
+}
+
+func (m *mockGateway) Void(ctx context.Context, reference string) (*GatewayResponse, error) {
+	args := m.Called(ctx, reference)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*GatewayResponse), args.Error(1)
+}
+
+func (m *mockGateway) Refund(
+	ctx context.Context,
+	reference string,
+	amount decimal.Decimal,
+	currency string,
+) (*GatewayResponse, error) {
+	args := m.Called(ctx, reference, amount, currency)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*GatewayResponse), args.Error(1)
+}
+
+type mockDB struct {
+	mock.Mock
+}
+
+func (m *mockDB) PutItem(
+	ctx context.Context,
+	input *dynamodb.PutItemInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+func (m *mockDB) GetItem(
+	ctx context.Context,
+	input *dynamodb.GetItemInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+// notCancelled returns a mockDB with no recorded cancellations and no stored
+// gateway results, which accepts the results it is given.
+func notCancelled() *mockDB {
+	db := new(mockDB)
+	db.On("GetItem", mock.Anything, mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+	db.On("PutItem", mock.Anything, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+
+	return db
+}
+
 // Tests
 
 func TestProcessPayment_Approved(t *testing.T) {
@@ -50,10 +133,11 @@ func TestProcessPayment_Approved(t *testing.T) {
 		Reference: "GW-12345",
 	}, nil)
 	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
 
-	svc := New(pub, gw, "http://wallet-queue")
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
 
-	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD")
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
 
 	assert.NoError(t, err)
 	gw.AssertExpectations(t)
@@ -77,10 +161,11 @@ func TestProcessPayment_Rejected(t *testing.T) {
 		Message:   "insufficient funds at issuer",
 	}, nil)
 	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
 
-	svc := New(pub, gw, "http://wallet-queue")
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
 
-	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD")
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
 
 	assert.NoError(t, err)
 
@@ -98,10 +183,11 @@ func TestProcessPayment_GatewayError(t *testing.T) {
 
 	gw.On("ProcessPayment", ctx, decimal.NewFromInt(100), "USD").Return(nil, errors.New("timeout"))
 	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
 
-	svc := New(pub, gw, "http://wallet-queue")
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
 
-	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD")
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
 
 	assert.NoError(t, err) // Still publishes rejected event
 
@@ -132,3 +218,345 @@ func TestMockGateway_AlwaysRejects(t *testing.T) {
 	assert.False(t, resp.Approved)
 	assert.Equal(t, "DECLINED", resp.ErrorCode)
 }
+
+func TestProcessPayment_NotifiesOrchestrator(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("ProcessPayment", ctx, decimal.NewFromInt(100), "USD").Return(&GatewayResponse{
+		Approved:  false,
+		ErrorCode: "DECLINED",
+		Message:   "declined",
+	}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	pub.AssertNumberOfCalls(t, "Publish", 2)
+}
+
+func TestProcessRefund_CompletedGoesToWallet(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("Refund", ctx, "GW-12345", decimal.NewFromInt(40), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "RF-1",
+	}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.RefundRequested, "pay-123", "user-456")
+	req.WithAmount(decimal.NewFromInt(40), "USD").WithGatewayRef("GW-12345").WithRefund("ref-1")
+
+	err := svc.ProcessRefund(ctx, &req)
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	pub.AssertNumberOfCalls(t, "Publish", 1)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.GatewayRefundCompleted, event.Type)
+	assert.Equal(t, "ref-1", event.RefundID)
+	assert.True(t, decimal.NewFromInt(40).Equal(event.Amount))
+}
+
+func TestProcessRefund_FailedGoesToOrchestrator(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("Refund", ctx, "GW-12345", decimal.NewFromInt(40), "USD").Return(nil, errors.New("timeout"))
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.RefundRequested, "pay-123", "user-456")
+	req.WithAmount(decimal.NewFromInt(40), "USD").WithGatewayRef("GW-12345").WithRefund("ref-1")
+
+	err := svc.ProcessRefund(ctx, &req)
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.GatewayRefundFailed, event.Type)
+	assert.Equal(t, "ref-1", event.RefundID)
+	assert.Equal(t, "timeout", event.Reason)
+}
+
+func TestProcessPayment_ManualCaptureIsPropagated(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("Authorize", ctx, decimal.NewFromInt(100), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "GW-12345",
+	}, nil)
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	err := svc.ProcessPayment(
+		ctx,
+		"pay-123",
+		"user-456",
+		"res-789",
+		decimal.NewFromInt(100),
+		"USD",
+		events.CaptureManual,
+	)
+
+	assert.NoError(t, err)
+	gw.AssertNotCalled(t, "ProcessPayment", mock.Anything, mock.Anything, mock.Anything)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.GatewayPaymentApproved, event.Type)
+	assert.Equal(t, events.CaptureManual, event.CaptureMode)
+}
+
+func TestProcessPayment_SkipsCancelledPayment(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{
+		Item: map[string]types.AttributeValue{
+			"payment_id": &types.AttributeValueMemberS{Value: "pay-123"},
+		},
+	}, nil)
+
+	svc := New(db, pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	gw.AssertNotCalled(t, "ProcessPayment", mock.Anything, mock.Anything, mock.Anything)
+	pub.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestMarkCancelled_RecordsPayment(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+		id := in.Item["payment_id"].(*types.AttributeValueMemberS)
+
+		return *in.TableName == "cancellations" && id.Value == "pay-123"
+	})).Return(&dynamodb.PutItemOutput{}, nil)
+
+	svc := New(db, nil, nil, "cancellations", "gateway-results", "", "")
+
+	err := svc.MarkCancelled(ctx, "pay-123")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func captureRequest() events.Event {
+	req := events.New(events.CaptureRequested, "pay-123", "user-456")
+	req.WithAmount(decimal.NewFromInt(60), "USD").WithReservation("res-789").WithGatewayRef("GW-12345")
+
+	return req
+}
+
+func TestCapturePayment_CapturedGoesToWallet(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("Capture", ctx, "GW-12345", decimal.NewFromInt(60), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "GW-12345",
+	}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := captureRequest()
+	err := svc.CapturePayment(ctx, &req)
+
+	assert.NoError(t, err)
+	gw.AssertExpectations(t)
+	pub.AssertNumberOfCalls(t, "Publish", 1)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.CaptureCompleted, event.Type)
+	assert.Equal(t, "res-789", event.ReservationID)
+	assert.True(t, decimal.NewFromInt(60).Equal(event.Amount))
+}
+
+func TestCapturePayment_DeclinedReleasesReservation(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("Capture", ctx, "GW-12345", decimal.NewFromInt(60), "USD").Return(&GatewayResponse{
+		Approved:  false,
+		ErrorCode: "EXPIRED",
+		Message:   "authorization expired",
+	}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(notCancelled(), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := captureRequest()
+	err := svc.CapturePayment(ctx, &req)
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.GatewayPaymentRejected, event.Type)
+	assert.Equal(t, "authorization expired", event.Reason)
+}
+
+func TestVoidPayment_DropsAuthorization(t *testing.T) {
+	ctx := context.Background()
+	gw := new(mockGateway)
+
+	gw.On("Void", ctx, "GW-12345").Return(&GatewayResponse{Approved: true, Reference: "GW-12345"}, nil)
+
+	svc := New(notCancelled(), nil, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.PaymentVoided, "pay-123", "user-456")
+	req.WithGatewayRef("GW-12345")
+
+	err := svc.VoidPayment(ctx, &req)
+
+	assert.NoError(t, err)
+	gw.AssertExpectations(t)
+}
+
+func TestVoidPayment_GatewayErrorIsRetried(t *testing.T) {
+	ctx := context.Background()
+	gw := new(mockGateway)
+
+	gw.On("Void", ctx, "GW-12345").Return(nil, errors.New("timeout"))
+
+	svc := New(notCancelled(), nil, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.PaymentVoided, "pay-123", "user-456")
+	req.WithGatewayRef("GW-12345")
+
+	err := svc.VoidPayment(ctx, &req)
+
+	assert.Error(t, err)
+}
+
+func TestReversePayment_RefundsSale(t *testing.T) {
+	ctx := context.Background()
+	gw := new(mockGateway)
+
+	gw.On("Refund", ctx, "GW-12345", decimal.NewFromInt(100), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "RF-1",
+	}, nil)
+
+	svc := New(notCancelled(), nil, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.ReversalRequested, "pay-123", "user-456")
+	req.WithAmount(decimal.NewFromInt(100), "USD").WithGatewayRef("GW-12345").WithCaptureMode(events.CaptureAutomatic)
+
+	err := svc.ReversePayment(ctx, &req)
+
+	assert.NoError(t, err)
+	gw.AssertExpectations(t)
+	gw.AssertNotCalled(t, "Void", mock.Anything, mock.Anything)
+}
+
+// storingResults returns a mockDB with no recorded cancellations that keeps
+// the gateway result stored under id and returns it once stored.
+func storingResults(id string) *mockDB {
+	db := new(mockDB)
+	stored := &dynamodb.GetItemOutput{}
+
+	isResult := mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		key := in.Key["id"].(*types.AttributeValueMemberS)
+
+		return *in.TableName == "gateway-results" && key.Value == id
+	})
+	db.On("GetItem", mock.Anything, isResult).Return(stored, nil)
+	db.On("GetItem", mock.Anything, mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+	db.On("PutItem", mock.Anything, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).
+		Run(func(args mock.Arguments) {
+			stored.Item = args.Get(1).(*dynamodb.PutItemInput).Item
+		})
+
+	return db
+}
+
+func TestProcessPayment_RedeliveryAfterFailedPublishChargesOnce(t *testing.T) {
+	ctx := context.Background()
+	pub := new(mockPublisher)
+	gw := new(mockGateway)
+
+	gw.On("ProcessPayment", ctx, decimal.NewFromInt(100), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "GW-12345",
+	}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(errors.New("queue unavailable")).Once()
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(storingResults("charge#pay-123"), pub, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	err := svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
+	assert.Error(t, err)
+
+	err = svc.ProcessPayment(ctx, "pay-123", "user-456", "res-789", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	gw.AssertNumberOfCalls(t, "ProcessPayment", 1)
+
+	event := pub.Calls[len(pub.Calls)-2].Arguments[2].(*events.Event)
+	assert.Equal(t, events.GatewayPaymentApproved, event.Type)
+	assert.Equal(t, "GW-12345", event.GatewayRef)
+}
+
+func TestReversePayment_RepeatedReversalRefundsOnce(t *testing.T) {
+	ctx := context.Background()
+	gw := new(mockGateway)
+
+	gw.On("Refund", ctx, "GW-12345", decimal.NewFromInt(100), "USD").Return(&GatewayResponse{
+		Approved:  true,
+		Reference: "RF-1",
+	}, nil)
+
+	svc := New(storingResults("reversal#pay-123"), nil, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.ReversalRequested, "pay-123", "user-456")
+	req.WithAmount(decimal.NewFromInt(100), "USD").WithGatewayRef("GW-12345").WithCaptureMode(events.CaptureAutomatic)
+
+	assert.NoError(t, svc.ReversePayment(ctx, &req))
+	assert.NoError(t, svc.ReversePayment(ctx, &req))
+	gw.AssertNumberOfCalls(t, "Refund", 1)
+}
+
+func TestReversePayment_VoidsAuthorization(t *testing.T) {
+	ctx := context.Background()
+	gw := new(mockGateway)
+
+	gw.On("Void", ctx, "GW-12345").Return(&GatewayResponse{Approved: false, Message: "already captured"}, nil)
+
+	svc := New(notCancelled(), nil, gw, "cancellations", "gateway-results", "http://wallet-queue", "http://orchestrator-queue")
+
+	req := events.New(events.ReversalRequested, "pay-123", "user-456")
+	req.WithGatewayRef("GW-12345").WithCaptureMode(events.CaptureManual)
+
+	err := svc.ReversePayment(ctx, &req)
+
+	assert.ErrorIs(t, err, ErrReversalDeclined)
+	gw.AssertExpectations(t)
+}
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
@@ -20,6 +21,8 @@ type CloudWatchClient interface {
 	) (*cloudwatch.PutMetricDataOutput, error)
 }
 
+const unknownCurrency = "UNKNOWN"
+
 type Service struct {
 	cw        CloudWatchClient
 	namespace string
@@ -76,7 +79,7 @@ func (s *Service) buildMetrics(event *events.Event) []types.MetricDatum {
 			Timestamp:  &now,
 			Dimensions: []types.Dimension{
 				{Name: aws.String("EventType"), Value: aws.String(event.Type)},
-				{Name: aws.String("Currency"), Value: aws.String(event.Currency)},
+				{Name: aws.String("Currency"), Value: aws.String(currencyDimension(event.Currency))},
 			},
 			Unit: types.StandardUnitNone,
 		})
@@ -92,6 +95,18 @@ func (s *Service) buildMetrics(event *events.Event) []types.MetricDatum {
 	return metrics
 }
 
+// currencyDimension returns the registry code for the Currency dimension.
+// Anything outside the registry is grouped under unknownCurrency so that a
+// malformed event cannot create new metric series.
+func currencyDimension(code string) string {
+	c, err := currency.Lookup(code)
+	if err != nil {
+		return unknownCurrency
+	}
+
+	return c.Code
+}
+
 func (s *Service) successMetric(t time.Time) types.MetricDatum {
 	return types.MetricDatum{
 		MetricName: aws.String("PaymentSuccess"),
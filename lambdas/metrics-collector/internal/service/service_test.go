@@ -110,6 +110,31 @@ func TestRecordEvent_GatewayRejected(t *testing.T) {
 	cw.AssertExpectations(t)
 }
 
+func TestRecordEvent_CurrencyDimension(t *testing.T) {
+	ctx := context.Background()
+	cw := new(mockCloudWatch)
+
+	cw.On("PutMetricData", ctx, mock.Anything).Return(nil, nil)
+
+	svc := New(cw, "PaymentSystem")
+
+	for _, code := range []string{"usd", "bogus"} {
+		event := events.New(events.PaymentInitiated, "pay-123", "user-456")
+		event.WithAmount(decimal.NewFromInt(100), code)
+
+		assert.NoError(t, svc.RecordEvent(ctx, &event))
+	}
+
+	var got []string
+
+	for _, call := range cw.Calls {
+		input := call.Arguments[1].(*cloudwatch.PutMetricDataInput)
+		got = append(got, *input.MetricData[1].Dimensions[1].Value)
+	}
+
+	assert.Equal(t, []string{"USD", "UNKNOWN"}, got)
+}
+
 func TestGetStats(t *testing.T) {
 	svc := New(nil, "PaymentSystem")
 
@@ -0,0 +1,86 @@
+// Command migrate rewrites the payment and refund amounts stored as strings
+// by older code as numbers, the encoding the service reads and updates, and
+// gives payments created before the listing indexes their sort_key:
+//
+//	migrate -dry-run
+//
+// It reads the tables named by PAYMENTS_TABLE and REFUNDS_TABLE and can run
+// while the service is live; run it again until nothing is left. Payments
+// whose amount was stored as an empty map carry no amount to recover and are
+// listed for manual repair.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/service"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "count the items to rewrite without writing")
+	flag.Parse()
+
+	if err := run(context.Background(), *dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, dryRun bool) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("load aws config: %w", err)
+	}
+
+	db := dynamodb.NewFromConfig(cfg)
+
+	migrations := []money.Migration{
+		{
+			Table:      os.Getenv("PAYMENTS_TABLE"),
+			Attributes: []string{"amount", "refunded_amount", "authorized_amount"},
+		},
+		{Table: os.Getenv("REFUNDS_TABLE"), Attributes: []string{"amount"}},
+	}
+
+	for _, m := range migrations {
+		m.DryRun = dryRun
+
+		report, err := m.Run(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: scanned %d, rewrote %d\n", m.Table, report.Scanned, report.Rewritten)
+
+		for _, id := range report.Changed {
+			fmt.Printf("%s: %s changed during the migration, run again\n", m.Table, id)
+		}
+
+		for _, id := range report.Unreadable {
+			fmt.Printf("%s: %s has an id or amount that cannot be read\n", m.Table, id)
+		}
+	}
+
+	table := os.Getenv("PAYMENTS_TABLE")
+	svc := service.New(db, nil, nil, service.Config{PaymentsTable: table})
+
+	report, err := svc.BackfillSortKeys(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: scanned %d without sort_key, backfilled %d\n", table, report.Scanned, report.Backfilled)
+
+	for _, id := range report.Unreadable {
+		fmt.Printf("%s: %s has a created_at that cannot be read\n", table, id)
+	}
+
+	return nil
+}
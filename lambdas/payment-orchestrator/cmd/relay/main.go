@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/publisher"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/handler"
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/service"
+)
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	db := dynamodb.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+	rec := timeline.NewRecorder(db, os.Getenv("TIMELINE_TABLE"), "payment-orchestrator")
+	pub := timeline.NewPublisher(publisher.NewSQS(sqsClient), rec)
+	bus := timeline.NewPublisher(
+		publisher.NewEventBridge(eventbridge.NewFromConfig(cfg), "payment-orchestrator"),
+		rec,
+	)
+
+	svc := service.New(db, pub, bus, service.Config{
+		PaymentsTable:    os.Getenv("PAYMENTS_TABLE"),
+		IdempotencyTable: os.Getenv("IDEMPOTENCY_TABLE"),
+		OutboxTable:      os.Getenv("OUTBOX_TABLE"),
+		RefundsTable:     os.Getenv("REFUNDS_TABLE"),
+		TimelineTable:    os.Getenv("TIMELINE_TABLE"),
+		WebhooksTable:    os.Getenv("WEBHOOKS_TABLE"),
+		DeliveriesTable:  os.Getenv("WEBHOOK_DELIVERIES_TABLE"),
+		WalletQueueURL:   os.Getenv("WALLET_QUEUE_URL"),
+		GatewayQueueURL:  os.Getenv("GATEWAY_QUEUE_URL"),
+		EventBusName:     os.Getenv("EVENT_BUS_NAME"),
+	})
+
+	batchSize := int32(25)
+	if v := os.Getenv("OUTBOX_BATCH_SIZE"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 32); err == nil {
+			batchSize = int32(n)
+		}
+	}
+
+	r := handler.NewRelay(svc, batchSize)
+	lambda.Start(r.Handle)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/idempotency"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	awsEvents "github.com/aws/aws-lambda-go/events"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/service"
+)
+
+// Consumer advances payments from the events other services send to the
+// orchestrator queue.
+type Consumer struct {
+	svc      *service.Service
+	recorder *timeline.Recorder
+	guard    *idempotency.Guard
+}
+
+func NewConsumer(svc *service.Service, recorder *timeline.Recorder, guard *idempotency.Guard) *Consumer {
+	return &Consumer{svc: svc, recorder: recorder, guard: guard}
+}
+
+func (c *Consumer) Handle(ctx context.Context, sqsEvent *awsEvents.SQSEvent) error {
+	slog.Info("processing batch", "count", len(sqsEvent.Records))
+
+	var lastErr error
+
+	for i := range sqsEvent.Records {
+		record := sqsEvent.Records[i]
+
+		if err := c.processRecord(ctx, &record); err != nil {
+			slog.Error("failed to process record", "error", err, "message_id", record.MessageId)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Consumer) processRecord(ctx context.Context, record *awsEvents.SQSMessage) error {
+	var event events.Event
+	if err := json.Unmarshal([]byte(record.Body), &event); err != nil {
+		return fmt.Errorf("unmarshal event: %w", err)
+	}
+
+	slog.Info("processing event", "type", event.Type, "payment_id", event.PaymentID)
+	c.recorder.Observe(ctx, &event)
+
+	return c.guard.Process(ctx, &event, c.advance)
+}
+
+// advance moves the payment on, once per event (see idempotency.Guard).
+func (c *Consumer) advance(ctx context.Context, event *events.Event) error {
+	err := c.dispatch(ctx, event)
+	if errors.Is(err, service.ErrInvalidTransition) {
+		// Duplicated or out-of-order delivery; the payment already moved on.
+		slog.Warn("ignoring stale event", "type", event.Type, "payment_id", event.PaymentID, "error", err)
+
+		return nil
+	}
+
+	return err
+}
+
+func (c *Consumer) dispatch(ctx context.Context, event *events.Event) error {
+	switch event.Type {
+	case events.FundsReserved:
+		return c.svc.MarkReserved(ctx, event.PaymentID, event.ReservationID)
+	case events.GatewayPaymentApproved:
+		if event.CaptureMode == events.CaptureManual {
+			return c.svc.MarkAuthorized(ctx, event.PaymentID, event.ReservationID, event.GatewayRef)
+		}
+
+		return c.svc.MarkProcessing(ctx, event.PaymentID, event.GatewayRef)
+	case events.FundsDeducted:
+		return c.svc.CompletePayment(ctx, event.PaymentID, event.GatewayRef)
+	case events.FundsReservationFailed, events.GatewayPaymentRejected:
+		return c.svc.FailPayment(ctx, event.PaymentID, event.Reason)
+	case events.FundsReleased:
+		// The wallet released the hold on its own, e.g. the reservation
+		// expired. Releases we asked for find the payment already settled.
+		return c.svc.FailPayment(ctx, event.PaymentID, event.Reason)
+	case events.FundsRefunded:
+		return c.svc.CompleteRefund(ctx, event.RefundID)
+	case events.GatewayRefundFailed:
+		return c.svc.FailRefund(ctx, event.RefundID, event.Reason)
+	default:
+		slog.Warn("unknown event type", "type", event.Type)
+		return nil
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 
@@ -13,6 +15,11 @@ import (
 	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/pkg/models"
 )
 
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
 type Handler struct {
 	svc *service.Service
 }
@@ -25,11 +32,31 @@ func (h *Handler) Handle(
 	ctx context.Context,
 	req *events.APIGatewayProxyRequest,
 ) (events.APIGatewayProxyResponse, error) {
-	switch req.HTTPMethod {
-	case http.MethodPost:
+	switch req.Resource + " " + req.HTTPMethod {
+	case "/payments POST":
 		return h.createPayment(ctx, req)
-	case http.MethodGet:
+	case "/payments GET":
+		return h.listPayments(ctx, req)
+	case "/payments/{id} GET":
 		return h.getPayment(ctx, req)
+	case "/payments/{id}/events GET":
+		return h.listEvents(ctx, req)
+	case "/payments/{id}/cancel POST":
+		return h.cancelPayment(ctx, req)
+	case "/payments/{id}/capture POST":
+		return h.capturePayment(ctx, req)
+	case "/payments/{id}/void POST":
+		return h.voidPayment(ctx, req)
+	case "/payments/{id}/refunds POST":
+		return h.createRefund(ctx, req)
+	case "/payments/{id}/webhooks GET":
+		return h.listWebhookDeliveries(ctx, req)
+	case "/payments/{id}/webhooks/{deliveryId}/redeliver POST":
+		return h.redeliverWebhook(ctx, req)
+	case "/services/{id}/webhook PUT":
+		return h.registerWebhook(ctx, req)
+	case "/services/{id}/webhook GET":
+		return h.getWebhook(ctx, req)
 	default:
 		return h.response(http.StatusMethodNotAllowed, models.ErrorJSON("method not allowed")), nil
 	}
@@ -50,12 +77,88 @@ func (h *Handler) createPayment(
 		return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
 	}
 
+	key := header(req, idempotencyKeyHeader)
+	if key == "" {
+		resp, _ := h.processPayment(ctx, &input)
+
+		return resp, nil
+	}
+
+	if len(key) > maxIdempotencyKeyLen {
+		return h.response(
+			http.StatusBadRequest,
+			models.ErrorJSON("idempotency key is too long"),
+		), nil
+	}
+
+	return h.processPaymentOnce(ctx, key, &input), nil
+}
+
+// processPaymentOnce runs processPayment at most once per Idempotency-Key,
+// replaying the stored response for identical retries.
+func (h *Handler) processPaymentOnce(
+	ctx context.Context,
+	key string,
+	input *models.CreatePaymentRequest,
+) events.APIGatewayProxyResponse {
+	record, err := h.svc.ClaimIdempotencyKey(ctx, input.UserID, key, input.Fingerprint())
+	switch {
+	case errors.Is(err, service.ErrIdempotencyKeyReused):
+		return h.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error()))
+	case errors.Is(err, service.ErrIdempotencyKeyInProgress):
+		return h.response(http.StatusConflict, models.ErrorJSON(err.Error()))
+	case err != nil:
+		slog.Error("failed to claim idempotency key", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to create payment"),
+		)
+	}
+
+	if record.Status == service.IdempotencyCompleted {
+		resp := h.response(record.StatusCode, record.ResponseBody)
+		resp.Headers["Idempotent-Replayed"] = "true"
+
+		return resp
+	}
+
+	resp, paymentID := h.processPayment(ctx, input)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		if err := h.svc.ReleaseIdempotencyKey(ctx, input.UserID, key); err != nil {
+			slog.Error("failed to release idempotency key", "error", err)
+		}
+
+		return resp
+	}
+
+	if err := h.svc.CompleteIdempotencyKey(
+		ctx,
+		input.UserID,
+		key,
+		paymentID,
+		resp.StatusCode,
+		resp.Body,
+	); err != nil {
+		slog.Error("failed to complete idempotency key", "error", err)
+	}
+
+	return resp
+}
+
+// processPayment creates the payment and returns the response along with the
+// new payment ID, which is empty on failure.
+func (h *Handler) processPayment(
+	ctx context.Context,
+	input *models.CreatePaymentRequest,
+) (events.APIGatewayProxyResponse, string) {
 	payment, err := h.svc.CreatePayment(
 		ctx,
 		input.UserID,
 		input.ServiceID,
 		input.Currency,
 		input.Description,
+		input.CaptureMode,
 		input.Amount,
 	)
 	if err != nil {
@@ -64,21 +167,10 @@ func (h *Handler) createPayment(
 		return h.response(
 			http.StatusInternalServerError,
 			models.ErrorJSON("failed to create payment"),
-		), nil
-	}
-
-	dto := models.PaymentDTO{
-		ID:          payment.ID,
-		UserID:      payment.UserID,
-		ServiceID:   payment.ServiceID,
-		Amount:      payment.Amount.String(),
-		Currency:    payment.Currency,
-		Status:      payment.Status,
-		Description: payment.Description,
-		CreatedAt:   payment.CreatedAt,
+		), ""
 	}
 
-	return h.response(http.StatusAccepted, models.SuccessJSON(dto)), nil
+	return h.response(http.StatusAccepted, models.SuccessJSON(toDTO(payment))), payment.ID
 }
 
 func (h *Handler) getPayment(
@@ -102,20 +194,390 @@ func (h *Handler) getPayment(
 		), nil
 	}
 
-	dto := models.PaymentDTO{
-		ID:          payment.ID,
-		UserID:      payment.UserID,
-		ServiceID:   payment.ServiceID,
-		Amount:      payment.Amount.String(),
-		Currency:    payment.Currency,
-		Status:      payment.Status,
-		Description: payment.Description,
-		CreatedAt:   payment.CreatedAt,
+	return h.response(http.StatusOK, models.SuccessJSON(toDTO(payment))), nil
+}
+
+func (h *Handler) listPayments(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	input, err := models.ParseListPaymentsRequest(req.QueryStringParameters)
+	if err != nil {
+		return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	page, err := h.svc.ListPayments(ctx, &service.PaymentFilter{
+		UserID:    input.UserID,
+		ServiceID: input.ServiceID,
+		Status:    input.Status,
+		From:      input.From,
+		To:        input.To,
+		NextToken: input.NextToken,
+		Limit:     int32(input.Limit),
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidPageToken) {
+			return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+		}
+
+		slog.Error("failed to list payments", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to list payments"),
+		), nil
+	}
+
+	dto := models.PaymentListDTO{
+		Payments:  make([]models.PaymentDTO, 0, len(page.Payments)),
+		NextToken: page.NextToken,
+	}
+	for i := range page.Payments {
+		dto.Payments = append(dto.Payments, toDTO(&page.Payments[i]))
 	}
 
 	return h.response(http.StatusOK, models.SuccessJSON(dto)), nil
 }
 
+func (h *Handler) listEvents(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	entries, err := h.svc.ListEvents(ctx, req.PathParameters["id"])
+	if err != nil {
+		if errors.Is(err, service.ErrPaymentNotFound) {
+			return h.response(http.StatusNotFound, models.ErrorJSON("payment not found")), nil
+		}
+
+		slog.Error("failed to list payment events", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to list payment events"),
+		), nil
+	}
+
+	dto := make([]models.PaymentEventDTO, 0, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		item := models.PaymentEventDTO{
+			OccurredAt:    e.OccurredAt,
+			ID:            e.EventID,
+			Type:          e.Type,
+			Source:        e.Source,
+			Currency:      e.Currency,
+			Reason:        e.Reason,
+			ReservationID: e.ReservationID,
+			GatewayRef:    e.GatewayRef,
+			RefundID:      e.RefundID,
+		}
+
+		if !e.Amount.IsZero() {
+			item.Amount = e.Amount.String()
+		}
+
+		dto = append(dto, item)
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(dto)), nil
+}
+
+func (h *Handler) cancelPayment(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	payment, err := h.svc.Cancel(ctx, req.PathParameters["id"])
+	switch {
+	case errors.Is(err, service.ErrPaymentNotFound):
+		return h.response(http.StatusNotFound, models.ErrorJSON("payment not found")), nil
+	case errors.Is(err, service.ErrPaymentNotCancellable):
+		return h.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to cancel payment", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to cancel payment"),
+		), nil
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(toDTO(payment))), nil
+}
+
+func (h *Handler) capturePayment(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	var input models.CaptureRequest
+	if req.Body != "" {
+		if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+			slog.Error("failed to unmarshal capture request", "error", err)
+
+			return h.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+		}
+	}
+
+	if err := input.Validate(); err != nil {
+		return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	payment, err := h.svc.Capture(ctx, req.PathParameters["id"], input.Amount)
+	if err != nil {
+		return h.settleError(err, "failed to capture payment"), nil
+	}
+
+	return h.response(http.StatusAccepted, models.SuccessJSON(toDTO(payment))), nil
+}
+
+func (h *Handler) voidPayment(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	payment, err := h.svc.Void(ctx, req.PathParameters["id"])
+	if err != nil {
+		return h.settleError(err, "failed to void payment"), nil
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(toDTO(payment))), nil
+}
+
+// settleError maps capture and void failures to responses.
+func (h *Handler) settleError(err error, msg string) events.APIGatewayProxyResponse {
+	switch {
+	case errors.Is(err, service.ErrPaymentNotFound):
+		return h.response(http.StatusNotFound, models.ErrorJSON("payment not found"))
+	case errors.Is(err, service.ErrPaymentNotAuthorized),
+		errors.Is(err, service.ErrCaptureExceedsAuthorization):
+		return h.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error()))
+	case errors.Is(err, service.ErrInvalidTransition):
+		return h.response(http.StatusConflict, models.ErrorJSON(err.Error()))
+	default:
+		slog.Error(msg, "error", err)
+
+		return h.response(http.StatusInternalServerError, models.ErrorJSON(msg))
+	}
+}
+
+func (h *Handler) createRefund(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	var input models.CreateRefundRequest
+	if req.Body != "" {
+		if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+			slog.Error("failed to unmarshal create refund request", "error", err)
+
+			return h.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+		}
+	}
+
+	if err := input.Validate(); err != nil {
+		return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	refund, err := h.svc.RequestRefund(ctx, req.PathParameters["id"], input.Amount, input.Reason)
+	switch {
+	case errors.Is(err, service.ErrPaymentNotFound):
+		return h.response(http.StatusNotFound, models.ErrorJSON("payment not found")), nil
+	case errors.Is(err, service.ErrPaymentNotRefundable),
+		errors.Is(err, service.ErrRefundExceedsPayment):
+		return h.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case errors.Is(err, service.ErrRefundConflict):
+		return h.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to create refund", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to create refund"),
+		), nil
+	}
+
+	return h.response(http.StatusAccepted, models.SuccessJSON(models.RefundDTO{
+		ID:        refund.ID,
+		PaymentID: refund.PaymentID,
+		Amount:    refund.Amount.String(),
+		Currency:  refund.Currency,
+		Status:    refund.Status,
+		Reason:    refund.Reason,
+		CreatedAt: refund.CreatedAt,
+	})), nil
+}
+
+func (h *Handler) registerWebhook(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	var input models.RegisterWebhookRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal register webhook request", "error", err)
+
+		return h.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return h.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	endpoint, err := h.svc.RegisterWebhook(ctx, req.PathParameters["id"], input.URL)
+	if err != nil {
+		slog.Error("failed to register webhook", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to register webhook"),
+		), nil
+	}
+
+	dto := toEndpointDTO(endpoint)
+	dto.Secret = endpoint.Secret
+
+	return h.response(http.StatusOK, models.SuccessJSON(dto)), nil
+}
+
+func (h *Handler) getWebhook(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	endpoint, err := h.svc.GetWebhook(ctx, req.PathParameters["id"])
+	if err != nil {
+		if errors.Is(err, service.ErrWebhookNotFound) {
+			return h.response(http.StatusNotFound, models.ErrorJSON(err.Error())), nil
+		}
+
+		slog.Error("failed to get webhook", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to get webhook"),
+		), nil
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(toEndpointDTO(endpoint))), nil
+}
+
+func (h *Handler) listWebhookDeliveries(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	deliveries, err := h.svc.ListWebhookDeliveries(ctx, req.PathParameters["id"])
+	if err != nil {
+		if errors.Is(err, service.ErrPaymentNotFound) {
+			return h.response(http.StatusNotFound, models.ErrorJSON("payment not found")), nil
+		}
+
+		slog.Error("failed to list webhook deliveries", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to list webhook deliveries"),
+		), nil
+	}
+
+	dto := make([]models.WebhookDeliveryDTO, 0, len(deliveries))
+	for i := range deliveries {
+		dto = append(dto, toDeliveryDTO(&deliveries[i]))
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(dto)), nil
+}
+
+func (h *Handler) redeliverWebhook(
+	ctx context.Context,
+	req *events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	delivery, err := h.svc.RedeliverWebhook(
+		ctx,
+		req.PathParameters["id"],
+		req.PathParameters["deliveryId"],
+	)
+	if err != nil {
+		if errors.Is(err, service.ErrDeliveryNotFound) {
+			return h.response(http.StatusNotFound, models.ErrorJSON(err.Error())), nil
+		}
+
+		if errors.Is(err, service.ErrDeliveryConflict) {
+			return h.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+		}
+
+		slog.Error("failed to redeliver webhook", "error", err)
+
+		return h.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to redeliver webhook"),
+		), nil
+	}
+
+	return h.response(http.StatusOK, models.SuccessJSON(toDeliveryDTO(delivery))), nil
+}
+
+func toEndpointDTO(endpoint *service.WebhookEndpoint) models.WebhookEndpointDTO {
+	return models.WebhookEndpointDTO{
+		ServiceID: endpoint.ServiceID,
+		URL:       endpoint.URL,
+		CreatedAt: endpoint.CreatedAt,
+		UpdatedAt: endpoint.UpdatedAt,
+	}
+}
+
+func toDeliveryDTO(delivery *service.WebhookDelivery) models.WebhookDeliveryDTO {
+	dto := models.WebhookDeliveryDTO{
+		ID:        delivery.ID,
+		PaymentID: delivery.PaymentID,
+		ServiceID: delivery.ServiceID,
+		EventType: delivery.EventType,
+		Status:    delivery.Status,
+		Attempts:  make([]models.WebhookAttemptDTO, 0, len(delivery.Attempts)),
+		CreatedAt: delivery.CreatedAt,
+		UpdatedAt: delivery.UpdatedAt,
+	}
+
+	if delivery.NextAttemptAt != 0 {
+		next := time.Unix(delivery.NextAttemptAt, 0).UTC()
+		dto.NextAttemptAt = &next
+	}
+
+	for _, a := range delivery.Attempts {
+		dto.Attempts = append(dto.Attempts, models.WebhookAttemptDTO{
+			At:         a.At,
+			URL:        a.URL,
+			StatusCode: a.StatusCode,
+			DurationMs: a.DurationMs,
+			Error:      a.Error,
+			Manual:     a.Manual,
+		})
+	}
+
+	return dto
+}
+
+func toDTO(payment *service.Payment) models.PaymentDTO {
+	dto := models.PaymentDTO{
+		ID:            payment.ID,
+		UserID:        payment.UserID,
+		ServiceID:     payment.ServiceID,
+		Amount:        payment.Amount.String(),
+		Currency:      payment.Currency,
+		Status:        payment.Status,
+		Description:   payment.Description,
+		CaptureMode:   payment.CaptureMode,
+		GatewayRef:    payment.GatewayRef,
+		FailureReason: payment.FailureReason,
+		CreatedAt:     payment.CreatedAt,
+		UpdatedAt:     payment.UpdatedAt,
+	}
+
+	if payment.AuthorizedAmount != nil {
+		dto.AuthorizedAmount = payment.AuthorizedAmount.String()
+	}
+
+	if !payment.RefundedAmount.IsZero() {
+		dto.RefundedAmount = payment.RefundedAmount.String()
+	}
+
+	return dto
+}
+
 func (h *Handler) response(status int, body string) events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
 		StatusCode: status,
@@ -123,3 +585,16 @@ func (h *Handler) response(status int, body string) events.APIGatewayProxyRespon
 		Body:       body,
 	}
 }
+
+// header returns the first value of a request header, matched
+// case-insensitively since API Gateway forwards header names as the client sent
+// them.
+func header(req *events.APIGatewayProxyRequest, name string) string {
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/service"
+)
+
+// Relay delivers pending outbox entries on a schedule.
+type Relay struct {
+	svc       *service.Service
+	batchSize int32
+}
+
+func NewRelay(svc *service.Service, batchSize int32) *Relay {
+	return &Relay{svc: svc, batchSize: batchSize}
+}
+
+func (r *Relay) Handle(ctx context.Context) error {
+	sent, err := r.svc.RelayOutbox(ctx, r.batchSize)
+	if err != nil {
+		slog.Error("outbox relay finished with errors", "error", err, "sent", sent)
+
+		return err
+	}
+
+	return nil
+}
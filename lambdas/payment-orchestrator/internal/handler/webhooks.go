@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	awsEvents "github.com/aws/aws-lambda-go/events"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/payment-orchestrator/internal/service"
+)
+
+// scheduledEvent is the detail type EventBridge uses for schedule rules.
+const scheduledEvent = "Scheduled Event"
+
+// Webhooks notifies services of their payment outcomes. It is the target of two
+// EventBridge rules: payment outcomes on the bus, which create and send the
+// webhook, and a schedule, which retries failed deliveries.
+type Webhooks struct {
+	svc       *service.Service
+	batchSize int32
+}
+
+func NewWebhooks(svc *service.Service, batchSize int32) *Webhooks {
+	return &Webhooks{svc: svc, batchSize: batchSize}
+}
+
+func (w *Webhooks) Handle(ctx context.Context, ebEvent *awsEvents.CloudWatchEvent) error {
+	if ebEvent.DetailType == scheduledEvent {
+		delivered, err := w.svc.RetryWebhooks(ctx, w.batchSize)
+		if err != nil {
+			slog.Error("webhook retry finished with errors", "error", err, "delivered", delivered)
+
+			return err
+		}
+
+		return nil
+	}
+
+	var event events.Event
+	if err := json.Unmarshal(ebEvent.Detail, &event); err != nil {
+		return fmt.Errorf("unmarshal event: %w", err)
+	}
+
+	if err := w.svc.DispatchWebhook(ctx, &event); err != nil {
+		slog.Error(
+			"failed to dispatch webhook",
+			"error", err,
+			"event_type", event.Type,
+			"payment_id", event.PaymentID,
+		)
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// BackfillReport is what BackfillSortKeys found in the payments table.
+type BackfillReport struct {
+	Scanned    int
+	Backfilled int
+	// Unreadable lists the payments whose created_at cannot be parsed, so no
+	// sort key can be derived for them.
+	Unreadable []string
+}
+
+// BackfillSortKeys sets sort_key on the payments written before it existed,
+// which the listing indexes leave out until they have one. Each write is
+// conditioned on the payment still lacking it, so running it again, or while
+// the service is live, changes nothing already set. With dryRun it only
+// counts.
+func (s *Service) BackfillSortKeys(ctx context.Context, dryRun bool) (*BackfillReport, error) {
+	report := &BackfillReport{}
+
+	var start map[string]types.AttributeValue
+
+	for {
+		page, err := s.db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:            aws.String(s.tableName),
+			ProjectionExpression: aws.String("id, created_at"),
+			FilterExpression:     aws.String("attribute_not_exists(sort_key)"),
+			ExclusiveStartKey:    start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan payments: %w", err)
+		}
+
+		for _, item := range page.Items {
+			report.Scanned++
+
+			if err := s.backfillSortKey(ctx, item, dryRun, report); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+func (s *Service) backfillSortKey(
+	ctx context.Context,
+	item map[string]types.AttributeValue,
+	dryRun bool,
+	report *BackfillReport,
+) error {
+	id, ok := item["id"].(*types.AttributeValueMemberS)
+	if !ok {
+		report.Unreadable = append(report.Unreadable, fmt.Sprintf("%v", item["id"]))
+
+		return nil
+	}
+
+	raw, ok := item["created_at"].(*types.AttributeValueMemberS)
+	if !ok {
+		report.Unreadable = append(report.Unreadable, id.Value)
+
+		return nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, raw.Value)
+	if err != nil {
+		report.Unreadable = append(report.Unreadable, id.Value)
+
+		return nil
+	}
+
+	if dryRun {
+		report.Backfilled++
+
+		return nil
+	}
+
+	_, err = s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": id,
+		},
+		UpdateExpression:    aws.String("SET sort_key = :sort_key"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(sort_key)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sort_key": &types.AttributeValueMemberS{Value: sortKey(createdAt, id.Value)},
+		},
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return nil
+		}
+
+		return fmt.Errorf("backfill sort key of %s: %w", id.Value, err)
+	}
+
+	report.Backfilled++
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var ErrPaymentNotCancellable = errors.New("only pending or reserved payments can be cancelled")
+
+// Cancel stops a payment that has not reached the gateway yet. The status
+// change and one payment.cancelled entry per destination are written in one
+// transaction: the wallet releases whatever it reserved, and pays back what it
+// already deducted, the gateway skips the charge if the reservation is still on
+// its way and the event bus tells subscribers. An approval the gateway had
+// already sent is reversed when it arrives (see reverseLateApproval).
+func (s *Service) Cancel(ctx context.Context, paymentID string) (*Payment, error) {
+	payment, err := s.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status != StatusPending && payment.Status != StatusReserved {
+		return nil, ErrPaymentNotCancellable
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.tableName),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: payment.ID},
+				},
+				UpdateExpression:         aws.String("SET #status = :cancelled, updated_at = :now"),
+				ConditionExpression:      aws.String("#status IN (:pending, :reserved)"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":cancelled": &types.AttributeValueMemberS{Value: StatusCancelled},
+					":pending":   &types.AttributeValueMemberS{Value: StatusPending},
+					":reserved":  &types.AttributeValueMemberS{Value: StatusReserved},
+					":now":       &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+				},
+			},
+		},
+	}
+
+	entries, err := outboxEntries(func() events.Event {
+		return cancelledEvent(payment)
+	}, s.walletQueueURL, s.gatewayQueueURL, s.eventBusName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		put, err := s.outboxPut(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, put)
+	}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			// The payment moved on between the read and the write.
+			return nil, ErrPaymentNotCancellable
+		}
+
+		return nil, fmt.Errorf("cancel payment: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := s.deliver(ctx, entry); err != nil {
+			slog.Error("failed to publish event", "error", err, "payment_id", payment.ID)
+		}
+	}
+
+	payment.Status = StatusCancelled
+
+	slog.Info("payment cancelled", "payment_id", payment.ID)
+
+	return payment, nil
+}
+
+func cancelledEvent(payment *Payment) events.Event {
+	event := events.New(events.PaymentCancelled, payment.ID, payment.UserID)
+	event.WithAmount(payment.Amount.Decimal, payment.Currency).
+		WithReservation(payment.ReservationID).
+		WithReason("cancelled")
+
+	return event
+}
+
+// reverseLateApproval handles a gateway approval that lost the race with
+// Cancel: the gateway charged, or authorized, a payment whose reservation the
+// wallet has already released, or deducted and then paid back. The payment
+// records the gateway reference and payment.reversal_requested asks the gateway
+// to give the money back, in one transaction guarded on the reference being
+// unset, so a redelivered approval does not reverse twice. err is what the
+// approval's transition returned; it is returned unchanged unless recording the
+// reversal fails.
+func (s *Service) reverseLateApproval(ctx context.Context, paymentID, gatewayRef string, err error) error {
+	if !errors.Is(err, ErrInvalidTransition) {
+		return err
+	}
+
+	payment, getErr := s.GetPayment(ctx, paymentID)
+	if getErr != nil {
+		return getErr
+	}
+
+	if payment.Status != StatusCancelled {
+		return err
+	}
+
+	event := events.New(events.ReversalRequested, payment.ID, payment.UserID)
+	event.WithAmount(payment.Amount.Decimal, payment.Currency).
+		WithGatewayRef(gatewayRef).
+		WithCaptureMode(payment.CaptureMode).
+		WithReason("cancelled")
+
+	entry, entryErr := newOutboxEntry(&event, s.gatewayQueueURL)
+	if entryErr != nil {
+		return entryErr
+	}
+
+	outboxPut, putErr := s.outboxPut(entry)
+	if putErr != nil {
+		return putErr
+	}
+
+	_, writeErr := s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.tableName),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: payment.ID},
+					},
+					UpdateExpression: aws.String("SET gateway_ref = :ref, updated_at = :now"),
+					ConditionExpression: aws.String(
+						"#status = :cancelled AND attribute_not_exists(gateway_ref)",
+					),
+					ExpressionAttributeNames: map[string]string{"#status": "status"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":ref":       &types.AttributeValueMemberS{Value: gatewayRef},
+						":cancelled": &types.AttributeValueMemberS{Value: StatusCancelled},
+						":now":       &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+					},
+				},
+			},
+			outboxPut,
+		},
+	})
+	if writeErr != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(writeErr, &tce) && conditionFailed(tce, 0) {
+			// Already reversed.
+			return err
+		}
+
+		return fmt.Errorf("request reversal: %w", writeErr)
+	}
+
+	if deliverErr := s.deliver(ctx, entry); deliverErr != nil {
+		slog.Error("failed to publish event", "error", deliverErr, "payment_id", payment.ID)
+	}
+
+	slog.Warn("gateway approved a cancelled payment, reversing", "payment_id", payment.ID, "gateway_ref", gatewayRef)
+
+	return err
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrPaymentNotAuthorized        = errors.New("payment is not awaiting capture")
+	ErrCaptureExceedsAuthorization = errors.New("capture exceeds the authorized amount")
+)
+
+// Capture charges an authorized payment for amount, or for the full authorized
+// amount when amount is zero. The payment moves to processing and the gateway
+// is asked to capture it; once it does, the wallet deducts the captured amount
+// from the reservation, releasing the rest, and wallet.funds_deducted completes
+// the payment as in automatic mode.
+func (s *Service) Capture(ctx context.Context, paymentID string, amount decimal.Decimal) (*Payment, error) {
+	payment, err := s.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status != StatusAuthorized {
+		return nil, ErrPaymentNotAuthorized
+	}
+
+	if amount.IsZero() {
+		amount = payment.Amount.Decimal
+	}
+
+	if !amount.IsPositive() || amount.GreaterThan(payment.Amount.Decimal) {
+		return nil, ErrCaptureExceedsAuthorization
+	}
+
+	entries, err := outboxEntries(func() events.Event {
+		event := events.New(events.CaptureRequested, payment.ID, payment.UserID)
+		event.WithAmount(amount, payment.Currency).
+			WithReservation(payment.ReservationID).
+			WithGatewayRef(payment.GatewayRef)
+
+		return event
+	}, s.gatewayQueueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.settleAuthorization(ctx, payment.ID, &types.Update{
+		UpdateExpression: aws.String(
+			"SET #status = :to, authorized_amount = amount, amount = :amount, updated_at = :now",
+		),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":to":     &types.AttributeValueMemberS{Value: StatusProcessing},
+			":amount": &types.AttributeValueMemberN{Value: amount.String()},
+		},
+	}, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized := payment.Amount
+	payment.AuthorizedAmount = &authorized
+	payment.Amount.Decimal = amount
+	payment.Status = StatusProcessing
+
+	slog.Info("payment captured", "payment_id", payment.ID, "amount", amount.String())
+
+	return payment, nil
+}
+
+// Void cancels an authorized payment: the gateway drops the authorization, the
+// wallet releases the reservation and payment.voided is broadcast. Nothing is
+// charged.
+func (s *Service) Void(ctx context.Context, paymentID string) (*Payment, error) {
+	payment, err := s.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status != StatusAuthorized {
+		return nil, ErrPaymentNotAuthorized
+	}
+
+	entries, err := outboxEntries(func() events.Event {
+		event := events.New(events.PaymentVoided, payment.ID, payment.UserID)
+		event.WithAmount(payment.Amount.Decimal, payment.Currency).
+			WithReservation(payment.ReservationID).
+			WithGatewayRef(payment.GatewayRef).
+			WithReason("voided")
+
+		return event
+	}, s.walletQueueURL, s.gatewayQueueURL, s.eventBusName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.settleAuthorization(ctx, payment.ID, &types.Update{
+		UpdateExpression: aws.String("SET #status = :to, updated_at = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":to": &types.AttributeValueMemberS{Value: StatusVoided},
+		},
+	}, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	payment.Status = StatusVoided
+
+	slog.Info("payment voided", "payment_id", payment.ID)
+
+	return payment, nil
+}
+
+// settleAuthorization applies update to an authorized payment and records
+// entries in the outbox, in one transaction.
+func (s *Service) settleAuthorization(
+	ctx context.Context,
+	paymentID string,
+	update *types.Update,
+	entries []*OutboxEntry,
+) error {
+	items := []types.TransactWriteItem{{Update: update}}
+
+	for _, entry := range entries {
+		put, err := s.outboxPut(entry)
+		if err != nil {
+			return err
+		}
+
+		items = append(items, put)
+	}
+
+	update.TableName = aws.String(s.tableName)
+	update.Key = map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: paymentID},
+	}
+	update.ConditionExpression = aws.String("#status = :authorized")
+	update.ExpressionAttributeNames = map[string]string{"#status": "status"}
+	update.ExpressionAttributeValues[":authorized"] = &types.AttributeValueMemberS{Value: StatusAuthorized}
+	update.ExpressionAttributeValues[":now"] = &types.AttributeValueMemberS{
+		Value: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	_, err := s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			// A concurrent capture or void got there first.
+			return fmt.Errorf("%w: payment %s is no longer authorized", ErrInvalidTransition, paymentID)
+		}
+
+		return fmt.Errorf("settle authorization: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := s.deliver(ctx, entry); err != nil {
+			slog.Error("failed to publish event", "error", err, "payment_id", paymentID)
+		}
+	}
+
+	return nil
+}
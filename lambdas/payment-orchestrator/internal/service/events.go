@@ -0,0 +1,17 @@
+package service
+
+import (
+	"context"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+)
+
+// ListEvents returns every event recorded for a payment by any service,
+// oldest first.
+func (s *Service) ListEvents(ctx context.Context, paymentID string) ([]timeline.Entry, error) {
+	if _, err := s.GetPayment(ctx, paymentID); err != nil {
+		return nil, err
+	}
+
+	return s.timeline.List(ctx, paymentID)
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key already used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// Idempotency record statuses.
+const (
+	IdempotencyInProgress = "in_progress"
+	IdempotencyCompleted  = "completed"
+)
+
+const (
+	// idempotencyLockTTL bounds how long an unfinished request holds its key,
+	// so a crashed invocation does not block the client forever. It is the
+	// longest a Lambda can run, so no invocation still working on a request
+	// loses its key to a retry.
+	idempotencyLockTTL = 15 * time.Minute
+	// idempotencyRetention is how long a finished response can be replayed.
+	idempotencyRetention = 24 * time.Hour
+)
+
+// IdempotencyRecord remembers a request sent with an Idempotency-Key header
+// and, once finished, the response to replay for identical retries.
+type IdempotencyRecord struct {
+	CreatedAt    time.Time `dynamodbav:"created_at"`
+	Key          string    `dynamodbav:"idempotency_key"`
+	Fingerprint  string    `dynamodbav:"fingerprint"`
+	Status       string    `dynamodbav:"status"`
+	PaymentID    string    `dynamodbav:"payment_id,omitempty"`
+	ResponseBody string    `dynamodbav:"response_body,omitempty"`
+	StatusCode   int       `dynamodbav:"status_code,omitempty"`
+	ExpiresAt    int64     `dynamodbav:"expires_at"`
+}
+
+// ClaimIdempotencyKey reserves a client key for the request identified by
+// fingerprint. Keys are scoped per user. A fresh claim returns an in-progress
+// record; a key already completed for the same request returns the stored
+// record so the caller can replay its response.
+func (s *Service) ClaimIdempotencyKey(
+	ctx context.Context,
+	userID, key, fingerprint string,
+) (*IdempotencyRecord, error) {
+	now := time.Now().UTC()
+	record := &IdempotencyRecord{
+		Key:         scopedKey(userID, key),
+		Fingerprint: fingerprint,
+		Status:      IdempotencyInProgress,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(idempotencyLockTTL).Unix(),
+	}
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return nil, fmt.Errorf("marshal idempotency record: %w", err)
+	}
+
+	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.idempotencyTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(idempotency_key) OR expires_at < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err == nil {
+		return record, nil
+	}
+
+	var ccf *types.ConditionalCheckFailedException
+	if !errors.As(err, &ccf) {
+		return nil, fmt.Errorf("claim idempotency key: %w", err)
+	}
+
+	var existing IdempotencyRecord
+	if err := attributevalue.UnmarshalMap(ccf.Item, &existing); err != nil {
+		return nil, fmt.Errorf("unmarshal idempotency record: %w", err)
+	}
+
+	switch {
+	case existing.Fingerprint != fingerprint:
+		return nil, ErrIdempotencyKeyReused
+	case existing.Status != IdempotencyCompleted:
+		return nil, ErrIdempotencyKeyInProgress
+	default:
+		return &existing, nil
+	}
+}
+
+// CompleteIdempotencyKey stores the response for a claimed key so retries
+// within the retention window receive it unchanged.
+func (s *Service) CompleteIdempotencyKey(
+	ctx context.Context,
+	userID, key, paymentID string,
+	statusCode int,
+	body string,
+) error {
+	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.idempotencyTable),
+		Key: map[string]types.AttributeValue{
+			"idempotency_key": &types.AttributeValueMemberS{Value: scopedKey(userID, key)},
+		},
+		UpdateExpression: aws.String(
+			"SET #status = :completed, payment_id = :pid, status_code = :code, " +
+				"response_body = :body, expires_at = :exp",
+		),
+		ConditionExpression:      aws.String("#status = :in_progress"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed":   &types.AttributeValueMemberS{Value: IdempotencyCompleted},
+			":in_progress": &types.AttributeValueMemberS{Value: IdempotencyInProgress},
+			":pid":         &types.AttributeValueMemberS{Value: paymentID},
+			":code":        &types.AttributeValueMemberN{Value: strconv.Itoa(statusCode)},
+			":body":        &types.AttributeValueMemberS{Value: body},
+			":exp": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(idempotencyRetention).Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey drops an in-progress claim after a failed request so
+// the client can retry with the same key.
+func (s *Service) ReleaseIdempotencyKey(ctx context.Context, userID, key string) error {
+	_, err := s.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.idempotencyTable),
+		Key: map[string]types.AttributeValue{
+			"idempotency_key": &types.AttributeValueMemberS{Value: scopedKey(userID, key)},
+		},
+		ConditionExpression:      aws.String("#status = :in_progress"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":in_progress": &types.AttributeValueMemberS{Value: IdempotencyInProgress},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+func scopedKey(userID, key string) string {
+	return userID + "#" + key
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MarkReserved moves a pending payment to reserved once the wallet holds the
+// funds.
+func (s *Service) MarkReserved(ctx context.Context, paymentID, reservationID string) error {
+	_, err := s.transition(ctx, paymentID, StatusReserved, []string{StatusPending}, map[string]string{
+		"reservation_id": reservationID,
+	})
+
+	return err
+}
+
+// MarkProcessing moves a reserved payment to processing once the gateway
+// accepts it.
+func (s *Service) MarkProcessing(ctx context.Context, paymentID, gatewayRef string) error {
+	_, err := s.transition(ctx, paymentID, StatusProcessing, []string{StatusReserved}, map[string]string{
+		"gateway_ref": gatewayRef,
+	})
+
+	return s.reverseLateApproval(ctx, paymentID, gatewayRef, err)
+}
+
+// MarkAuthorized moves a manual-capture payment to authorized once the gateway
+// accepts it. The wallet keeps the reservation until Capture or Void. Pending
+// is accepted because the approval can overtake wallet.funds_reserved.
+func (s *Service) MarkAuthorized(ctx context.Context, paymentID, reservationID, gatewayRef string) error {
+	_, err := s.transition(
+		ctx,
+		paymentID,
+		StatusAuthorized,
+		[]string{StatusPending, StatusReserved},
+		map[string]string{"reservation_id": reservationID, "gateway_ref": gatewayRef},
+	)
+
+	return s.reverseLateApproval(ctx, paymentID, gatewayRef, err)
+}
+
+// CompletePayment marks the payment as completed after the wallet deduction and
+// broadcasts payment.completed. Pending and reserved are accepted as source
+// statuses because SQS does not guarantee wallet.funds_reserved or the gateway
+// approval arrive before the deduction.
+func (s *Service) CompletePayment(ctx context.Context, paymentID, gatewayRef string) error {
+	payment, err := s.finalize(
+		ctx,
+		paymentID,
+		StatusCompleted,
+		[]string{StatusPending, StatusReserved, StatusProcessing},
+		map[string]string{"gateway_ref": gatewayRef},
+		func(payment *Payment) events.Event {
+			if gatewayRef != "" {
+				payment.GatewayRef = gatewayRef
+			}
+
+			event := events.New(events.PaymentCompleted, payment.ID, payment.UserID)
+			event.WithAmount(payment.Amount.Decimal, payment.Currency).
+				WithReservation(payment.ReservationID).
+				WithGatewayRef(payment.GatewayRef)
+
+			return event
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("payment completed", "payment_id", payment.ID, "gateway_ref", payment.GatewayRef)
+
+	return nil
+}
+
+// FailPayment marks a non-terminal payment as failed and broadcasts
+// payment.failed.
+func (s *Service) FailPayment(ctx context.Context, paymentID, reason string) error {
+	payment, err := s.finalize(
+		ctx,
+		paymentID,
+		StatusFailed,
+		[]string{StatusPending, StatusReserved, StatusProcessing, StatusAuthorized},
+		map[string]string{"failure_reason": reason},
+		func(payment *Payment) events.Event {
+			payment.FailureReason = reason
+
+			event := events.New(events.PaymentFailed, payment.ID, payment.UserID)
+			event.WithAmount(payment.Amount.Decimal, payment.Currency).
+				WithReservation(payment.ReservationID).
+				WithReason(reason)
+
+			return event
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	slog.Warn("payment failed", "payment_id", payment.ID, "reason", reason)
+
+	return nil
+}
+
+// finalize moves the payment to a final status, like transition, and records
+// the outcome event for the event bus in the outbox in the same transaction,
+// so it is not lost when publishing fails. The write is guarded on the status
+// that was read, so outcome always describes the payment as written; if the
+// payment moves on in between it is read again.
+func (s *Service) finalize(
+	ctx context.Context,
+	paymentID, to string,
+	from []string,
+	set map[string]string,
+	outcome func(payment *Payment) events.Event,
+) (*Payment, error) {
+	for range finalizeAttempts {
+		payment, err := s.GetPayment(ctx, paymentID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(from, payment.Status) {
+			return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, payment.Status, to)
+		}
+
+		event := outcome(payment)
+
+		entry, err := newOutboxEntry(&event, s.eventBusName)
+		if err != nil {
+			return nil, err
+		}
+
+		outboxPut, err := s.outboxPut(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		update, values := statusUpdate(to, set)
+		values[":from"] = &types.AttributeValueMemberS{Value: payment.Status}
+
+		_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{
+					Update: &types.Update{
+						TableName: aws.String(s.tableName),
+						Key: map[string]types.AttributeValue{
+							"id": &types.AttributeValueMemberS{Value: paymentID},
+						},
+						UpdateExpression:          aws.String(update),
+						ConditionExpression:       aws.String("#status = :from"),
+						ExpressionAttributeNames:  map[string]string{"#status": "status"},
+						ExpressionAttributeValues: values,
+					},
+				},
+				outboxPut,
+			},
+		})
+		if err != nil {
+			var tce *types.TransactionCanceledException
+			if errors.As(err, &tce) {
+				continue
+			}
+
+			return nil, fmt.Errorf("update payment status: %w", err)
+		}
+
+		if err := s.deliver(ctx, entry); err != nil {
+			slog.Error("failed to publish event", "error", err, "event_type", event.Type, "payment_id", paymentID)
+		}
+
+		payment.Status = to
+
+		return payment, nil
+	}
+
+	return nil, fmt.Errorf("%w: payment %s", ErrPaymentConflict, paymentID)
+}
+
+// transition sets the payment status to "to" only if the current status is one
+// of "from", writing the non-empty attributes in set along with it. It returns
+// ErrInvalidTransition when the guard does not hold, which is the normal
+// outcome for duplicated or out-of-order events.
+func (s *Service) transition(
+	ctx context.Context,
+	paymentID, to string,
+	from []string,
+	set map[string]string,
+) (*Payment, error) {
+	update, values := statusUpdate(to, set)
+
+	placeholders := make([]string, 0, len(from))
+	for i, status := range from {
+		key := ":from" + strconv.Itoa(i)
+		placeholders = append(placeholders, key)
+		values[key] = &types.AttributeValueMemberS{Value: status}
+	}
+
+	result, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: paymentID},
+		},
+		UpdateExpression: aws.String(update),
+		ConditionExpression: aws.String(
+			"attribute_exists(id) AND #status IN (" + strings.Join(placeholders, ", ") + ")",
+		),
+		ExpressionAttributeNames:            map[string]string{"#status": "status"},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			if ccf.Item == nil {
+				return nil, ErrPaymentNotFound
+			}
+
+			return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, statusOf(ccf.Item), to)
+		}
+
+		return nil, fmt.Errorf("update payment status: %w", err)
+	}
+
+	var payment Payment
+	if err := attributevalue.UnmarshalMap(result.Attributes, &payment); err != nil {
+		return nil, fmt.Errorf("unmarshal payment: %w", err)
+	}
+
+	return &payment, nil
+}
+
+// statusUpdate returns the update expression that sets the status to "to"
+// along with the non-empty attributes in set, and its values.
+func statusUpdate(to string, set map[string]string) (string, map[string]types.AttributeValue) {
+	update := []string{"#status = :to", "updated_at = :now"}
+	values := map[string]types.AttributeValue{
+		":to":  &types.AttributeValueMemberS{Value: to},
+		":now": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(set)) {
+		if set[name] == "" {
+			continue
+		}
+
+		update = append(update, name+" = :"+name)
+		values[":"+name] = &types.AttributeValueMemberS{Value: set[name]}
+	}
+
+	return "SET " + strings.Join(update, ", "), values
+}
+
+func statusOf(item map[string]types.AttributeValue) string {
+	if v, ok := item["status"].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	ErrMissingListKey   = errors.New("one of user_id, service_id or status is required")
+	ErrInvalidPageToken = errors.New("invalid next_token")
+)
+
+// sortKeyLayout is a fixed-width timestamp so that string order in the
+// listing indexes matches chronological order.
+const sortKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// sortKeyMax sorts after any "#<id>" suffix, making the upper bound inclusive.
+const sortKeyMax = "~"
+
+// PaymentFilter narrows a payment listing. Each of UserID, ServiceID and
+// Status is backed by an index, so at least one must be set; the remaining
+// ones are applied as filters.
+type PaymentFilter struct {
+	From      time.Time
+	To        time.Time
+	UserID    string
+	ServiceID string
+	Status    string
+	NextToken string
+	Limit     int32
+}
+
+// PaymentPage is one page of a payment listing, newest first.
+type PaymentPage struct {
+	NextToken string
+	Payments  []Payment
+}
+
+// ListPayments returns payments matching the filter ordered by creation time,
+// newest first. NextToken is opaque to callers and empty on the last page.
+// Query applies Limit before the filter expressions, so the index is read
+// until the page holds Limit payments or runs out; only the last page can be
+// short.
+func (s *Service) ListPayments(ctx context.Context, filter *PaymentFilter) (*PaymentPage, error) {
+	input, err := s.listQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &PaymentPage{Payments: make([]Payment, 0, filter.Limit)}
+
+	for {
+		result, err := s.db.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("query payments: %w", err)
+		}
+
+		var batch []Payment
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &batch); err != nil {
+			return nil, fmt.Errorf("unmarshal payments: %w", err)
+		}
+
+		page.Payments = append(page.Payments, batch...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return page, nil
+		}
+
+		remaining := filter.Limit - int32(len(page.Payments))
+		if remaining <= 0 {
+			page.NextToken, err = encodePageToken(result.LastEvaluatedKey)
+			if err != nil {
+				return nil, err
+			}
+
+			return page, nil
+		}
+
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		input.Limit = aws.Int32(remaining)
+	}
+}
+
+// listQuery picks the most selective index for the filter and turns the
+// rest of it into key conditions and filter expressions.
+func (s *Service) listQuery(filter *PaymentFilter) (*dynamodb.QueryInput, error) {
+	var index, key string
+
+	switch {
+	case filter.UserID != "":
+		index, key = "user_id-index", "user_id"
+	case filter.ServiceID != "":
+		index, key = "service_id-index", "service_id"
+	case filter.Status != "":
+		index, key = "status-index", "status"
+	default:
+		return nil, ErrMissingListKey
+	}
+
+	criteria := map[string]string{
+		"user_id":    filter.UserID,
+		"service_id": filter.ServiceID,
+		"status":     filter.Status,
+	}
+
+	keyCond := "#pk = :pk"
+	names := map[string]string{"#pk": key}
+	values := map[string]types.AttributeValue{
+		":pk": &types.AttributeValueMemberS{Value: criteria[key]},
+	}
+
+	var filters []string
+
+	for _, attr := range []string{"user_id", "service_id", "status"} {
+		if attr == key || criteria[attr] == "" {
+			continue
+		}
+
+		names["#"+attr] = attr
+		values[":"+attr] = &types.AttributeValueMemberS{Value: criteria[attr]}
+		filters = append(filters, "#"+attr+" = :"+attr)
+	}
+
+	if !filter.From.IsZero() || !filter.To.IsZero() {
+		from, to := "", sortKeyMax
+		if !filter.From.IsZero() {
+			from = filter.From.UTC().Format(sortKeyLayout)
+		}
+
+		if !filter.To.IsZero() {
+			to = filter.To.UTC().Format(sortKeyLayout) + sortKeyMax
+		}
+
+		keyCond += " AND sort_key BETWEEN :from AND :to"
+		values[":from"] = &types.AttributeValueMemberS{Value: from}
+		values[":to"] = &types.AttributeValueMemberS{Value: to}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tableName),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    aws.String(keyCond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(filter.Limit),
+	}
+
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+
+	if filter.NextToken != "" {
+		startKey, err := decodePageToken(filter.NextToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := startKey[key]; !ok {
+			// The token was issued for a listing on a different index.
+			return nil, ErrInvalidPageToken
+		}
+
+		input.ExclusiveStartKey = startKey
+	}
+
+	return input, nil
+}
+
+// sortKey orders payments in the listing indexes: creation time first, then
+// the ID so payments created in the same instant keep a stable order.
+func sortKey(createdAt time.Time, id string) string {
+	return createdAt.UTC().Format(sortKeyLayout) + "#" + id
+}
+
+// encodePageToken wraps a LastEvaluatedKey, whose attributes are all strings
+// in the listing indexes, into an opaque URL-safe token.
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	plain := make(map[string]string, len(key))
+
+	for name, value := range key {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("encode page token: unexpected type for %s", name)
+		}
+
+		plain[name] = s.Value
+	}
+
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", fmt.Errorf("encode page token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	var plain map[string]string
+	if err := json.Unmarshal(b, &plain); err != nil || len(plain) == 0 {
+		return nil, ErrInvalidPageToken
+	}
+
+	key := make(map[string]types.AttributeValue, len(plain))
+	for name, value := range plain {
+		key[name] = &types.AttributeValueMemberS{Value: value}
+	}
+
+	return key, nil
+}
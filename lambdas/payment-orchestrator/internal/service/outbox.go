@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Outbox entry statuses. A failed entry cannot be read or decoded and is
+// never delivered; it is kept for inspection.
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// outboxRetention is how long a sent entry is kept before TTL removes it.
+const outboxRetention = 7 * 24 * time.Hour
+
+// OutboxEntry is an event waiting to be delivered to a queue or the event
+// bus. It is written in the same transaction as the state change that
+// produced the event, so the event is never lost even if publishing fails
+// afterwards.
+type OutboxEntry struct {
+	CreatedAt   time.Time `dynamodbav:"created_at"`
+	ID          string    `dynamodbav:"id"`
+	PaymentID   string    `dynamodbav:"payment_id"`
+	EventType   string    `dynamodbav:"event_type"`
+	Destination string    `dynamodbav:"destination"`
+	Payload     string    `dynamodbav:"payload"`
+	Status      string    `dynamodbav:"status"`
+	Attempts    int       `dynamodbav:"attempts"`
+	ExpiresAt   int64     `dynamodbav:"expires_at,omitempty"`
+}
+
+func newOutboxEntry(event *events.Event, destination string) (*OutboxEntry, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event: %w", err)
+	}
+
+	return &OutboxEntry{
+		ID:          event.ID,
+		PaymentID:   event.PaymentID,
+		EventType:   event.Type,
+		Destination: destination,
+		Payload:     string(payload),
+		Status:      OutboxPending,
+		CreatedAt:   event.OccurredAt,
+	}, nil
+}
+
+// outboxEntries builds one entry per destination, each holding its own event
+// from build so that every entry has its own id.
+func outboxEntries(build func() events.Event, destinations ...string) ([]*OutboxEntry, error) {
+	entries := make([]*OutboxEntry, 0, len(destinations))
+
+	for _, destination := range destinations {
+		event := build()
+
+		entry, err := newOutboxEntry(&event, destination)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// outboxPut returns the transaction item that records entry in the outbox.
+func (s *Service) outboxPut(entry *OutboxEntry) (types.TransactWriteItem, error) {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("marshal outbox entry: %w", err)
+	}
+
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: aws.String(s.outboxTable),
+			Item:      item,
+		},
+	}, nil
+}
+
+// RelayOutbox publishes up to limit pending outbox entries, oldest first, and
+// marks each one sent. Entries that fail to publish stay pending for the next
+// run; entries that cannot be decoded are marked failed, so they do not take
+// a slot on every run. It returns the number of entries delivered.
+func (s *Service) RelayOutbox(ctx context.Context, limit int32) (int, error) {
+	result, err := s.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.outboxTable),
+		IndexName:              aws.String("status-index"),
+		KeyConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: OutboxPending},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int32(limit),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("query outbox: %w", err)
+	}
+
+	var (
+		sent    int
+		lastErr error
+	)
+
+	for _, item := range result.Items {
+		var entry OutboxEntry
+		if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+			lastErr = fmt.Errorf("unmarshal outbox entry: %w", err)
+
+			if id, ok := item["id"].(*types.AttributeValueMemberS); ok {
+				s.markFailed(ctx, id.Value, lastErr)
+			}
+
+			continue
+		}
+
+		if err := s.deliver(ctx, &entry); err != nil {
+			slog.Error("failed to relay outbox entry", "error", err, "outbox_id", entry.ID)
+			lastErr = err
+
+			continue
+		}
+
+		sent++
+	}
+
+	slog.Info("outbox relayed", "sent", sent, "pending", len(result.Items))
+
+	return sent, lastErr
+}
+
+// deliver publishes an outbox entry, to the event bus when that is its
+// destination and to a queue otherwise, and marks it sent. A publish failure
+// bumps the attempt counter and leaves the entry pending; a payload that
+// cannot be decoded marks it failed, since no retry can deliver it.
+func (s *Service) deliver(ctx context.Context, entry *OutboxEntry) error {
+	var event events.Event
+	if err := json.Unmarshal([]byte(entry.Payload), &event); err != nil {
+		err = fmt.Errorf("unmarshal outbox payload: %w", err)
+		s.markFailed(ctx, entry.ID, err)
+
+		return err
+	}
+
+	publisher := s.publisher
+	if s.eventBusName != "" && entry.Destination == s.eventBusName {
+		publisher = s.bus
+	}
+
+	if err := publisher.Publish(ctx, entry.Destination, &event); err != nil {
+		s.recordAttempt(ctx, entry.ID)
+
+		return fmt.Errorf("publish outbox entry: %w", err)
+	}
+
+	return s.markSent(ctx, entry.ID)
+}
+
+func (s *Service) markSent(ctx context.Context, id string) error {
+	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String(
+			"SET #status = :sent, sent_at = :now, expires_at = :exp ADD attempts :one",
+		),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sent":    &types.AttributeValueMemberS{Value: OutboxSent},
+			":pending": &types.AttributeValueMemberS{Value: OutboxPending},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":exp": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(outboxRetention).Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// Another relay run already delivered it.
+			return nil
+		}
+
+		return fmt.Errorf("mark outbox entry sent: %w", err)
+	}
+
+	return nil
+}
+
+// markFailed takes a pending entry that can never be delivered out of the
+// relay's way, recording why. Failing to do so is only logged: the entry is
+// tried again on the next run.
+func (s *Service) markFailed(ctx context.Context, id string, cause error) {
+	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:         aws.String("SET #status = :failed, #error = :error, failed_at = :now"),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "status", "#error": "error"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":failed":  &types.AttributeValueMemberS{Value: OutboxFailed},
+			":pending": &types.AttributeValueMemberS{Value: OutboxPending},
+			":error":   &types.AttributeValueMemberS{Value: cause.Error()},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to mark outbox entry failed", "error", err, "outbox_id", id)
+
+		return
+	}
+
+	slog.Error("outbox entry cannot be delivered", "error", cause, "outbox_id", id)
+}
+
+func (s *Service) recordAttempt(ctx context.Context, id string) {
+	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("ADD attempts :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to record outbox attempt", "error", err, "outbox_id", id)
+	}
+}
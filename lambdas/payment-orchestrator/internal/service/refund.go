@@ -0,0 +1,339 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrRefundNotFound       = errors.New("refund not found")
+	ErrPaymentNotRefundable = errors.New("only completed payments can be refunded")
+	ErrRefundExceedsPayment = errors.New("refund exceeds the remaining refundable amount")
+	ErrRefundConflict       = errors.New("payment was modified concurrently, retry the refund")
+)
+
+// Refund statuses.
+const (
+	RefundPending   = "pending"
+	RefundCompleted = "completed"
+	RefundFailed    = "failed"
+)
+
+// StatusRefunded marks a payment whose full amount has been committed to
+// refunds.
+const StatusRefunded = "refunded"
+
+// Refund returns part or all of a completed payment to the user's wallet.
+type Refund struct {
+	CreatedAt     time.Time    `dynamodbav:"created_at"`
+	UpdatedAt     time.Time    `dynamodbav:"updated_at"`
+	ID            string       `dynamodbav:"id"`
+	PaymentID     string       `dynamodbav:"payment_id"`
+	UserID        string       `dynamodbav:"user_id"`
+	Amount        money.Amount `dynamodbav:"amount"`
+	Currency      string       `dynamodbav:"currency"`
+	Status        string       `dynamodbav:"status"`
+	Reason        string       `dynamodbav:"reason,omitempty"`
+	FailureReason string       `dynamodbav:"failure_reason,omitempty"`
+}
+
+// RequestRefund refunds amount of a completed payment, or whatever is left
+// to refund when amount is zero. The payment's refunded total, the refund
+// record and its payment.refund_requested outbox entry are written in one
+// transaction guarded on the previous total, so concurrent refunds can never
+// add up to more than the payment amount.
+func (s *Service) RequestRefund(
+	ctx context.Context,
+	paymentID string,
+	amount decimal.Decimal,
+	reason string,
+) (*Refund, error) {
+	payment, err := s.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status != StatusCompleted {
+		return nil, ErrPaymentNotRefundable
+	}
+
+	remaining := payment.Amount.Sub(payment.RefundedAmount.Decimal)
+	if amount.IsZero() {
+		amount = remaining
+	}
+
+	if !amount.IsPositive() || amount.GreaterThan(remaining) {
+		return nil, ErrRefundExceedsPayment
+	}
+
+	now := time.Now().UTC()
+	refund := &Refund{
+		ID:        uuid.New().String(),
+		PaymentID: payment.ID,
+		UserID:    payment.UserID,
+		Amount:    money.New(amount),
+		Currency:  payment.Currency,
+		Status:    RefundPending,
+		Reason:    reason,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	event := events.New(events.RefundRequested, payment.ID, payment.UserID)
+	event.WithAmount(amount, payment.Currency).
+		WithGatewayRef(payment.GatewayRef).
+		WithRefund(refund.ID).
+		WithReason(reason)
+
+	entry, err := newOutboxEntry(&event, s.gatewayQueueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.refundWrites(payment, refund, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return nil, ErrRefundConflict
+		}
+
+		return nil, fmt.Errorf("save refund: %w", err)
+	}
+
+	if err := s.deliver(ctx, entry); err != nil {
+		slog.Error("failed to publish event", "error", err, "refund_id", refund.ID)
+	}
+
+	slog.Info("refund requested", "payment_id", payment.ID, "refund_id", refund.ID)
+
+	return refund, nil
+}
+
+// refundWrites builds the transaction for RequestRefund.
+func (s *Service) refundWrites(
+	payment *Payment,
+	refund *Refund,
+	entry *OutboxEntry,
+) ([]types.TransactWriteItem, error) {
+	refundItem, err := attributevalue.MarshalMap(refund)
+	if err != nil {
+		return nil, fmt.Errorf("marshal refund: %w", err)
+	}
+
+	outboxPut, err := s.outboxPut(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	refunded := payment.RefundedAmount.Add(refund.Amount.Decimal)
+
+	status := StatusCompleted
+	if refunded.Equal(payment.Amount.Decimal) {
+		status = StatusRefunded
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.tableName),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: payment.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET refunded_amount = :refunded, #status = :status, updated_at = :now",
+				),
+				ConditionExpression: aws.String(
+					"#status = :completed AND " +
+						"(attribute_not_exists(refunded_amount) OR refunded_amount = :previous)",
+				),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":refunded":  &types.AttributeValueMemberN{Value: refunded.String()},
+					":previous":  &types.AttributeValueMemberN{Value: payment.RefundedAmount.String()},
+					":status":    &types.AttributeValueMemberS{Value: status},
+					":completed": &types.AttributeValueMemberS{Value: StatusCompleted},
+					":now": &types.AttributeValueMemberS{
+						Value: refund.CreatedAt.Format(time.RFC3339Nano),
+					},
+				},
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String(s.refundsTable),
+				Item:                refundItem,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		},
+		outboxPut,
+	}, nil
+}
+
+// CompleteRefund marks a refund completed once the wallet has been credited.
+func (s *Service) CompleteRefund(ctx context.Context, refundID string) error {
+	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.refundsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: refundID},
+		},
+		UpdateExpression:         aws.String("SET #status = :completed, updated_at = :now"),
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed": &types.AttributeValueMemberS{Value: RefundCompleted},
+			":pending":   &types.AttributeValueMemberS{Value: RefundPending},
+			":now":       &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return fmt.Errorf("%w: refund %s is not pending", ErrInvalidTransition, refundID)
+		}
+
+		return fmt.Errorf("complete refund: %w", err)
+	}
+
+	slog.Info("refund completed", "refund_id", refundID)
+
+	return nil
+}
+
+// FailRefund marks a pending refund failed and gives its amount back to the
+// payment's refundable balance in the same transaction. The payment update is
+// guarded on the status and refunded total that were read, so a concurrent
+// refund is never overwritten; the conflict is returned for the event to be
+// retried.
+func (s *Service) FailRefund(ctx context.Context, refundID, reason string) error {
+	refund, err := s.getRefund(ctx, refundID)
+	if err != nil {
+		return err
+	}
+
+	if refund.Status != RefundPending {
+		return fmt.Errorf("%w: refund %s is not pending", ErrInvalidTransition, refundID)
+	}
+
+	payment, err := s.GetPayment(ctx, refund.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	if payment.Status != StatusCompleted && payment.Status != StatusRefunded {
+		return fmt.Errorf("%w: payment %s is %s", ErrInvalidTransition, payment.ID, payment.Status)
+	}
+
+	refunded := payment.RefundedAmount.Sub(refund.Amount.Decimal)
+	if refunded.IsNegative() {
+		return fmt.Errorf("%w: refund %s exceeds the refunded total", ErrInvalidTransition, refundID)
+	}
+
+	now := &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.refundsTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: refund.ID},
+					},
+					UpdateExpression: aws.String(
+						"SET #status = :failed, failure_reason = :reason, updated_at = :now",
+					),
+					ConditionExpression:      aws.String("#status = :pending"),
+					ExpressionAttributeNames: map[string]string{"#status": "status"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":failed":  &types.AttributeValueMemberS{Value: RefundFailed},
+						":pending": &types.AttributeValueMemberS{Value: RefundPending},
+						":reason":  &types.AttributeValueMemberS{Value: reason},
+						":now":     now,
+					},
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.tableName),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: payment.ID},
+					},
+					UpdateExpression: aws.String(
+						"SET refunded_amount = :refunded, #status = :completed, updated_at = :now",
+					),
+					ConditionExpression:      aws.String("#status = :expected AND refunded_amount = :previous"),
+					ExpressionAttributeNames: map[string]string{"#status": "status"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":refunded":  &types.AttributeValueMemberN{Value: refunded.String()},
+						":previous":  &types.AttributeValueMemberN{Value: payment.RefundedAmount.String()},
+						":expected":  &types.AttributeValueMemberS{Value: payment.Status},
+						":completed": &types.AttributeValueMemberS{Value: StatusCompleted},
+						":now":       now,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			if conditionFailed(tce, 0) {
+				return fmt.Errorf("%w: refund %s is not pending", ErrInvalidTransition, refundID)
+			}
+
+			return ErrRefundConflict
+		}
+
+		return fmt.Errorf("fail refund: %w", err)
+	}
+
+	slog.Warn("refund failed", "refund_id", refundID, "payment_id", refund.PaymentID, "reason", reason)
+
+	return nil
+}
+
+func (s *Service) getRefund(ctx context.Context, id string) (*Refund, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.refundsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get refund: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrRefundNotFound
+	}
+
+	var refund Refund
+	if err := attributevalue.UnmarshalMap(result.Item, &refund); err != nil {
+		return nil, fmt.Errorf("unmarshal refund: %w", err)
+	}
+
+	return &refund, nil
+}
+
+// conditionFailed reports whether item i of a cancelled transaction failed its
+// condition expression.
+func conditionFailed(tce *types.TransactionCanceledException, i int) bool {
+	return i < len(tce.CancellationReasons) &&
+		aws.ToString(tce.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
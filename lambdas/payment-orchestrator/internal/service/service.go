@@ -8,6 +8,9 @@ import (
 	"time"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	"github.com/HELL0ANTHONY/payment-system/shared/webhook"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -16,7 +19,27 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-var ErrPaymentNotFound = errors.New("payment not found")
+var (
+	ErrPaymentNotFound   = errors.New("payment not found")
+	ErrInvalidTransition = errors.New("invalid payment status transition")
+	ErrPaymentConflict   = errors.New("payment kept changing while being updated")
+)
+
+// finalizeAttempts bounds how many times a final status change is retried
+// when the payment changes between its read and its write.
+const finalizeAttempts = 3
+
+// Payment statuses.
+const (
+	StatusPending    = "pending"
+	StatusReserved   = "reserved"
+	StatusProcessing = "processing"
+	StatusAuthorized = "authorized"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusVoided     = "voided"
+	StatusCancelled  = "cancelled"
+)
 
 type DynamoDBClient interface {
 	PutItem(
@@ -29,6 +52,31 @@ type DynamoDBClient interface {
 		params *dynamodb.GetItemInput,
 		optFns ...func(*dynamodb.Options),
 	) (*dynamodb.GetItemOutput, error)
+	UpdateItem(
+		ctx context.Context,
+		params *dynamodb.UpdateItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(
+		ctx context.Context,
+		params *dynamodb.DeleteItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.DeleteItemOutput, error)
+	Query(
+		ctx context.Context,
+		params *dynamodb.QueryInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(
+		ctx context.Context,
+		params *dynamodb.TransactWriteItemsInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.TransactWriteItemsOutput, error)
+	Scan(
+		ctx context.Context,
+		params *dynamodb.ScanInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.ScanOutput, error)
 }
 
 type EventPublisher interface {
@@ -36,68 +84,138 @@ type EventPublisher interface {
 }
 
 type Payment struct {
-	CreatedAt   time.Time       `dynamodbav:"created_at"`
-	UpdatedAt   time.Time       `dynamodbav:"updated_at"`
-	ID          string          `dynamodbav:"id"`
-	UserID      string          `dynamodbav:"user_id"`
-	ServiceID   string          `dynamodbav:"service_id"`
-	Amount      decimal.Decimal `dynamodbav:"amount"`
-	Currency    string          `dynamodbav:"currency"`
-	Status      string          `dynamodbav:"status"`
-	Description string          `dynamodbav:"description"`
+	CreatedAt        time.Time     `dynamodbav:"created_at"`
+	UpdatedAt        time.Time     `dynamodbav:"updated_at"`
+	AuthorizedAmount *money.Amount `dynamodbav:"authorized_amount,omitempty"`
+	ID               string        `dynamodbav:"id"`
+	UserID           string        `dynamodbav:"user_id"`
+	ServiceID        string        `dynamodbav:"service_id,omitempty"`
+	Amount           money.Amount  `dynamodbav:"amount"`
+	RefundedAmount   money.Amount  `dynamodbav:"refunded_amount"`
+	Currency         string        `dynamodbav:"currency"`
+	Status           string        `dynamodbav:"status"`
+	Description      string        `dynamodbav:"description"`
+	CaptureMode      string        `dynamodbav:"capture_mode,omitempty"`
+	ReservationID    string        `dynamodbav:"reservation_id,omitempty"`
+	GatewayRef       string        `dynamodbav:"gateway_ref,omitempty"`
+	FailureReason    string        `dynamodbav:"failure_reason,omitempty"`
+	SortKey          string        `dynamodbav:"sort_key"`
+}
+
+// Config holds the names of the resources the service works with.
+type Config struct {
+	PaymentsTable    string
+	IdempotencyTable string
+	OutboxTable      string
+	RefundsTable     string
+	TimelineTable    string
+	WebhooksTable    string
+	DeliveriesTable  string
+	WalletQueueURL   string
+	GatewayQueueURL  string
+	EventBusName     string
 }
 
 type Service struct {
-	db             DynamoDBClient
-	publisher      EventPublisher
-	tableName      string
-	walletQueueURL string
+	db               DynamoDBClient
+	publisher        EventPublisher
+	bus              EventPublisher
+	timeline         *timeline.Recorder
+	tableName        string
+	idempotencyTable string
+	outboxTable      string
+	refundsTable     string
+	webhooksTable    string
+	deliveriesTable  string
+	webhooks         *webhook.Sender
+	walletQueueURL   string
+	gatewayQueueURL  string
+	eventBusName     string
 }
 
-func New(db DynamoDBClient, pub EventPublisher, tableName, walletQueueURL string) *Service {
+// New creates a service that sends commands through pub (SQS) and
+// broadcasts payment outcomes through bus (EventBridge).
+func New(db DynamoDBClient, pub, bus EventPublisher, cfg Config) *Service {
 	return &Service{
-		db:             db,
-		publisher:      pub,
-		tableName:      tableName,
-		walletQueueURL: walletQueueURL,
+		db:               db,
+		publisher:        pub,
+		bus:              bus,
+		timeline:         timeline.NewRecorder(db, cfg.TimelineTable, "payment-orchestrator"),
+		tableName:        cfg.PaymentsTable,
+		idempotencyTable: cfg.IdempotencyTable,
+		outboxTable:      cfg.OutboxTable,
+		refundsTable:     cfg.RefundsTable,
+		webhooksTable:    cfg.WebhooksTable,
+		deliveriesTable:  cfg.DeliveriesTable,
+		webhooks:         webhook.NewSender(webhook.NewPublicClient(webhookTimeout)),
+		walletQueueURL:   cfg.WalletQueueURL,
+		gatewayQueueURL:  cfg.GatewayQueueURL,
+		eventBusName:     cfg.EventBusName,
 	}
 }
 
-// CreatePayment creates a new payment record.
+// CreatePayment creates a new payment record together with its
+// payment.initiated outbox entry. An empty captureMode means automatic.
 func (s *Service) CreatePayment(
 	ctx context.Context,
-	userID, serviceID, currency, description string,
+	userID, serviceID, currency, description, captureMode string,
 	amount decimal.Decimal,
 ) (*Payment, error) {
+	if captureMode == "" {
+		captureMode = events.CaptureAutomatic
+	}
+
+	now := time.Now().UTC()
 	payment := &Payment{
 		ID:          uuid.New().String(),
 		UserID:      userID,
 		ServiceID:   serviceID,
-		Amount:      amount,
+		Amount:      money.New(amount),
 		Currency:    currency,
-		Status:      "pending",
+		Status:      StatusPending,
 		Description: description,
-		CreatedAt:   time.Now().UTC(),
-		UpdatedAt:   time.Now().UTC(),
+		CaptureMode: captureMode,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
+	payment.SortKey = sortKey(payment.CreatedAt, payment.ID)
 
 	item, err := attributevalue.MarshalMap(payment)
 	if err != nil {
 		return nil, fmt.Errorf("marshal payment: %w", err)
 	}
 
-	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(s.tableName),
-		Item:      item,
+	event := events.New(events.PaymentInitiated, payment.ID, payment.UserID)
+	event.WithAmount(payment.Amount.Decimal, payment.Currency).WithCaptureMode(payment.CaptureMode)
+
+	entry, err := newOutboxEntry(&event, s.walletQueueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	outboxPut, err := s.outboxPut(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(s.tableName),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(id)"),
+				},
+			},
+			outboxPut,
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("save payment: %w", err)
 	}
 
-	event := events.New(events.PaymentInitiated, payment.ID, payment.UserID)
-	event.WithAmount(payment.Amount, payment.Currency)
-
-	if err := s.publisher.Publish(ctx, s.walletQueueURL, &event); err != nil {
+	// Deliver right away to keep latency low; the relay retries on failure.
+	if err := s.deliver(ctx, entry); err != nil {
 		slog.Error("failed to publish event", "error", err, "payment_id", payment.ID)
 	}
 
@@ -3,11 +3,21 @@ package service
 import (
 	"context"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	"github.com/HELL0ANTHONY/payment-system/shared/webhook"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -42,6 +52,65 @@ func (m *mockDB) GetItem(
 	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
 }
 
+func (m *mockDB) UpdateItem(
+	ctx context.Context,
+	input *dynamodb.UpdateItemInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *mockDB) DeleteItem(
+	ctx context.Context,
+	input *dynamodb.DeleteItemInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.DeleteItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.DeleteItemOutput), args.Error(1)
+}
+
+func (m *mockDB) Query(
+	ctx context.Context,
+	input *dynamodb.QueryInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.QueryOutput, error) {
+	args := m.Called(ctx, input)
+
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func (m *mockDB) TransactWriteItems(
+	ctx context.Context,
+	input *dynamodb.TransactWriteItemsInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+func (m *mockDB) Scan(
+	ctx context.Context,
+	input *dynamodb.ScanInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.ScanOutput, error) {
+	args := m.Called(ctx, input)
+
+	return args.Get(0).(*dynamodb.ScanOutput), args.Error(1)
+}
+
 type mockPublisher struct {
 	mock.Mock
 }
@@ -59,10 +128,19 @@ func TestCreatePayment_Success(t *testing.T) {
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
-	db.On("PutItem", ctx, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		return len(input.TransactItems) == 2 &&
+			*input.TransactItems[0].Put.TableName == "payments" &&
+			*input.TransactItems[1].Put.TableName == "outbox"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
 	pub.On("Publish", ctx, "http://queue", mock.Anything).Return(nil)
 
-	svc := New(db, pub, "payments", "http://queue")
+	svc := New(db, pub, nil, Config{
+		PaymentsTable:  "payments",
+		OutboxTable:    "outbox",
+		WalletQueueURL: "http://queue",
+	})
 
 	payment, err := svc.CreatePayment(
 		ctx,
@@ -70,6 +148,7 @@ func TestCreatePayment_Success(t *testing.T) {
 		"service-456",
 		"USD",
 		"Test",
+		"",
 		decimal.NewFromInt(100),
 	)
 
@@ -90,9 +169,9 @@ func TestCreatePayment_DBError(t *testing.T) {
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
-	db.On("PutItem", ctx, mock.Anything).Return(nil, errors.New("db error"))
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, errors.New("db error"))
 
-	svc := New(db, pub, "payments", "http://queue")
+	svc := New(db, pub, nil, Config{PaymentsTable: "payments", WalletQueueURL: "http://queue"})
 
 	payment, err := svc.CreatePayment(
 		ctx,
@@ -100,12 +179,14 @@ func TestCreatePayment_DBError(t *testing.T) {
 		"svc",
 		"USD",
 		"Test",
+		"",
 		decimal.NewFromInt(100),
 	)
 
 	assert.Error(t, err)
 	assert.Nil(t, payment)
 	assert.Contains(t, err.Error(), "save payment")
+	pub.AssertNotCalled(t, "Publish")
 }
 
 func TestCreatePayment_PublishError_StillSucceeds(t *testing.T) {
@@ -113,10 +194,11 @@ func TestCreatePayment_PublishError_StillSucceeds(t *testing.T) {
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
-	db.On("PutItem", ctx, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
 	pub.On("Publish", ctx, "http://queue", mock.Anything).Return(errors.New("sqs error"))
 
-	svc := New(db, pub, "payments", "http://queue")
+	svc := New(db, pub, nil, Config{PaymentsTable: "payments", WalletQueueURL: "http://queue"})
 
 	payment, err := svc.CreatePayment(
 		ctx,
@@ -124,11 +206,16 @@ func TestCreatePayment_PublishError_StillSucceeds(t *testing.T) {
 		"svc",
 		"USD",
 		"Test",
+		"",
 		decimal.NewFromInt(100),
 	)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, payment)
+
+	// The entry stays pending for the relay; only the attempt is recorded.
+	update := db.Calls[1].Arguments[1].(*dynamodb.UpdateItemInput)
+	assert.Equal(t, "ADD attempts :one", *update.UpdateExpression)
 }
 
 func TestGetPayment_Success(t *testing.T) {
@@ -138,7 +225,7 @@ func TestGetPayment_Success(t *testing.T) {
 	existingPayment := &Payment{
 		ID:       "pay-123",
 		UserID:   "user-456",
-		Amount:   decimal.NewFromInt(50),
+		Amount:   money.New(decimal.NewFromInt(50)),
 		Currency: "MXN",
 		Status:   "completed",
 	}
@@ -147,7 +234,7 @@ func TestGetPayment_Success(t *testing.T) {
 
 	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
 
-	svc := New(db, nil, "payments", "")
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
 
 	payment, err := svc.GetPayment(ctx, "pay-123")
 
@@ -155,6 +242,7 @@ func TestGetPayment_Success(t *testing.T) {
 	assert.Equal(t, "pay-123", payment.ID)
 	assert.Equal(t, "user-456", payment.UserID)
 	assert.Equal(t, "completed", payment.Status)
+	assert.True(t, payment.Amount.Equal(decimal.NewFromInt(50)))
 }
 
 func TestGetPayment_NotFound(t *testing.T) {
@@ -163,10 +251,1305 @@ func TestGetPayment_NotFound(t *testing.T) {
 
 	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: nil}, nil)
 
-	svc := New(db, nil, "payments", "")
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
 
 	payment, err := svc.GetPayment(ctx, "non-existent")
 
 	assert.ErrorIs(t, err, ErrPaymentNotFound)
 	assert.Nil(t, payment)
 }
+
+func paymentIn(t *testing.T, status string) map[string]types.AttributeValue {
+	t.Helper()
+
+	item, err := attributevalue.MarshalMap(&Payment{
+		ID:            "pay-123",
+		UserID:        "user-456",
+		Amount:        money.New(decimal.NewFromInt(100)),
+		Currency:      "USD",
+		Status:        status,
+		ReservationID: "res-789",
+	})
+	assert.NoError(t, err)
+
+	return item
+}
+
+func TestCompletePayment_PublishesCompleted(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusProcessing)}, nil,
+	)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		update := input.TransactItems[0].Update
+		outbox := input.TransactItems[1].Put
+
+		return update.ExpressionAttributeValues[":to"].(*types.AttributeValueMemberS).Value == StatusCompleted &&
+			update.ExpressionAttributeValues[":from"].(*types.AttributeValueMemberS).Value == StatusProcessing &&
+			outbox.Item["destination"].(*types.AttributeValueMemberS).Value == "payment-events"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments", EventBusName: "payment-events"})
+
+	err := svc.CompletePayment(ctx, "pay-123", "GW-1")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	bus.AssertExpectations(t)
+
+	event := bus.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.PaymentCompleted, event.Type)
+	assert.Equal(t, "GW-1", event.GatewayRef)
+	assert.Equal(t, "res-789", event.ReservationID)
+	assert.True(t, event.Amount.Equal(decimal.NewFromInt(100)))
+}
+
+func TestCompletePayment_DeductionOvertakesReservation(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: paymentIn(t, StatusPending)}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		from := input.TransactItems[0].Update.ExpressionAttributeValues[":from"]
+
+		return from.(*types.AttributeValueMemberS).Value == StatusPending
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments", EventBusName: "payment-events"})
+
+	err := svc.CompletePayment(ctx, "pay-123", "GW-1")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func TestCompletePayment_PublishErrorKeepsOutboxEntry(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusProcessing)}, nil,
+	)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		return *input.UpdateExpression == "ADD attempts :one"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(errors.New("eventbridge error"))
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments", EventBusName: "payment-events"})
+
+	err := svc.CompletePayment(ctx, "pay-123", "GW-1")
+
+	// The entry stays pending for the relay.
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func TestCompletePayment_RereadsPaymentThatMovedOn(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusReserved)}, nil,
+	).Once()
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusFailed)}, nil,
+	).Once()
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{}).Once()
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments", EventBusName: "payment-events"})
+
+	err := svc.CompletePayment(ctx, "pay-123", "GW-1")
+
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	db.AssertExpectations(t)
+	bus.AssertNotCalled(t, "Publish")
+}
+
+func TestFailPayment_PublishesFailed(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: paymentIn(t, StatusPending)}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments", EventBusName: "payment-events"})
+
+	err := svc.FailPayment(ctx, "pay-123", "insufficient funds")
+
+	assert.NoError(t, err)
+
+	event := bus.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.PaymentFailed, event.Type)
+	assert.Equal(t, "insufficient funds", event.Reason)
+}
+
+func TestTransition_StaleEventIsRejected(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: paymentIn(t, StatusFailed)}, nil)
+
+	svc := New(db, nil, bus, Config{PaymentsTable: "payments"})
+
+	err := svc.CompletePayment(ctx, "pay-123", "GW-1")
+
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+	bus.AssertNotCalled(t, "Publish")
+}
+
+func TestTransition_PaymentNotFound(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("UpdateItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{})
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	err := svc.MarkReserved(ctx, "missing", "res-1")
+
+	assert.ErrorIs(t, err, ErrPaymentNotFound)
+}
+
+func TestClaimIdempotencyKey_FreshClaim(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.MatchedBy(func(input *dynamodb.PutItemInput) bool {
+		key := input.Item["idempotency_key"].(*types.AttributeValueMemberS).Value
+
+		return *input.TableName == "idempotency" && key == "user-1#key-1"
+	})).Return(&dynamodb.PutItemOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{IdempotencyTable: "idempotency"})
+
+	record, err := svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, IdempotencyInProgress, record.Status)
+	db.AssertExpectations(t)
+}
+
+func TestClaimIdempotencyKey_ReplaysCompleted(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	stored, _ := attributevalue.MarshalMap(&IdempotencyRecord{
+		Key:          "user-1#key-1",
+		Fingerprint:  "fp-1",
+		Status:       IdempotencyCompleted,
+		PaymentID:    "pay-123",
+		StatusCode:   202,
+		ResponseBody: `{"success":true}`,
+	})
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{Item: stored})
+
+	svc := New(db, nil, nil, Config{IdempotencyTable: "idempotency"})
+
+	record, err := svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, IdempotencyCompleted, record.Status)
+	assert.Equal(t, "pay-123", record.PaymentID)
+	assert.Equal(t, 202, record.StatusCode)
+}
+
+func TestClaimIdempotencyKey_DifferentBody(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	stored, _ := attributevalue.MarshalMap(&IdempotencyRecord{
+		Key:         "user-1#key-1",
+		Fingerprint: "fp-1",
+		Status:      IdempotencyCompleted,
+	})
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{Item: stored})
+
+	svc := New(db, nil, nil, Config{IdempotencyTable: "idempotency"})
+
+	record, err := svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-2")
+
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	assert.Nil(t, record)
+}
+
+func TestClaimIdempotencyKey_InProgress(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	stored, _ := attributevalue.MarshalMap(&IdempotencyRecord{
+		Key:         "user-1#key-1",
+		Fingerprint: "fp-1",
+		Status:      IdempotencyInProgress,
+	})
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{Item: stored})
+
+	svc := New(db, nil, nil, Config{IdempotencyTable: "idempotency"})
+
+	_, err := svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-1")
+
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInProgress)
+}
+
+func TestClaimIdempotencyKey_SlowRequestKeepsItsKey(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	var claimed IdempotencyRecord
+
+	db.On("PutItem", ctx, mock.Anything).
+		Run(func(args mock.Arguments) {
+			input := args.Get(1).(*dynamodb.PutItemInput)
+			assert.NoError(t, attributevalue.UnmarshalMap(input.Item, &claimed))
+		}).
+		Return(&dynamodb.PutItemOutput{}, nil).
+		Once()
+
+	svc := New(db, nil, nil, Config{IdempotencyTable: "idempotency"})
+
+	_, err := svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-1")
+	assert.NoError(t, err)
+
+	// A retry while the first request is still running, ten minutes later,
+	// finds the lock held; the condition only lets it reclaim an expired one.
+	retryAt := time.Now().Add(10 * time.Minute).Unix()
+	assert.Greater(t, claimed.ExpiresAt, retryAt)
+
+	stored, _ := attributevalue.MarshalMap(&claimed)
+	db.On("PutItem", ctx, mock.MatchedBy(func(input *dynamodb.PutItemInput) bool {
+		return *input.ConditionExpression == "attribute_not_exists(idempotency_key) OR expires_at < :now"
+	})).Return(nil, &types.ConditionalCheckFailedException{Item: stored}).Once()
+
+	_, err = svc.ClaimIdempotencyKey(ctx, "user-1", "key-1", "fp-1")
+
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInProgress)
+	db.AssertExpectations(t)
+}
+
+func TestRelayOutbox_PublishesPendingEntries(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	event := events.New(events.PaymentInitiated, "pay-123", "user-456")
+	entry, _ := newOutboxEntry(&event, "http://queue")
+	item, _ := attributevalue.MarshalMap(entry)
+
+	db.On("Query", ctx, mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.IndexName == "status-index" && *input.Limit == 10
+	})).Return(&dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{item}}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		return *input.ConditionExpression == "#status = :pending"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.ID == event.ID && e.Type == events.PaymentInitiated
+	})).Return(nil)
+
+	svc := New(db, pub, nil, Config{OutboxTable: "outbox"})
+
+	sent, err := svc.RelayOutbox(ctx, 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestRelayOutbox_PublishErrorKeepsEntryPending(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	event := events.New(events.PaymentInitiated, "pay-123", "user-456")
+	entry, _ := newOutboxEntry(&event, "http://queue")
+	item, _ := attributevalue.MarshalMap(entry)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{item},
+	}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		return *input.UpdateExpression == "ADD attempts :one"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://queue", mock.Anything).Return(errors.New("sqs error"))
+
+	svc := New(db, pub, nil, Config{OutboxTable: "outbox"})
+
+	sent, err := svc.RelayOutbox(ctx, 10)
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	db.AssertExpectations(t)
+}
+
+func TestRelayOutbox_UndecodablePayloadIsMarkedFailed(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	event := events.New(events.PaymentInitiated, "pay-123", "user-456")
+	entry, _ := newOutboxEntry(&event, "http://queue")
+	entry.Payload = "{not json"
+	item, _ := attributevalue.MarshalMap(entry)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{item},
+	}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		status := input.ExpressionAttributeValues[":failed"].(*types.AttributeValueMemberS)
+
+		return input.Key["id"].(*types.AttributeValueMemberS).Value == entry.ID &&
+			*input.ConditionExpression == "#status = :pending" &&
+			status.Value == OutboxFailed
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	svc := New(db, pub, nil, Config{OutboxTable: "outbox"})
+
+	sent, err := svc.RelayOutbox(ctx, 10)
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	db.AssertExpectations(t)
+	pub.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestListPayments_ByUserWithFilters(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	item, _ := attributevalue.MarshalMap(&Payment{ID: "pay-1", UserID: "user-1", Status: StatusCompleted})
+	lastKey := map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "pay-1"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-1"},
+		"sort_key": &types.AttributeValueMemberS{Value: "2026-01-15T10:00:00.000000000Z#pay-1"},
+	}
+
+	db.On("Query", ctx, mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.IndexName == "user_id-index" &&
+			*input.KeyConditionExpression == "#pk = :pk AND sort_key BETWEEN :from AND :to" &&
+			*input.FilterExpression == "#status = :status" &&
+			!*input.ScanIndexForward
+	})).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]types.AttributeValue{item},
+		LastEvaluatedKey: lastKey,
+	}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	page, err := svc.ListPayments(ctx, &PaymentFilter{
+		UserID: "user-1",
+		Status: StatusCompleted,
+		From:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+		Limit:  1,
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Payments, 1)
+	assert.NotEmpty(t, page.NextToken)
+
+	decoded, err := decodePageToken(page.NextToken)
+	assert.NoError(t, err)
+	assert.Equal(t, lastKey, decoded)
+}
+
+func TestListPayments_FillsPagesTheFilterThinned(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	item := func(id string) map[string]types.AttributeValue {
+		item, _ := attributevalue.MarshalMap(&Payment{ID: id, UserID: "user-1", Status: StatusCompleted})
+
+		return item
+	}
+	key := func(id string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"id":       &types.AttributeValueMemberS{Value: id},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-1"},
+			"sort_key": &types.AttributeValueMemberS{Value: "2026-01-15T10:00:00.000000000Z#" + id},
+		}
+	}
+	startsAfter := func(id string, limit int32) any {
+		return mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			start, ok := input.ExclusiveStartKey["id"].(*types.AttributeValueMemberS)
+
+			return *input.Limit == limit && ((id == "" && !ok) || (ok && start.Value == id))
+		})
+	}
+
+	// The filter drops everything in the first read and some of the second.
+	db.On("Query", ctx, startsAfter("", 3)).Return(&dynamodb.QueryOutput{
+		LastEvaluatedKey: key("pay-3"),
+	}, nil)
+	db.On("Query", ctx, startsAfter("pay-3", 3)).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]types.AttributeValue{item("pay-4")},
+		LastEvaluatedKey: key("pay-6"),
+	}, nil)
+	db.On("Query", ctx, startsAfter("pay-6", 2)).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]types.AttributeValue{item("pay-7"), item("pay-8")},
+		LastEvaluatedKey: key("pay-8"),
+	}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	page, err := svc.ListPayments(ctx, &PaymentFilter{UserID: "user-1", Status: StatusCompleted, Limit: 3})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Payments, 3)
+	db.AssertExpectations(t)
+
+	decoded, err := decodePageToken(page.NextToken)
+	assert.NoError(t, err)
+	assert.Equal(t, key("pay-8"), decoded)
+}
+
+func TestListPayments_RequiresIndexedKey(t *testing.T) {
+	svc := New(new(mockDB), nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.ListPayments(context.Background(), &PaymentFilter{Limit: 20})
+
+	assert.ErrorIs(t, err, ErrMissingListKey)
+}
+
+func TestListPayments_RejectsTokenFromOtherIndex(t *testing.T) {
+	token, _ := encodePageToken(map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "pay-1"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-1"},
+		"sort_key": &types.AttributeValueMemberS{Value: "x"},
+	})
+
+	svc := New(new(mockDB), nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.ListPayments(context.Background(), &PaymentFilter{
+		ServiceID: "svc-1",
+		NextToken: token,
+		Limit:     20,
+	})
+
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+}
+
+func TestSortKey_OrdersChronologically(t *testing.T) {
+	base := time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	assert.Less(t, sortKey(base, "b"), sortKey(base.Add(500*time.Millisecond), "a"))
+	assert.Less(t, sortKey(base, "a"), sortKey(base, "b"))
+}
+
+func completedPayment(t *testing.T, amount, refunded int64) map[string]types.AttributeValue {
+	t.Helper()
+
+	item, err := attributevalue.MarshalMap(&Payment{
+		ID:             "pay-123",
+		UserID:         "user-456",
+		Amount:         money.New(decimal.NewFromInt(amount)),
+		RefundedAmount: money.New(decimal.NewFromInt(refunded)),
+		Currency:       "USD",
+		Status:         StatusCompleted,
+		GatewayRef:     "GW-1",
+	})
+	assert.NoError(t, err)
+
+	return item
+}
+
+func TestBackfillSortKeys_SetsMissingKeys(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("Scan", ctx, mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+		return *input.FilterExpression == "attribute_not_exists(sort_key)"
+	})).Return(&dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{
+		{
+			"id":         &types.AttributeValueMemberS{Value: "pay-1"},
+			"created_at": &types.AttributeValueMemberS{Value: "2026-01-15T10:00:00.5Z"},
+		},
+		{
+			"id":         &types.AttributeValueMemberS{Value: "pay-2"},
+			"created_at": &types.AttributeValueMemberS{Value: "yesterday"},
+		},
+	}}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		key := input.ExpressionAttributeValues[":sort_key"].(*types.AttributeValueMemberS).Value
+
+		return input.Key["id"].(*types.AttributeValueMemberS).Value == "pay-1" &&
+			key == "2026-01-15T10:00:00.500000000Z#pay-1"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	report, err := svc.BackfillSortKeys(ctx, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, 1, report.Backfilled)
+	assert.Equal(t, []string{"pay-2"}, report.Unreadable)
+	db.AssertExpectations(t)
+}
+
+func TestRequestRefund_Partial(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).
+		Return(&dynamodb.GetItemOutput{Item: completedPayment(t, 100, 30)}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		update := input.TransactItems[0].Update
+		values := update.ExpressionAttributeValues
+
+		return len(input.TransactItems) == 3 &&
+			values[":previous"].(*types.AttributeValueMemberN).Value == "30" &&
+			values[":refunded"].(*types.AttributeValueMemberN).Value == "70" &&
+			values[":status"].(*types.AttributeValueMemberS).Value == StatusCompleted &&
+			*input.TransactItems[1].Put.TableName == "refunds" &&
+			*input.TransactItems[2].Put.TableName == "outbox"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, nil, Config{
+		PaymentsTable:   "payments",
+		RefundsTable:    "refunds",
+		OutboxTable:     "outbox",
+		GatewayQueueURL: "http://gateway-queue",
+	})
+
+	refund, err := svc.RequestRefund(ctx, "pay-123", decimal.NewFromInt(40), "damaged")
+
+	assert.NoError(t, err)
+	assert.Equal(t, RefundPending, refund.Status)
+	assert.True(t, refund.Amount.Equal(decimal.NewFromInt(40)))
+	db.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.RefundRequested, event.Type)
+	assert.Equal(t, refund.ID, event.RefundID)
+	assert.Equal(t, "GW-1", event.GatewayRef)
+}
+
+func TestRequestRefund_ZeroAmountRefundsRemainder(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).
+		Return(&dynamodb.GetItemOutput{Item: completedPayment(t, 100, 30)}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		values := input.TransactItems[0].Update.ExpressionAttributeValues
+
+		return values[":refunded"].(*types.AttributeValueMemberN).Value == "100" &&
+			values[":status"].(*types.AttributeValueMemberS).Value == StatusRefunded
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	svc := New(db, pub, nil, Config{PaymentsTable: "payments", RefundsTable: "refunds"})
+
+	refund, err := svc.RequestRefund(ctx, "pay-123", decimal.Zero, "")
+
+	assert.NoError(t, err)
+	assert.True(t, refund.Amount.Equal(decimal.NewFromInt(70)))
+	db.AssertExpectations(t)
+}
+
+func TestRequestRefund_ExceedsRemaining(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).
+		Return(&dynamodb.GetItemOutput{Item: completedPayment(t, 100, 80)}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.RequestRefund(ctx, "pay-123", decimal.NewFromInt(21), "")
+
+	assert.ErrorIs(t, err, ErrRefundExceedsPayment)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestRequestRefund_PaymentNotCompleted(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	item, _ := attributevalue.MarshalMap(&Payment{ID: "pay-123", Status: StatusProcessing})
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.RequestRefund(ctx, "pay-123", decimal.NewFromInt(10), "")
+
+	assert.ErrorIs(t, err, ErrPaymentNotRefundable)
+}
+
+func TestRequestRefund_ConcurrentRefundConflicts(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).
+		Return(&dynamodb.GetItemOutput{Item: completedPayment(t, 100, 0)}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).
+		Return(nil, &types.TransactionCanceledException{})
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.RequestRefund(ctx, "pay-123", decimal.NewFromInt(60), "")
+
+	assert.ErrorIs(t, err, ErrRefundConflict)
+}
+
+func pendingRefund(t *testing.T) map[string]types.AttributeValue {
+	t.Helper()
+
+	item, err := attributevalue.MarshalMap(&Refund{
+		ID:        "ref-1",
+		PaymentID: "pay-123",
+		Amount:    money.New(decimal.NewFromInt(40)),
+		Status:    RefundPending,
+	})
+	assert.NoError(t, err)
+
+	return item
+}
+
+func refundedPayment(t *testing.T, status string, refunded int64) map[string]types.AttributeValue {
+	t.Helper()
+
+	item, err := attributevalue.MarshalMap(&Payment{
+		ID:             "pay-123",
+		Amount:         money.New(decimal.NewFromInt(100)),
+		RefundedAmount: money.New(decimal.NewFromInt(refunded)),
+		Status:         status,
+	})
+	assert.NoError(t, err)
+
+	return item
+}
+
+func TestFailRefund_RestoresRefundableAmount(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "refunds"
+	})).Return(&dynamodb.GetItemOutput{Item: pendingRefund(t)}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "payments"
+	})).Return(&dynamodb.GetItemOutput{Item: refundedPayment(t, StatusRefunded, 100)}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		payment := input.TransactItems[1].Update
+		values := payment.ExpressionAttributeValues
+
+		return *input.TransactItems[0].Update.TableName == "refunds" &&
+			*payment.TableName == "payments" &&
+			*payment.ConditionExpression == "#status = :expected AND refunded_amount = :previous" &&
+			values[":expected"].(*types.AttributeValueMemberS).Value == StatusRefunded &&
+			values[":previous"].(*types.AttributeValueMemberN).Value == "100" &&
+			values[":refunded"].(*types.AttributeValueMemberN).Value == "60"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments", RefundsTable: "refunds"})
+
+	err := svc.FailRefund(ctx, "ref-1", "issuer declined")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func TestFailRefund_ConcurrentRefundIsRetried(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "refunds"
+	})).Return(&dynamodb.GetItemOutput{Item: pendingRefund(t)}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "payments"
+	})).Return(&dynamodb.GetItemOutput{Item: refundedPayment(t, StatusCompleted, 40)}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		},
+	})
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments", RefundsTable: "refunds"})
+
+	err := svc.FailRefund(ctx, "ref-1", "issuer declined")
+
+	assert.ErrorIs(t, err, ErrRefundConflict)
+	assert.NotErrorIs(t, err, ErrInvalidTransition)
+}
+
+func TestFailRefund_PaymentNotRefundedIsStale(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "refunds"
+	})).Return(&dynamodb.GetItemOutput{Item: pendingRefund(t)}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "payments"
+	})).Return(&dynamodb.GetItemOutput{Item: refundedPayment(t, StatusFailed, 0)}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments", RefundsTable: "refunds"})
+
+	err := svc.FailRefund(ctx, "ref-1", "issuer declined")
+
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func authorizedPayment(t *testing.T) map[string]types.AttributeValue {
+	t.Helper()
+
+	item, err := attributevalue.MarshalMap(&Payment{
+		ID:            "pay-123",
+		UserID:        "user-456",
+		Amount:        money.New(decimal.NewFromInt(100)),
+		Currency:      "USD",
+		Status:        StatusAuthorized,
+		CaptureMode:   events.CaptureManual,
+		ReservationID: "res-789",
+		GatewayRef:    "GW-1",
+	})
+	assert.NoError(t, err)
+
+	return item
+}
+
+func TestCapture_LowerAmount(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: authorizedPayment(t)}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		update := input.TransactItems[0].Update
+
+		return *update.ConditionExpression == "#status = :authorized" &&
+			update.ExpressionAttributeValues[":amount"].(*types.AttributeValueMemberN).Value == "60" &&
+			update.ExpressionAttributeValues[":to"].(*types.AttributeValueMemberS).Value == StatusProcessing
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, nil, Config{PaymentsTable: "payments", GatewayQueueURL: "http://gateway-queue"})
+
+	payment, err := svc.Capture(ctx, "pay-123", decimal.NewFromInt(60))
+
+	assert.NoError(t, err)
+	assert.Equal(t, StatusProcessing, payment.Status)
+	assert.True(t, payment.Amount.Equal(decimal.NewFromInt(60)))
+	assert.True(t, payment.AuthorizedAmount.Equal(decimal.NewFromInt(100)))
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.CaptureRequested, event.Type)
+	assert.Equal(t, "res-789", event.ReservationID)
+	assert.Equal(t, "GW-1", event.GatewayRef)
+	assert.True(t, event.Amount.Equal(decimal.NewFromInt(60)))
+}
+
+func TestCapture_ExceedsAuthorization(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: authorizedPayment(t)}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.Capture(ctx, "pay-123", decimal.NewFromInt(101))
+
+	assert.ErrorIs(t, err, ErrCaptureExceedsAuthorization)
+}
+
+func TestCapture_RequiresAuthorizedPayment(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	item, _ := attributevalue.MarshalMap(&Payment{ID: "pay-123", Status: StatusCompleted})
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.Capture(ctx, "pay-123", decimal.Zero)
+
+	assert.ErrorIs(t, err, ErrPaymentNotAuthorized)
+}
+
+func TestVoid_ReleasesReservationAndAuthorization(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: authorizedPayment(t)}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, bus, Config{
+		PaymentsTable:   "payments",
+		WalletQueueURL:  "http://wallet-queue",
+		GatewayQueueURL: "http://gateway-queue",
+		EventBusName:    "payment-events",
+	})
+
+	payment, err := svc.Void(ctx, "pay-123")
+
+	assert.NoError(t, err)
+	assert.Equal(t, StatusVoided, payment.Status)
+	pub.AssertExpectations(t)
+	bus.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.PaymentVoided, event.Type)
+	assert.Equal(t, "res-789", event.ReservationID)
+	assert.Equal(t, "GW-1", pub.Calls[1].Arguments[2].(*events.Event).GatewayRef)
+}
+
+func TestVoid_ConcurrentCaptureWins(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: authorizedPayment(t)}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{})
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.Void(ctx, "pay-123")
+
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+}
+
+func TestCancel_NotifiesWalletAndGateway(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+	bus := new(mockPublisher)
+
+	item, _ := attributevalue.MarshalMap(&Payment{
+		ID:            "pay-123",
+		UserID:        "user-456",
+		Status:        StatusReserved,
+		ReservationID: "res-789",
+	})
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		return len(input.TransactItems) == 4 &&
+			*input.TransactItems[0].Update.ConditionExpression == "#status IN (:pending, :reserved)"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://wallet-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, bus, Config{
+		PaymentsTable:   "payments",
+		WalletQueueURL:  "http://wallet-queue",
+		GatewayQueueURL: "http://gateway-queue",
+		EventBusName:    "payment-events",
+	})
+
+	payment, err := svc.Cancel(ctx, "pay-123")
+
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCancelled, payment.Status)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+	bus.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.PaymentCancelled, event.Type)
+	assert.Equal(t, "res-789", event.ReservationID)
+}
+
+func TestCancel_RejectsPaymentAtGateway(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	item, _ := attributevalue.MarshalMap(&Payment{ID: "pay-123", Status: StatusProcessing})
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments"})
+
+	_, err := svc.Cancel(ctx, "pay-123")
+
+	assert.ErrorIs(t, err, ErrPaymentNotCancellable)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestMarkProcessing_ApprovalAfterCancelIsReversed(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	// The gateway approved while Cancel released the reservation.
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		return *input.TableName == "payments"
+	})).Return(nil, &types.ConditionalCheckFailedException{
+		Item: map[string]types.AttributeValue{
+			"status": &types.AttributeValueMemberS{Value: StatusCancelled},
+		},
+	})
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusCancelled)}, nil,
+	)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(input *dynamodb.TransactWriteItemsInput) bool {
+		update := input.TransactItems[0].Update
+		outbox := input.TransactItems[1].Put
+
+		return *update.ConditionExpression == "#status = :cancelled AND attribute_not_exists(gateway_ref)" &&
+			outbox.Item["event_type"].(*types.AttributeValueMemberS).Value == events.ReversalRequested &&
+			outbox.Item["destination"].(*types.AttributeValueMemberS).Value == "http://gateway-queue"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		return *input.TableName == "outbox"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, nil, Config{
+		PaymentsTable:   "payments",
+		OutboxTable:     "outbox",
+		GatewayQueueURL: "http://gateway-queue",
+	})
+
+	err := svc.MarkProcessing(ctx, "pay-123", "GW-1")
+
+	// The approval itself is stale; the reversal is on its way.
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.ReversalRequested, event.Type)
+	assert.Equal(t, "GW-1", event.GatewayRef)
+	assert.True(t, event.Amount.Equal(decimal.NewFromInt(100)))
+}
+
+func TestMarkProcessing_ApprovalReversedOnce(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("UpdateItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{
+		Item: map[string]types.AttributeValue{
+			"status": &types.AttributeValueMemberS{Value: StatusCancelled},
+		},
+	})
+	db.On("GetItem", ctx, mock.Anything).Return(
+		&dynamodb.GetItemOutput{Item: paymentIn(t, StatusCancelled)}, nil,
+	)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("ConditionalCheckFailed")},
+			{Code: aws.String("None")},
+		},
+	})
+
+	svc := New(db, pub, nil, Config{PaymentsTable: "payments", GatewayQueueURL: "http://gateway-queue"})
+
+	err := svc.MarkProcessing(ctx, "pay-123", "GW-1")
+
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	pub.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestListEvents_ReturnsTimeline(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	payment, _ := attributevalue.MarshalMap(&Payment{ID: "pay-123", Status: StatusCompleted})
+	first, _ := attributevalue.MarshalMap(&timeline.Entry{
+		PaymentID: "pay-123",
+		Type:      events.PaymentInitiated,
+		Source:    "payment-orchestrator",
+	})
+	second, _ := attributevalue.MarshalMap(&timeline.Entry{
+		PaymentID: "pay-123",
+		Type:      events.FundsReserved,
+		Source:    "wallet-service",
+	})
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: payment}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.TableName == "timeline" && *input.ScanIndexForward
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{first, second},
+	}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments", TimelineTable: "timeline"})
+
+	entries, err := svc.ListEvents(ctx, "pay-123")
+
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, events.FundsReserved, entries[1].Type)
+	assert.Equal(t, "wallet-service", entries[1].Source)
+}
+
+func TestListEvents_PaymentNotFound(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{PaymentsTable: "payments", TimelineTable: "timeline"})
+
+	_, err := svc.ListEvents(ctx, "missing")
+
+	assert.ErrorIs(t, err, ErrPaymentNotFound)
+	db.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
+}
+
+func webhookService(t *testing.T, db *mockDB, url string) *Service {
+	t.Helper()
+
+	payment, err := attributevalue.MarshalMap(&Payment{
+		ID:        "pay-123",
+		UserID:    "user-456",
+		ServiceID: "svc-1",
+		Amount:    money.New(decimal.NewFromInt(100)),
+		Currency:  "USD",
+		Status:    StatusCompleted,
+	})
+	assert.NoError(t, err)
+
+	endpoint, err := attributevalue.MarshalMap(&WebhookEndpoint{
+		ServiceID: "svc-1",
+		URL:       url,
+		Secret:    "whsec_test",
+	})
+	assert.NoError(t, err)
+
+	db.On("GetItem", mock.Anything, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "payments"
+	})).Return(&dynamodb.GetItemOutput{Item: payment}, nil)
+	db.On("GetItem", mock.Anything, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "webhooks"
+	})).Return(&dynamodb.GetItemOutput{Item: endpoint}, nil)
+
+	svc := New(db, nil, nil, Config{
+		PaymentsTable:   "payments",
+		WebhooksTable:   "webhooks",
+		DeliveriesTable: "deliveries",
+	})
+	// The test endpoints listen on loopback, which the production client
+	// refuses to reach.
+	svc.webhooks = webhook.NewSender(http.DefaultClient)
+
+	return svc
+}
+
+func TestDispatchWebhook_DeliversSignedPayload(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	var (
+		body      []byte
+		signature string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(webhook.SignatureHeader)
+	}))
+	defer srv.Close()
+
+	svc := webhookService(t, db, srv.URL)
+
+	db.On("PutItem", ctx, mock.MatchedBy(func(input *dynamodb.PutItemInput) bool {
+		return *input.TableName == "deliveries" && *input.ConditionExpression == "attribute_not_exists(id)"
+	})).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		status := input.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS)
+
+		return status.Value == DeliveryDelivered
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	event := events.New(events.PaymentCompleted, "pay-123", "user-456")
+
+	err := svc.DispatchWebhook(ctx, &event)
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	assert.NoError(t, webhook.Verify("whsec_test", signature, body, webhook.DefaultTolerance, time.Now()))
+	assert.Contains(t, string(body), `"type":"payment.completed"`)
+	assert.Contains(t, string(body), `"service_id":"svc-1"`)
+}
+
+func TestDispatchWebhook_SchedulesRetryOnFailure(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	svc := webhookService(t, db, srv.URL)
+
+	db.On("PutItem", ctx, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		status := input.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS)
+		_, scheduled := input.ExpressionAttributeValues[":next"]
+
+		return status.Value == DeliveryPending && scheduled
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	event := events.New(events.PaymentFailed, "pay-123", "user-456")
+
+	err := svc.DispatchWebhook(ctx, &event)
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func TestDispatchWebhook_IgnoresDuplicateEvent(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	svc := webhookService(t, db, "http://unused")
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{})
+
+	event := events.New(events.PaymentCompleted, "pay-123", "user-456")
+
+	err := svc.DispatchWebhook(ctx, &event)
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "UpdateItem", mock.Anything, mock.Anything)
+}
+
+func TestRetryWebhooks_GivesUpAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	svc := webhookService(t, db, srv.URL)
+
+	delivery, _ := attributevalue.MarshalMap(&WebhookDelivery{
+		ID:        "evt-1",
+		PaymentID: "pay-123",
+		ServiceID: "svc-1",
+		EventType: events.PaymentCompleted,
+		Payload:   `{}`,
+		Status:    DeliveryPending,
+		Attempts:  make([]WebhookAttempt, webhookMaxAttempts-1),
+	})
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{delivery},
+	}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		status := input.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS)
+
+		return status.Value == DeliveryFailed &&
+			strings.HasSuffix(*input.UpdateExpression, "REMOVE next_attempt_at")
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	delivered, err := svc.RetryWebhooks(ctx, 25)
+
+	assert.NoError(t, err)
+	assert.Zero(t, delivered)
+	db.AssertNumberOfCalls(t, "UpdateItem", 1)
+}
+
+func TestRetryWebhooks_SkipsDeliveryAttemptedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	svc := webhookService(t, db, srv.URL)
+
+	delivery, _ := attributevalue.MarshalMap(&WebhookDelivery{
+		ID:        "evt-1",
+		PaymentID: "pay-123",
+		ServiceID: "svc-1",
+		EventType: events.PaymentCompleted,
+		Payload:   `{}`,
+		Status:    DeliveryPending,
+		Attempts:  make([]WebhookAttempt, 2),
+	})
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{delivery},
+	}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+		attempts := input.ExpressionAttributeValues[":attempts"].(*types.AttributeValueMemberN)
+
+		return *input.ConditionExpression == "size(attempts) = :attempts" && attempts.Value == "2"
+	})).Return(nil, &types.ConditionalCheckFailedException{})
+
+	delivered, err := svc.RetryWebhooks(ctx, 25)
+
+	assert.NoError(t, err)
+	assert.Zero(t, delivered)
+	db.AssertNumberOfCalls(t, "UpdateItem", 1)
+}
+
+func TestRedeliverWebhook_FailedDelivery(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	svc := webhookService(t, db, srv.URL)
+
+	delivery, _ := attributevalue.MarshalMap(&WebhookDelivery{
+		ID:        "evt-1",
+		PaymentID: "pay-123",
+		ServiceID: "svc-1",
+		Payload:   `{}`,
+		Status:    DeliveryFailed,
+		Attempts:  make([]WebhookAttempt, webhookMaxAttempts),
+	})
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+		return *input.TableName == "deliveries"
+	})).Return(&dynamodb.GetItemOutput{Item: delivery}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	result, err := svc.RedeliverWebhook(ctx, "pay-123", "evt-1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, DeliveryDelivered, result.Status)
+	assert.True(t, result.Attempts[len(result.Attempts)-1].Manual)
+
+	_, err = svc.RedeliverWebhook(ctx, "other-payment", "evt-1")
+	assert.ErrorIs(t, err, ErrDeliveryNotFound)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(1))
+	assert.Equal(t, 4*time.Minute, webhookBackoff(4))
+	assert.Equal(t, time.Hour, webhookBackoff(webhookMaxAttempts))
+}
@@ -0,0 +1,505 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/webhook"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("no webhook registered for this service")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrDeliveryConflict = errors.New("webhook delivery was attempted concurrently")
+)
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 8
+	webhookBaseDelay   = 30 * time.Second
+	webhookMaxDelay    = time.Hour
+)
+
+// webhookEvents are the terminal payment outcomes reported to the service
+// that owns the payment.
+var webhookEvents = map[string]bool{
+	events.PaymentCompleted: true,
+	events.PaymentFailed:    true,
+	events.PaymentVoided:    true,
+	events.PaymentCancelled: true,
+}
+
+// WebhookEndpoint is where a service receives its payment webhooks. Secret
+// signs every request and is generated on first registration.
+type WebhookEndpoint struct {
+	CreatedAt time.Time `dynamodbav:"created_at"`
+	UpdatedAt time.Time `dynamodbav:"updated_at"`
+	ServiceID string    `dynamodbav:"service_id"`
+	URL       string    `dynamodbav:"url"`
+	Secret    string    `dynamodbav:"secret"`
+}
+
+// WebhookAttempt is one entry of a delivery log. StatusCode is zero when the
+// endpoint could not be reached.
+type WebhookAttempt struct {
+	At         time.Time `dynamodbav:"at"`
+	URL        string    `dynamodbav:"url,omitempty"`
+	StatusCode int       `dynamodbav:"status_code,omitempty"`
+	DurationMs int64     `dynamodbav:"duration_ms"`
+	Error      string    `dynamodbav:"error,omitempty"`
+	Manual     bool      `dynamodbav:"manual,omitempty"`
+}
+
+// WebhookDelivery is one webhook for one payment outcome, identified by the
+// event that caused it. The payload is fixed at creation so every attempt
+// sends the same body. NextAttemptAt is only set while the delivery is
+// pending, which keeps finished deliveries out of status-index.
+type WebhookDelivery struct {
+	CreatedAt     time.Time        `dynamodbav:"created_at"`
+	UpdatedAt     time.Time        `dynamodbav:"updated_at"`
+	ID            string           `dynamodbav:"id"`
+	PaymentID     string           `dynamodbav:"payment_id"`
+	ServiceID     string           `dynamodbav:"service_id"`
+	EventType     string           `dynamodbav:"event_type"`
+	Payload       string           `dynamodbav:"payload"`
+	Status        string           `dynamodbav:"status"`
+	NextAttemptAt int64            `dynamodbav:"next_attempt_at,omitempty"`
+	Attempts      []WebhookAttempt `dynamodbav:"attempts"`
+}
+
+// webhookPayload is the JSON body sent to the endpoint.
+type webhookPayload struct {
+	CreatedAt time.Time          `json:"created_at"`
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	Data      webhookPaymentData `json:"data"`
+}
+
+type webhookPaymentData struct {
+	ID            string `json:"id"`
+	UserID        string `json:"user_id"`
+	ServiceID     string `json:"service_id"`
+	Amount        string `json:"amount"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+	GatewayRef    string `json:"gateway_ref,omitempty"`
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// RegisterWebhook sets the webhook URL of a service. The signing secret is
+// created the first time and kept on later updates.
+func (s *Service) RegisterWebhook(ctx context.Context, serviceID, url string) (*WebhookEndpoint, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	result, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.webhooksTable),
+		Key: map[string]types.AttributeValue{
+			"service_id": &types.AttributeValueMemberS{Value: serviceID},
+		},
+		UpdateExpression: aws.String(
+			"SET #url = :url, updated_at = :now, secret = if_not_exists(secret, :secret), " +
+				"created_at = if_not_exists(created_at, :now)",
+		),
+		ExpressionAttributeNames: map[string]string{"#url": "url"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":url":    &types.AttributeValueMemberS{Value: url},
+			":secret": &types.AttributeValueMemberS{Value: secret},
+			":now":    &types.AttributeValueMemberS{Value: now},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("register webhook: %w", err)
+	}
+
+	var endpoint WebhookEndpoint
+	if err := attributevalue.UnmarshalMap(result.Attributes, &endpoint); err != nil {
+		return nil, fmt.Errorf("unmarshal webhook endpoint: %w", err)
+	}
+
+	slog.Info("webhook registered", "service_id", serviceID)
+
+	return &endpoint, nil
+}
+
+func (s *Service) GetWebhook(ctx context.Context, serviceID string) (*WebhookEndpoint, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.webhooksTable),
+		Key: map[string]types.AttributeValue{
+			"service_id": &types.AttributeValueMemberS{Value: serviceID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get webhook endpoint: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrWebhookNotFound
+	}
+
+	var endpoint WebhookEndpoint
+	if err := attributevalue.UnmarshalMap(result.Item, &endpoint); err != nil {
+		return nil, fmt.Errorf("unmarshal webhook endpoint: %w", err)
+	}
+
+	return &endpoint, nil
+}
+
+// DispatchWebhook creates the delivery for a terminal payment event and makes
+// the first attempt. Other events, payments without a service and services
+// without a webhook are ignored, as are events that already have a delivery.
+func (s *Service) DispatchWebhook(ctx context.Context, event *events.Event) error {
+	if !webhookEvents[event.Type] {
+		return nil
+	}
+
+	payment, err := s.GetPayment(ctx, event.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	if payment.ServiceID == "" {
+		return nil
+	}
+
+	if _, err := s.GetWebhook(ctx, payment.ServiceID); err != nil {
+		if errors.Is(err, ErrWebhookNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	payload, err := json.Marshal(&webhookPayload{
+		ID:        event.ID,
+		Type:      event.Type,
+		CreatedAt: event.OccurredAt,
+		Data: webhookPaymentData{
+			ID:            payment.ID,
+			UserID:        payment.UserID,
+			ServiceID:     payment.ServiceID,
+			Amount:        payment.Amount.String(),
+			Currency:      payment.Currency,
+			Status:        payment.Status,
+			GatewayRef:    payment.GatewayRef,
+			FailureReason: payment.FailureReason,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal webhook payload: %w", err)
+	}
+
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{
+		ID:            event.ID,
+		PaymentID:     payment.ID,
+		ServiceID:     payment.ServiceID,
+		EventType:     event.Type,
+		Payload:       string(payload),
+		Status:        DeliveryPending,
+		NextAttemptAt: now.Unix(),
+		Attempts:      []WebhookAttempt{},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	item, err := attributevalue.MarshalMap(delivery)
+	if err != nil {
+		return fmt.Errorf("marshal webhook delivery: %w", err)
+	}
+
+	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.deliveriesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// Redelivered event; the first delivery owns the retries.
+			return nil
+		}
+
+		return fmt.Errorf("save webhook delivery: %w", err)
+	}
+
+	return s.attemptDelivery(ctx, delivery, false)
+}
+
+// RetryWebhooks makes the next attempt for up to limit pending deliveries whose
+// retry time has come. It returns the number of deliveries that succeeded.
+func (s *Service) RetryWebhooks(ctx context.Context, limit int32) (int, error) {
+	result, err := s.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.deliveriesTable),
+		IndexName:              aws.String("status-index"),
+		KeyConditionExpression: aws.String("#status = :pending AND next_attempt_at <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: DeliveryPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int32(limit),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+
+	var (
+		delivered int
+		lastErr   error
+	)
+
+	for _, item := range result.Items {
+		var delivery WebhookDelivery
+		if err := attributevalue.UnmarshalMap(item, &delivery); err != nil {
+			lastErr = fmt.Errorf("unmarshal webhook delivery: %w", err)
+
+			continue
+		}
+
+		err := s.attemptDelivery(ctx, &delivery, false)
+		if errors.Is(err, ErrDeliveryConflict) {
+			// Another run got to it first and recorded its own attempt.
+			continue
+		}
+
+		if err != nil {
+			slog.Error("failed to retry webhook", "error", err, "delivery_id", delivery.ID)
+			lastErr = err
+
+			continue
+		}
+
+		if delivery.Status == DeliveryDelivered {
+			delivered++
+		}
+	}
+
+	slog.Info("webhooks retried", "delivered", delivered, "due", len(result.Items))
+
+	return delivered, lastErr
+}
+
+// RedeliverWebhook sends a delivery again right away, whatever its status. A
+// successful redelivery marks it delivered; a failed one is logged without
+// touching the automatic retry schedule.
+func (s *Service) RedeliverWebhook(ctx context.Context, paymentID, deliveryID string) (*WebhookDelivery, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.deliveriesTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: deliveryID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get webhook delivery: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrDeliveryNotFound
+	}
+
+	var delivery WebhookDelivery
+	if err := attributevalue.UnmarshalMap(result.Item, &delivery); err != nil {
+		return nil, fmt.Errorf("unmarshal webhook delivery: %w", err)
+	}
+
+	if delivery.PaymentID != paymentID {
+		return nil, ErrDeliveryNotFound
+	}
+
+	if err := s.attemptDelivery(ctx, &delivery, true); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// ListWebhookDeliveries returns the webhook deliveries of a payment with their
+// attempt logs.
+func (s *Service) ListWebhookDeliveries(ctx context.Context, paymentID string) ([]WebhookDelivery, error) {
+	if _, err := s.GetPayment(ctx, paymentID); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.deliveriesTable),
+		IndexName:              aws.String("payment_id-index"),
+		KeyConditionExpression: aws.String("payment_id = :pid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pid": &types.AttributeValueMemberS{Value: paymentID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+
+	var deliveries []WebhookDelivery
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &deliveries); err != nil {
+		return nil, fmt.Errorf("unmarshal webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// attemptDelivery sends the delivery to the service's current endpoint and
+// appends the outcome to its log. A failed automatic attempt schedules the
+// next one with exponential backoff, or gives up after webhookMaxAttempts.
+// Only storage errors are returned: an unreachable endpoint is an outcome.
+// The attempt is only recorded if no other attempt was recorded since the
+// delivery was read; otherwise ErrDeliveryConflict is returned, so two runs
+// that picked the same delivery neither lose an attempt nor reschedule it
+// twice.
+func (s *Service) attemptDelivery(ctx context.Context, delivery *WebhookDelivery, manual bool) error {
+	attempt := WebhookAttempt{At: time.Now().UTC(), Manual: manual}
+
+	endpoint, err := s.GetWebhook(ctx, delivery.ServiceID)
+	switch {
+	case errors.Is(err, ErrWebhookNotFound):
+		attempt.Error = err.Error()
+	case err != nil:
+		return err
+	default:
+		attempt.URL = endpoint.URL
+
+		result, err := s.webhooks.Send(ctx, endpoint.URL, endpoint.Secret, &webhook.Message{
+			ID:    delivery.ID,
+			Event: delivery.EventType,
+			Body:  []byte(delivery.Payload),
+		})
+		attempt.StatusCode = result.StatusCode
+		attempt.DurationMs = result.Duration.Milliseconds()
+
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+	}
+
+	status, next := delivery.Status, delivery.NextAttemptAt
+
+	switch {
+	case attempt.Error == "":
+		status, next = DeliveryDelivered, 0
+	case manual:
+		// Manual attempts do not count towards the retry budget.
+	case delivery.automaticAttempts()+1 >= webhookMaxAttempts:
+		status, next = DeliveryFailed, 0
+	default:
+		status = DeliveryPending
+		next = attempt.At.Add(webhookBackoff(delivery.automaticAttempts() + 1)).Unix()
+	}
+
+	logged, err := attributevalue.MarshalList([]WebhookAttempt{attempt})
+	if err != nil {
+		return fmt.Errorf("marshal webhook attempt: %w", err)
+	}
+
+	update := "SET #status = :status, updated_at = :now, attempts = list_append(attempts, :attempt)"
+	values := map[string]types.AttributeValue{
+		":status":   &types.AttributeValueMemberS{Value: status},
+		":now":      &types.AttributeValueMemberS{Value: attempt.At.Format(time.RFC3339Nano)},
+		":attempt":  &types.AttributeValueMemberL{Value: logged},
+		":attempts": &types.AttributeValueMemberN{Value: strconv.Itoa(len(delivery.Attempts))},
+	}
+
+	if next == 0 {
+		update += " REMOVE next_attempt_at"
+	} else {
+		update += ", next_attempt_at = :next"
+		values[":next"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(next, 10)}
+	}
+
+	_, err = s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.deliveriesTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: delivery.ID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("size(attempts) = :attempts"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return fmt.Errorf("%w: %s", ErrDeliveryConflict, delivery.ID)
+		}
+
+		return fmt.Errorf("record webhook attempt: %w", err)
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.Status = status
+	delivery.NextAttemptAt = next
+	delivery.UpdatedAt = attempt.At
+
+	if attempt.Error != "" {
+		slog.Warn(
+			"webhook attempt failed",
+			"delivery_id", delivery.ID,
+			"service_id", delivery.ServiceID,
+			"status", status,
+			"error", attempt.Error,
+		)
+	}
+
+	return nil
+}
+
+func (d *WebhookDelivery) automaticAttempts() int {
+	n := 0
+
+	for _, a := range d.Attempts {
+		if !a.Manual {
+			n++
+		}
+	}
+
+	return n
+}
+
+// webhookBackoff is the wait after the given number of failed attempts:
+// webhookBaseDelay doubled each time, capped at webhookMaxDelay.
+func webhookBackoff(failed int) time.Duration {
+	delay := webhookBaseDelay << (failed - 1)
+	if delay <= 0 || delay > webhookMaxDelay {
+		return webhookMaxDelay
+	}
+
+	return delay
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate webhook secret: %w", err)
+	}
+
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -1,20 +1,34 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"time"
 
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/webhook"
 	"github.com/shopspring/decimal"
 )
 
+// Capture modes accepted in CreatePaymentRequest.
+const (
+	CaptureAutomatic = "automatic"
+	CaptureManual    = "manual"
+)
+
 type CreatePaymentRequest struct {
 	UserID      string          `json:"user_id"`
 	ServiceID   string          `json:"service_id"`
 	Amount      decimal.Decimal `json:"amount"`
 	Currency    string          `json:"currency"`
 	Description string          `json:"description"`
+	CaptureMode string          `json:"capture_mode,omitempty"`
 }
 
+// Validate checks the request and normalises the currency code to upper case,
+// so "usd" and "USD" create the same payment.
 func (r *CreatePaymentRequest) Validate() error {
 	if r.UserID == "" {
 		return ErrValidation("user_id is required")
@@ -28,9 +42,136 @@ func (r *CreatePaymentRequest) Validate() error {
 		return ErrValidation("currency is required")
 	}
 
+	c, err := currency.Lookup(r.Currency)
+	if err != nil {
+		return ErrValidation(err.Error())
+	}
+
+	if err := c.ValidateAmount(r.Amount); err != nil {
+		return ErrValidation(err.Error())
+	}
+
+	r.Currency = c.Code
+
+	if r.CaptureMode != "" && r.CaptureMode != CaptureAutomatic && r.CaptureMode != CaptureManual {
+		return ErrValidation("capture_mode must be automatic or manual")
+	}
+
+	return nil
+}
+
+// Fingerprint identifies the request content so a reused Idempotency-Key can
+// be told apart from a genuine retry. It is computed over the decoded request,
+// so formatting differences in the original body do not matter.
+func (r *CreatePaymentRequest) Fingerprint() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// CaptureRequest is the optional body of POST /payments/{id}/capture. A zero
+// amount captures the full authorized amount.
+type CaptureRequest struct {
+	Amount decimal.Decimal `json:"amount"`
+}
+
+func (r *CaptureRequest) Validate() error {
+	if r.Amount.IsNegative() {
+		return ErrValidation("amount must not be negative")
+	}
+
+	return nil
+}
+
+// CreateRefundRequest is the body of POST /payments/{id}/refunds. A zero
+// amount refunds whatever is left of the payment.
+type CreateRefundRequest struct {
+	Amount decimal.Decimal `json:"amount"`
+	Reason string          `json:"reason"`
+}
+
+func (r *CreateRefundRequest) Validate() error {
+	if r.Amount.IsNegative() {
+		return ErrValidation("amount must not be negative")
+	}
+
 	return nil
 }
 
+// RegisterWebhookRequest is the body of PUT /services/{id}/webhook.
+type RegisterWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// Validate requires an https URL on a public host, since webhooks are sent
+// from inside the network.
+func (r *RegisterWebhookRequest) Validate() error {
+	if err := webhook.CheckEndpoint(r.URL); err != nil {
+		return ErrValidation("url must be an https URL on a public host")
+	}
+
+	return nil
+}
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// ListPaymentsRequest holds the query string of GET /payments.
+type ListPaymentsRequest struct {
+	From      time.Time
+	To        time.Time
+	UserID    string
+	ServiceID string
+	Status    string
+	NextToken string
+	Limit     int
+}
+
+// ParseListPaymentsRequest reads and validates the listing query parameters.
+// Dates are RFC 3339 and both bounds are inclusive.
+func ParseListPaymentsRequest(params map[string]string) (*ListPaymentsRequest, error) {
+	r := &ListPaymentsRequest{
+		UserID:    params["user_id"],
+		ServiceID: params["service_id"],
+		Status:    params["status"],
+		NextToken: params["next_token"],
+		Limit:     DefaultListLimit,
+	}
+
+	if r.UserID == "" && r.ServiceID == "" && r.Status == "" {
+		return nil, ErrValidation("one of user_id, service_id or status is required")
+	}
+
+	for name, dst := range map[string]*time.Time{"from": &r.From, "to": &r.To} {
+		if v := params[name]; v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, ErrValidation(name + " must be an RFC 3339 timestamp")
+			}
+
+			*dst = t
+		}
+	}
+
+	if !r.From.IsZero() && !r.To.IsZero() && r.To.Before(r.From) {
+		return nil, ErrValidation("to must not be before from")
+	}
+
+	if v := params["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxListLimit {
+			return nil, ErrValidation("limit must be between 1 and " + strconv.Itoa(MaxListLimit))
+		}
+
+		r.Limit = n
+	}
+
+	return r, nil
+}
+
 type Response struct {
 	Data    any    `json:"data,omitempty"`
 	Error   string `json:"error,omitempty"`
@@ -38,14 +179,82 @@ type Response struct {
 }
 
 type PaymentDTO struct {
-	CreatedAt   time.Time `json:"created_at"`
-	ID          string    `json:"id"`
-	UserID      string    `json:"user_id"`
-	ServiceID   string    `json:"service_id"`
-	Amount      string    `json:"amount"`
-	Currency    string    `json:"currency"`
-	Status      string    `json:"status"`
-	Description string    `json:"description"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	ID               string    `json:"id"`
+	UserID           string    `json:"user_id"`
+	ServiceID        string    `json:"service_id"`
+	Amount           string    `json:"amount"`
+	Currency         string    `json:"currency"`
+	Status           string    `json:"status"`
+	Description      string    `json:"description"`
+	CaptureMode      string    `json:"capture_mode,omitempty"`
+	AuthorizedAmount string    `json:"authorized_amount,omitempty"`
+	GatewayRef       string    `json:"gateway_ref,omitempty"`
+	FailureReason    string    `json:"failure_reason,omitempty"`
+	RefundedAmount   string    `json:"refunded_amount,omitempty"`
+}
+
+type RefundDTO struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        string    `json:"id"`
+	PaymentID string    `json:"payment_id"`
+	Amount    string    `json:"amount"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// PaymentEventDTO is one entry of GET /payments/{id}/events. Source is the
+// service that recorded the event first.
+type PaymentEventDTO struct {
+	OccurredAt    time.Time `json:"occurred_at"`
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Source        string    `json:"source"`
+	Amount        string    `json:"amount,omitempty"`
+	Currency      string    `json:"currency,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	ReservationID string    `json:"reservation_id,omitempty"`
+	GatewayRef    string    `json:"gateway_ref,omitempty"`
+	RefundID      string    `json:"refund_id,omitempty"`
+}
+
+// WebhookEndpointDTO describes a service's webhook. Secret is only returned
+// by PUT /services/{id}/webhook.
+type WebhookEndpointDTO struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ServiceID string    `json:"service_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+type WebhookAttemptDTO struct {
+	At         time.Time `json:"at"`
+	URL        string    `json:"url,omitempty"`
+	StatusCode int       `json:"status_code,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+	Manual     bool      `json:"manual,omitempty"`
+}
+
+// WebhookDeliveryDTO is one entry of GET /payments/{id}/webhooks.
+type WebhookDeliveryDTO struct {
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+	NextAttemptAt *time.Time          `json:"next_attempt_at,omitempty"`
+	ID            string              `json:"id"`
+	PaymentID     string              `json:"payment_id"`
+	ServiceID     string              `json:"service_id"`
+	EventType     string              `json:"event_type"`
+	Status        string              `json:"status"`
+	Attempts      []WebhookAttemptDTO `json:"attempts"`
+}
+
+type PaymentListDTO struct {
+	Payments  []PaymentDTO `json:"payments"`
+	NextToken string       `json:"next_token,omitempty"`
 }
 
 func SuccessJSON(data any) string {
@@ -64,7 +273,8 @@ func Headers() map[string]string {
 	return map[string]string{
 		"Content-Type":                 "application/json",
 		"Access-Control-Allow-Origin":  "*",
-		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type, Idempotency-Key",
 	}
 }
 
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/publisher"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/handler"
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+)
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	db := dynamodb.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+	rec := timeline.NewRecorder(db, os.Getenv("TIMELINE_TABLE"), "wallet-service")
+	pub := timeline.NewPublisher(publisher.NewSQS(sqsClient), rec)
+	bus := timeline.NewPublisher(
+		publisher.NewEventBridge(eventbridge.NewFromConfig(cfg), "wallet-service"),
+		rec,
+	)
+
+	var limits map[string]service.Limits
+
+	if path := os.Getenv("SPENDING_LIMITS_FILE"); path != "" {
+		limits, err = service.LoadLimits(path)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	svc := service.New(db, pub, bus, service.Config{
+		DefaultLimits:        limits,
+		WalletsTable:         os.Getenv("WALLETS_TABLE"),
+		WalletKeysTable:      os.Getenv("WALLET_KEYS_TABLE"),
+		ReservationsTable:    os.Getenv("RESERVATIONS_TABLE"),
+		LedgerTable:          os.Getenv("LEDGER_TABLE"),
+		AuditTable:           os.Getenv("WALLET_AUDIT_TABLE"),
+		GatewayQueueURL:      os.Getenv("GATEWAY_QUEUE_URL"),
+		OrchestratorQueueURL: os.Getenv("ORCHESTRATOR_QUEUE_URL"),
+		EventBusName:         os.Getenv("EVENT_BUS_NAME"),
+	})
+
+	api := handler.NewAPI(svc)
+	lambda.Start(api.Handle)
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"os"
+	"time"
 
+	"github.com/HELL0ANTHONY/payment-system/shared/fx"
+	"github.com/HELL0ANTHONY/payment-system/shared/idempotency"
 	"github.com/HELL0ANTHONY/payment-system/shared/publisher"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 
 	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/handler"
@@ -22,16 +27,54 @@ func main() {
 
 	db := dynamodb.NewFromConfig(cfg)
 	sqsClient := sqs.NewFromConfig(cfg)
-	pub := publisher.NewSQS(sqsClient)
-
-	svc := service.New(
-		db,
-		pub,
-		os.Getenv("WALLETS_TABLE"),
-		os.Getenv("RESERVATIONS_TABLE"),
-		os.Getenv("GATEWAY_QUEUE_URL"),
+	rec := timeline.NewRecorder(db, os.Getenv("TIMELINE_TABLE"), "wallet-service")
+	pub := timeline.NewPublisher(publisher.NewSQS(sqsClient), rec)
+	bus := timeline.NewPublisher(
+		publisher.NewEventBridge(eventbridge.NewFromConfig(cfg), "wallet-service"),
+		rec,
 	)
 
-	h := handler.New(svc)
+	var rates fx.Provider
+
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		ttl := 15 * time.Minute
+		if v := os.Getenv("FX_QUOTE_TTL"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				ttl = d
+			}
+		}
+
+		static, err := fx.LoadFile(path, ttl)
+		if err != nil {
+			panic(err)
+		}
+
+		rates = static
+	}
+
+	var limits map[string]service.Limits
+
+	if path := os.Getenv("SPENDING_LIMITS_FILE"); path != "" {
+		limits, err = service.LoadLimits(path)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	svc := service.New(db, pub, bus, service.Config{
+		FX:                   rates,
+		DefaultLimits:        limits,
+		WalletsTable:         os.Getenv("WALLETS_TABLE"),
+		WalletKeysTable:      os.Getenv("WALLET_KEYS_TABLE"),
+		ReservationsTable:    os.Getenv("RESERVATIONS_TABLE"),
+		LedgerTable:          os.Getenv("LEDGER_TABLE"),
+		GatewayQueueURL:      os.Getenv("GATEWAY_QUEUE_URL"),
+		OrchestratorQueueURL: os.Getenv("ORCHESTRATOR_QUEUE_URL"),
+		EventBusName:         os.Getenv("EVENT_BUS_NAME"),
+	})
+
+	guard := idempotency.NewGuard(db, os.Getenv("PROCESSED_EVENTS_TABLE"), "wallet-service")
+
+	h := handler.New(svc, rec, guard)
 	lambda.Start(h.Handle)
 }
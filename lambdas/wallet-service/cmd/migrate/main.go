@@ -0,0 +1,104 @@
+// Command migrate rewrites the wallet and reservation amounts stored as
+// strings by older code as numbers, the encoding the service reads and
+// updates, gives wallets whose balance predates the ledger an opening
+// movement in it and writes the wallet keys of open wallets created before
+// keys existed:
+//
+//	migrate -dry-run
+//
+// It reads the tables named by WALLETS_TABLE, RESERVATIONS_TABLE,
+// LEDGER_TABLE and WALLET_KEYS_TABLE and can run while the service is live;
+// run it again until nothing is left. Users with two open wallets in a
+// currency are listed for one of them to be closed by hand.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "count the items to rewrite without writing")
+	flag.Parse()
+
+	if err := run(context.Background(), *dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, dryRun bool) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("load aws config: %w", err)
+	}
+
+	db := dynamodb.NewFromConfig(cfg)
+
+	migrations := []money.Migration{
+		{Table: os.Getenv("WALLETS_TABLE"), Attributes: []string{"balance", "held"}},
+		{Table: os.Getenv("RESERVATIONS_TABLE"), Attributes: []string{"amount", "payment_amount"}},
+	}
+
+	for _, m := range migrations {
+		m.DryRun = dryRun
+
+		report, err := m.Run(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: scanned %d, rewrote %d\n", m.Table, report.Scanned, report.Rewritten)
+
+		for _, id := range report.Changed {
+			fmt.Printf("%s: %s changed during the migration, run again\n", m.Table, id)
+		}
+
+		for _, id := range report.Unreadable {
+			fmt.Printf("%s: %s has an id or amount that cannot be read\n", m.Table, id)
+		}
+	}
+
+	table := os.Getenv("WALLETS_TABLE")
+	svc := service.New(db, nil, nil, service.Config{
+		WalletsTable:    table,
+		WalletKeysTable: os.Getenv("WALLET_KEYS_TABLE"),
+		LedgerTable:     os.Getenv("LEDGER_TABLE"),
+	})
+
+	report, err := svc.OpenLedgers(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: scanned %d, opened %d ledgers\n", table, report.Scanned, report.Opened)
+
+	for _, id := range report.Changed {
+		fmt.Printf("%s: %s changed during the migration, run again\n", table, id)
+	}
+
+	for _, id := range report.Unbalanced {
+		fmt.Printf("%s: %s has unbalanced ledger movements\n", table, id)
+	}
+
+	keys, err := svc.BackfillWalletKeys(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: scanned %d, wrote %d wallet keys\n", table, keys.Scanned, keys.Written)
+
+	for _, id := range keys.Duplicates {
+		fmt.Printf("%s: %s shares its user and currency with another open wallet\n", table, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// Command statement prints a wallet statement for a date range:
+//
+//	statement -wallet wallet-123 -from 2026-01-01 -to 2026-01-31 -format csv > january.csv
+//
+// It reads the same tables as the service, named by WALLETS_TABLE,
+// RESERVATIONS_TABLE and LEDGER_TABLE.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/pkg/models"
+)
+
+func main() {
+	walletID := flag.String("wallet", "", "wallet ID")
+	req := models.StatementRequest{}
+	flag.StringVar(&req.From, "from", "", "first day (2006-01-02) or RFC 3339 time")
+	flag.StringVar(&req.To, "to", "", "last day, included, or RFC 3339 time, excluded")
+	flag.StringVar(&req.Format, "format", models.FormatCSV, "csv or json")
+	flag.Parse()
+
+	if err := run(context.Background(), *walletID, &req); err != nil {
+		fmt.Fprintln(os.Stderr, "statement:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, walletID string, req *models.StatementRequest) error {
+	if walletID == "" {
+		return errors.New("-wallet is required")
+	}
+
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("load aws config: %w", err)
+	}
+
+	svc := service.New(dynamodb.NewFromConfig(cfg), nil, nil, service.Config{
+		WalletsTable:      os.Getenv("WALLETS_TABLE"),
+		ReservationsTable: os.Getenv("RESERVATIONS_TABLE"),
+		LedgerTable:       os.Getenv("LEDGER_TABLE"),
+	})
+
+	statement, err := svc.Statement(ctx, walletID, req.Start, req.End)
+	if err != nil {
+		return err
+	}
+
+	if req.Format == models.FormatCSV {
+		return statement.WriteCSV(os.Stdout)
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+
+	return out.Encode(statement)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/publisher"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/handler"
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+)
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	db := dynamodb.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+	rec := timeline.NewRecorder(db, os.Getenv("TIMELINE_TABLE"), "wallet-service")
+	pub := timeline.NewPublisher(publisher.NewSQS(sqsClient), rec)
+	bus := timeline.NewPublisher(
+		publisher.NewEventBridge(eventbridge.NewFromConfig(cfg), "wallet-service"),
+		rec,
+	)
+
+	svc := service.New(db, pub, bus, service.Config{
+		WalletsTable:         os.Getenv("WALLETS_TABLE"),
+		WalletKeysTable:      os.Getenv("WALLET_KEYS_TABLE"),
+		ReservationsTable:    os.Getenv("RESERVATIONS_TABLE"),
+		LedgerTable:          os.Getenv("LEDGER_TABLE"),
+		GatewayQueueURL:      os.Getenv("GATEWAY_QUEUE_URL"),
+		OrchestratorQueueURL: os.Getenv("ORCHESTRATOR_QUEUE_URL"),
+		EventBusName:         os.Getenv("EVENT_BUS_NAME"),
+	})
+
+	v := handler.NewVerifier(svc)
+	lambda.Start(v.Handle)
+}
@@ -0,0 +1,510 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/shopspring/decimal"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/pkg/models"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// API serves the wallet endpoints behind API Gateway.
+type API struct {
+	svc *service.Service
+}
+
+func NewAPI(svc *service.Service) *API {
+	return &API{svc: svc}
+}
+
+func (a *API) Handle(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	switch req.Resource + " " + req.HTTPMethod {
+	case "/wallets POST":
+		return a.createWallet(ctx, req)
+	case "/wallets/{id} GET":
+		return a.getWallet(ctx, req)
+	case "/users/{user_id}/wallets GET":
+		return a.listUserWallets(ctx, req)
+	case "/wallets/{id}/status PUT":
+		return a.setStatus(ctx, req)
+	case "/wallets/{id}/limits GET":
+		return a.getLimits(ctx, req)
+	case "/wallets/{id}/limits PUT":
+		return a.setLimits(ctx, req)
+	case "/wallets/{id}/statement GET":
+		return a.statement(ctx, req)
+	case "/wallets/{id}/deposits POST":
+		return a.deposit(ctx, req)
+	case "/transfers POST":
+		return a.transfer(ctx, req)
+	default:
+		return a.response(http.StatusMethodNotAllowed, models.ErrorJSON("method not allowed")), nil
+	}
+}
+
+func (a *API) createWallet(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	var input models.CreateWalletRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal create wallet request", "error", err)
+
+		return a.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	wallet, err := a.svc.CreateWallet(ctx, input.UserID, input.Currency)
+	switch {
+	case errors.Is(err, service.ErrWalletExists):
+		return a.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to create wallet", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to create wallet"),
+		), nil
+	}
+
+	return a.response(http.StatusCreated, models.SuccessJSON(toWalletDTO(wallet))), nil
+}
+
+func (a *API) getWallet(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	id := req.PathParameters["id"]
+	if id == "" {
+		return a.response(http.StatusBadRequest, models.ErrorJSON("id is required")), nil
+	}
+
+	wallet, err := a.svc.GetWallet(ctx, id)
+	if err != nil {
+		if errors.Is(err, service.ErrWalletNotFound) {
+			return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+		}
+
+		slog.Error("failed to get wallet", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to get wallet"),
+		), nil
+	}
+
+	return a.response(http.StatusOK, models.SuccessJSON(toWalletDTO(wallet))), nil
+}
+
+func (a *API) listUserWallets(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	userID := req.PathParameters["user_id"]
+	if userID == "" {
+		return a.response(http.StatusBadRequest, models.ErrorJSON("user_id is required")), nil
+	}
+
+	wallets, err := a.svc.ListUserWallets(ctx, userID)
+	if err != nil {
+		slog.Error("failed to list wallets", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to list wallets"),
+		), nil
+	}
+
+	list := models.WalletListDTO{Wallets: make([]models.WalletDTO, 0, len(wallets))}
+	for i := range wallets {
+		list.Wallets = append(list.Wallets, toWalletDTO(&wallets[i]))
+	}
+
+	return a.response(http.StatusOK, models.SuccessJSON(list)), nil
+}
+
+// setStatus freezes, unfreezes or closes a wallet.
+func (a *API) setStatus(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	var input models.StatusRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal status request", "error", err)
+
+		return a.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	wallet, err := a.svc.SetWalletStatus(
+		ctx,
+		req.PathParameters["id"],
+		input.Status,
+		input.Reason,
+		input.ChangedBy,
+	)
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound):
+		return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+	case errors.Is(err, service.ErrInvalidTransition), errors.Is(err, service.ErrWalletNotEmpty):
+		return a.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case errors.Is(err, service.ErrWalletConflict):
+		return a.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to set wallet status", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to set wallet status"),
+		), nil
+	}
+
+	return a.response(http.StatusOK, models.SuccessJSON(toWalletDTO(wallet))), nil
+}
+
+func (a *API) getLimits(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	wallet, err := a.svc.GetWallet(ctx, req.PathParameters["id"])
+	if err != nil {
+		if errors.Is(err, service.ErrWalletNotFound) {
+			return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+		}
+
+		slog.Error("failed to get wallet", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to get limits"),
+		), nil
+	}
+
+	return a.response(http.StatusOK, models.SuccessJSON(a.toLimitsDTO(wallet))), nil
+}
+
+// setLimits replaces a wallet's own spending limits.
+func (a *API) setLimits(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	var input models.LimitsRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal limits request", "error", err)
+
+		return a.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	wallet, err := a.svc.SetLimits(ctx, req.PathParameters["id"], service.Limits{
+		PerTransaction: amount(input.PerTransaction),
+		Daily:          amount(input.Daily),
+		Weekly:         amount(input.Weekly),
+	})
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound):
+		return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+	case errors.Is(err, service.ErrInvalidLimit), errors.Is(err, currency.ErrTooPrecise):
+		return a.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to set limits", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to set limits"),
+		), nil
+	}
+
+	return a.response(http.StatusOK, models.SuccessJSON(a.toLimitsDTO(wallet))), nil
+}
+
+// statement returns a wallet's movements over a date range, as JSON in the
+// usual envelope or as a CSV file.
+func (a *API) statement(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	input := models.StatementRequest{
+		From:   req.QueryStringParameters["from"],
+		To:     req.QueryStringParameters["to"],
+		Format: req.QueryStringParameters["format"],
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	walletID := req.PathParameters["id"]
+
+	statement, err := a.svc.Statement(ctx, walletID, input.Start, input.End)
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound):
+		return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+	case err != nil:
+		slog.Error("failed to build statement", "error", err, "wallet_id", walletID)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to build statement"),
+		), nil
+	}
+
+	if input.Format == models.FormatJSON {
+		return a.response(http.StatusOK, models.SuccessJSON(statement)), nil
+	}
+
+	var body strings.Builder
+	if err := statement.WriteCSV(&body); err != nil {
+		slog.Error("failed to render statement", "error", err, "wallet_id", walletID)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to build statement"),
+		), nil
+	}
+
+	resp := a.response(http.StatusOK, body.String())
+	resp.Headers["Content-Type"] = "text/csv"
+	resp.Headers["Content-Disposition"] = fmt.Sprintf(
+		"attachment; filename=%q",
+		fmt.Sprintf("statement-%s-%s.csv", walletID, input.Start.Format(time.DateOnly)),
+	)
+
+	return resp, nil
+}
+
+// deposit tops up a wallet. The Idempotency-Key header is required and names
+// the deposit: retrying with the same key and amount replays the result
+// without crediting the wallet again.
+func (a *API) deposit(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	key, msg := idempotencyKey(req)
+	if msg != "" {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(msg)), nil
+	}
+
+	var input models.DepositRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal deposit request", "error", err)
+
+		return a.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	deposit, err := a.svc.DepositFunds(
+		ctx,
+		req.PathParameters["id"],
+		key,
+		input.Amount,
+		input.Currency,
+	)
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound):
+		return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+	case errors.Is(err, service.ErrCurrencyMismatch), errors.Is(err, service.ErrWalletClosed):
+		return a.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case errors.Is(err, service.ErrDepositKeyReused):
+		return a.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case errors.Is(err, service.ErrWalletConflict):
+		return a.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to deposit funds", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to deposit funds"),
+		), nil
+	}
+
+	resp := a.response(http.StatusCreated, models.SuccessJSON(models.DepositDTO{
+		ID:       deposit.ID,
+		Amount:   deposit.Amount.String(),
+		Currency: deposit.Wallet.Currency,
+		Wallet:   toWalletDTO(deposit.Wallet),
+	}))
+
+	if deposit.Replayed {
+		resp.Headers["Idempotent-Replayed"] = "true"
+	}
+
+	return resp, nil
+}
+
+// transfer moves funds between two wallets. Like deposits, it requires an
+// Idempotency-Key, which names the transfer within the source wallet.
+func (a *API) transfer(
+	ctx context.Context,
+	req *awsEvents.APIGatewayProxyRequest,
+) (awsEvents.APIGatewayProxyResponse, error) {
+	key, msg := idempotencyKey(req)
+	if msg != "" {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(msg)), nil
+	}
+
+	var input models.TransferRequest
+	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
+		slog.Error("failed to unmarshal transfer request", "error", err)
+
+		return a.response(http.StatusBadRequest, models.ErrorJSON("invalid json")), nil
+	}
+
+	if err := input.Validate(); err != nil {
+		return a.response(http.StatusBadRequest, models.ErrorJSON(err.Error())), nil
+	}
+
+	transfer, err := a.svc.TransferFunds(
+		ctx,
+		key,
+		input.FromWalletID,
+		input.ToWalletID,
+		input.Amount,
+		input.Currency,
+	)
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound):
+		return a.response(http.StatusNotFound, models.ErrorJSON("wallet not found")), nil
+	case errors.Is(err, service.ErrInsufficientFunds),
+		errors.Is(err, service.ErrCurrencyMismatch),
+		errors.Is(err, service.ErrWalletFrozen),
+		errors.Is(err, service.ErrWalletClosed),
+		errors.Is(err, service.ErrTransferKeyReused):
+		return a.response(http.StatusUnprocessableEntity, models.ErrorJSON(err.Error())), nil
+	case errors.Is(err, service.ErrWalletConflict):
+		return a.response(http.StatusConflict, models.ErrorJSON(err.Error())), nil
+	case err != nil:
+		slog.Error("failed to transfer funds", "error", err)
+
+		return a.response(
+			http.StatusInternalServerError,
+			models.ErrorJSON("failed to transfer funds"),
+		), nil
+	}
+
+	resp := a.response(http.StatusCreated, models.SuccessJSON(models.TransferDTO{
+		ID:           transfer.ID,
+		FromWalletID: transfer.From.ID,
+		ToWalletID:   transfer.ToID,
+		Amount:       transfer.Amount.String(),
+		Currency:     transfer.Currency,
+		Wallet:       toWalletDTO(transfer.From),
+	}))
+
+	if transfer.Replayed {
+		resp.Headers["Idempotent-Replayed"] = "true"
+	}
+
+	return resp, nil
+}
+
+func toWalletDTO(wallet *service.Wallet) models.WalletDTO {
+	return models.WalletDTO{
+		ID:        wallet.ID,
+		UserID:    wallet.UserID,
+		Currency:  wallet.Currency,
+		Status:    wallet.State(),
+		Balance:   wallet.Balance.String(),
+		Held:      wallet.Held.String(),
+		Available: wallet.Available().String(),
+		CreatedAt: wallet.CreatedAt,
+		UpdatedAt: wallet.UpdatedAt,
+	}
+}
+
+func (a *API) toLimitsDTO(wallet *service.Wallet) models.LimitsDTO {
+	limits := a.svc.Limits(wallet)
+	dto := models.LimitsDTO{WalletID: wallet.ID, Currency: wallet.Currency}
+
+	if limits.PerTransaction != nil {
+		dto.PerTransaction = limits.PerTransaction.String()
+	}
+
+	if limits.Daily != nil {
+		dto.Daily = limits.Daily.String()
+	}
+
+	if limits.Weekly != nil {
+		dto.Weekly = limits.Weekly.String()
+	}
+
+	return dto
+}
+
+// amount wraps an optional request amount for the service.
+func amount(d *decimal.Decimal) *money.Amount {
+	if d == nil {
+		return nil
+	}
+
+	a := money.New(*d)
+
+	return &a
+}
+
+func (a *API) response(status int, body string) awsEvents.APIGatewayProxyResponse {
+	return awsEvents.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    models.Headers(),
+		Body:       body,
+	}
+}
+
+// idempotencyKey returns the request's Idempotency-Key, or why the request
+// must be rejected without one.
+func idempotencyKey(req *awsEvents.APIGatewayProxyRequest) (string, string) {
+	key := header(req, idempotencyKeyHeader)
+
+	switch {
+	case key == "":
+		return "", "idempotency key is required"
+	case len(key) > maxIdempotencyKeyLen:
+		return "", "idempotency key is too long"
+	default:
+		return key, ""
+	}
+}
+
+// header returns the first value of a request header, matched
+// case-insensitively since API Gateway forwards header names as the client sent
+// them.
+func header(req *awsEvents.APIGatewayProxyRequest, name string) string {
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
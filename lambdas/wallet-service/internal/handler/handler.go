@@ -7,17 +7,21 @@ import (
 	"log/slog"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/idempotency"
+	"github.com/HELL0ANTHONY/payment-system/shared/timeline"
 	awsEvents "github.com/aws/aws-lambda-go/events"
 
 	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
 )
 
 type Handler struct {
-	svc *service.Service
+	svc      *service.Service
+	recorder *timeline.Recorder
+	guard    *idempotency.Guard
 }
 
-func New(svc *service.Service) *Handler {
-	return &Handler{svc: svc}
+func New(svc *service.Service, recorder *timeline.Recorder, guard *idempotency.Guard) *Handler {
+	return &Handler{svc: svc, recorder: recorder, guard: guard}
 }
 
 func (h *Handler) Handle(ctx context.Context, sqsEvent *awsEvents.SQSEvent) error {
@@ -44,14 +48,41 @@ func (h *Handler) processRecord(ctx context.Context, record *awsEvents.SQSMessag
 	}
 
 	slog.Info("processing event", "type", event.Type, "payment_id", event.PaymentID)
+	h.recorder.Observe(ctx, &event)
 
+	return h.guard.Process(ctx, &event, h.dispatch)
+}
+
+// dispatch runs the service operation for an event, once per event (see
+// idempotency.Guard).
+func (h *Handler) dispatch(ctx context.Context, event *events.Event) error {
 	switch event.Type {
 	case events.PaymentInitiated:
-		return h.svc.ReserveFunds(ctx, event.PaymentID, event.UserID, event.Amount, event.Currency)
+		return h.svc.ReserveFunds(
+			ctx,
+			event.PaymentID,
+			event.UserID,
+			event.Amount,
+			event.Currency,
+			event.CaptureMode,
+		)
 	case events.GatewayPaymentApproved:
 		return h.svc.ConfirmDeduction(ctx, event.PaymentID, event.ReservationID, event.GatewayRef)
-	case events.GatewayPaymentRejected:
+	case events.CaptureCompleted:
+		return h.svc.CaptureFunds(ctx, event.PaymentID, event.ReservationID, event.Amount)
+	case events.GatewayPaymentRejected, events.PaymentVoided:
 		return h.svc.ReleaseFunds(ctx, event.ReservationID, event.Reason)
+	case events.PaymentCancelled:
+		return h.svc.ReleasePaymentFunds(ctx, event.PaymentID, event.Reason)
+	case events.GatewayRefundCompleted:
+		return h.svc.CreditRefund(
+			ctx,
+			event.PaymentID,
+			event.UserID,
+			event.RefundID,
+			event.Amount,
+			event.Currency,
+		)
 	default:
 		slog.Warn("unknown event type", "type", event.Type)
 		return nil
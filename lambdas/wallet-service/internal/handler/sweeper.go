@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+)
+
+// Sweeper releases reservations past their expiry on a schedule.
+type Sweeper struct {
+	svc       *service.Service
+	batchSize int32
+}
+
+func NewSweeper(svc *service.Service, batchSize int32) *Sweeper {
+	return &Sweeper{svc: svc, batchSize: batchSize}
+}
+
+func (s *Sweeper) Handle(ctx context.Context) error {
+	released, err := s.svc.ExpireReservations(ctx, s.batchSize)
+	if err != nil {
+		slog.Error("reservation sweep finished with errors", "error", err, "released", released)
+
+		return err
+	}
+
+	return nil
+}
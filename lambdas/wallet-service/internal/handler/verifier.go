@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/HELL0ANTHONY/payment-system/lambdas/wallet-service/internal/service"
+)
+
+// VerifyRequest names the wallet to check. An empty request, such as the
+// payload of a schedule rule, checks every wallet.
+type VerifyRequest struct {
+	WalletID string `json:"wallet_id"`
+}
+
+// Verifier recomputes wallet balances from the ledger. It fails the
+// invocation when any wallet drifted, so the error metric can raise an alarm.
+type Verifier struct {
+	svc *service.Service
+}
+
+func NewVerifier(svc *service.Service) *Verifier {
+	return &Verifier{svc: svc}
+}
+
+func (v *Verifier) Handle(ctx context.Context, req VerifyRequest) error {
+	if req.WalletID != "" {
+		check, err := v.svc.VerifyWallet(ctx, req.WalletID)
+		if err != nil {
+			return err
+		}
+
+		if check.Drifted() {
+			return fmt.Errorf("wallet %s drifted from the ledger", req.WalletID)
+		}
+
+		return nil
+	}
+
+	drifted, err := v.svc.VerifyWallets(ctx)
+	if err != nil {
+		slog.Error("ledger verification finished with errors", "error", err, "drifted", len(drifted))
+
+		return err
+	}
+
+	if len(drifted) > 0 {
+		return fmt.Errorf("%d wallets drifted from the ledger", len(drifted))
+	}
+
+	return nil
+}
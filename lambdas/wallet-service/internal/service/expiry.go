@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReasonExpired is the wallet.funds_released reason for reservations that
+// ran past expires_at.
+const ReasonExpired = "expired"
+
+// expiryTime is t as expires_at stores it: in UTC, to the second. The
+// sweeper compares expires_at as text with the current time in that form, so
+// an offset or a fraction of a second would expire a reservation early or
+// late.
+func expiryTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// ExpireReservations releases up to limit active reservations whose
+// expires_at has passed, oldest first. Each one is reported with
+// wallet.funds_released and reason expired. It returns the number of
+// reservations released.
+func (s *Service) ExpireReservations(ctx context.Context, limit int32) (int, error) {
+	result, err := s.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.reservationsTable),
+		IndexName:              aws.String("status-index"),
+		KeyConditionExpression: aws.String("#status = :active AND expires_at < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: "active"},
+			":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int32(limit),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("query expired reservations: %w", err)
+	}
+
+	var (
+		expired int
+		lastErr error
+	)
+
+	for _, item := range result.Items {
+		var reservation Reservation
+		if err := attributevalue.UnmarshalMap(item, &reservation); err != nil {
+			lastErr = fmt.Errorf("unmarshal reservation: %w", err)
+
+			continue
+		}
+
+		if err := s.expire(ctx, &reservation); err != nil {
+			slog.Error("failed to expire reservation", "error", err, "reservation_id", reservation.ID)
+			lastErr = err
+
+			continue
+		}
+
+		if reservation.Status == "released" {
+			expired++
+		}
+	}
+
+	slog.Info("reservations expired", "released", expired, "due", len(result.Items))
+
+	return expired, lastErr
+}
+
+// expire releases an expired reservation; release reports it to the
+// orchestrator, which fails the payment.
+func (s *Service) expire(ctx context.Context, reservation *Reservation) error {
+	_, err := s.release(ctx, reservation, ReasonExpired)
+
+	return err
+}
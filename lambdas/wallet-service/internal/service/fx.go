@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/fx"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/shopspring/decimal"
+)
+
+// fundingWallet returns the wallet that pays amount, in code, for a user,
+// with the quote to convert it at, or nil when the wallet is in code. Without
+// a wallet in code, and with a rate provider configured, the user's other
+// active wallets are tried in currency order and the first one whose available
+// balance covers the converted amount is used.
+func (s *Service) fundingWallet(
+	ctx context.Context,
+	userID string,
+	amount decimal.Decimal,
+	code string,
+) (*Wallet, *fx.Quote, error) {
+	wallet, err := s.userWallet(ctx, userID, code)
+	if !errors.Is(err, ErrNoWalletForCurrency) || s.rates == nil {
+		return wallet, nil, err
+	}
+
+	wallets, err := s.ListUserWallets(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slices.SortFunc(wallets, func(a, b Wallet) int {
+		return strings.Compare(a.Currency, b.Currency)
+	})
+
+	var convertible bool
+
+	for i := range wallets {
+		if wallets[i].checkSend() != nil {
+			continue
+		}
+
+		quote, err := s.rates.Quote(ctx, code, wallets[i].Currency)
+		if errors.Is(err, fx.ErrNoRate) {
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("quote %s to %s: %w", code, wallets[i].Currency, err)
+		}
+
+		convertible = true
+
+		if !wallets[i].Available().LessThan(quote.Convert(amount)) {
+			return &wallets[i], &quote, nil
+		}
+	}
+
+	if convertible {
+		return nil, nil, ErrInsufficientFunds
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrNoWalletForCurrency, currency.Normalize(code))
+}
+
+// lockQuote converts the reservation into the quote's currency and keeps the
+// payment's amount and the rate with it, so every later movement of the
+// reservation settles at the same rate. An automatic-capture reservation
+// expires with the quote if the quote runs out first; a manual-capture one
+// keeps its authorization period, since its rate is locked either way.
+func (r *Reservation) lockQuote(quote *fx.Quote) {
+	paid := r.Amount
+	expiresAt := quote.ExpiresAt
+
+	r.PaymentAmount = &paid
+	r.PaymentCurrency = r.Currency
+	r.Amount = money.New(quote.Convert(paid.Decimal))
+	r.Currency = quote.To
+	r.FXRate = quote.Rate.String()
+	r.QuoteExpiresAt = &expiresAt
+
+	if r.CaptureMode != events.CaptureManual && r.ExpiresAt.After(expiresAt) {
+		r.ExpiresAt = expiryTime(expiresAt)
+	}
+}
+
+// payment returns the reserved amount and its currency as the payment has
+// them.
+func (r *Reservation) payment() (decimal.Decimal, string) {
+	if r.PaymentCurrency == "" || r.PaymentAmount == nil {
+		return r.Amount.Decimal, r.Currency
+	}
+
+	return r.PaymentAmount.Decimal, r.PaymentCurrency
+}
+
+// rate is the locked exchange rate, 1 for a reservation in the payment's
+// currency.
+func (r *Reservation) rate() decimal.Decimal {
+	rate, err := decimal.NewFromString(r.FXRate)
+	if err != nil {
+		return decimal.NewFromInt(1)
+	}
+
+	return rate
+}
+
+// settle converts an amount of the payment into the wallet's currency at the
+// locked rate. Settling the whole payment gives back Amount.
+func (r *Reservation) settle(amount decimal.Decimal) decimal.Decimal {
+	if r.PaymentCurrency == "" {
+		return amount
+	}
+
+	quote := fx.Quote{From: r.PaymentCurrency, To: r.Currency, Rate: r.rate()}
+
+	return quote.Convert(amount)
+}
+
+// refund converts an amount refunded of the payment into the wallet's
+// currency at the locked rate. Unlike settle it rounds down, so partial
+// refunds never add up to more than was deducted; refunding the whole
+// payment gives back what settling it deducted.
+func (r *Reservation) refund(amount decimal.Decimal) decimal.Decimal {
+	paid, _ := r.payment()
+	if r.PaymentCurrency == "" || amount.Equal(paid) {
+		return r.settle(amount)
+	}
+
+	converted := amount.Mul(r.rate())
+
+	c, err := currency.Lookup(r.Currency)
+	if err != nil {
+		return converted
+	}
+
+	return converted.RoundFloor(c.MinorUnits)
+}
+
+// reservationEvent starts an event about a reservation for amount of the
+// payment, carrying what it settles to in the wallet.
+func reservationEvent(eventType string, r *Reservation, amount decimal.Decimal) events.Event {
+	_, code := r.payment()
+
+	event := events.New(eventType, r.PaymentID, r.UserID)
+	event.WithAmount(amount, code).
+		WithReservation(r.ID).
+		WithSettlement(r.settle(amount), r.Currency, r.rate())
+
+	return event
+}
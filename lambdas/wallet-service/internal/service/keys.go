@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// WalletKey claims a user's currency for one open wallet. It is written with
+// the wallet, on the condition that it does not exist yet, and deleted when
+// the wallet is closed, so a user cannot end up with two open wallets in a
+// currency however many requests race to create them.
+type WalletKey struct {
+	CreatedAt time.Time `dynamodbav:"created_at"`
+	ID        string    `dynamodbav:"id"`
+	WalletID  string    `dynamodbav:"wallet_id"`
+}
+
+// walletKeyID is the key of a user's wallet in a currency.
+func walletKeyID(userID, code string) string {
+	return userID + "#" + code
+}
+
+// putWalletKey is the transaction item that claims the key of wallet.
+func (s *Service) putWalletKey(wallet *Wallet) (types.TransactWriteItem, error) {
+	item, err := attributevalue.MarshalMap(WalletKey{
+		ID:        walletKeyID(wallet.UserID, wallet.Currency),
+		WalletID:  wallet.ID,
+		CreatedAt: wallet.CreatedAt,
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("marshal wallet key: %w", err)
+	}
+
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:           aws.String(s.walletKeysTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}, nil
+}
+
+// getWalletKey returns the key of the user's wallet in a currency, or nil if
+// no wallet holds it.
+func (s *Service) getWalletKey(ctx context.Context, userID, code string) (*WalletKey, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.walletKeysTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: walletKeyID(userID, code)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get wallet key: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var key WalletKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("unmarshal wallet key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// KeyReport is what BackfillWalletKeys found in the wallets table.
+type KeyReport struct {
+	Scanned int
+	Written int
+	// Duplicates lists the open wallets whose key another open wallet of the
+	// same user and currency holds. One of them has to be closed by hand.
+	Duplicates []string
+}
+
+// BackfillWalletKeys gives every open wallet created before wallet keys
+// existed its key. A key already held by the wallet is left as it is. With
+// dryRun it only counts.
+func (s *Service) BackfillWalletKeys(ctx context.Context, dryRun bool) (*KeyReport, error) {
+	report := &KeyReport{}
+
+	var start map[string]types.AttributeValue
+
+	for {
+		page, err := s.db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(s.walletsTable),
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan wallets: %w", err)
+		}
+
+		var wallets []Wallet
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &wallets); err != nil {
+			return nil, fmt.Errorf("unmarshal wallets: %w", err)
+		}
+
+		for i := range wallets {
+			report.Scanned++
+
+			if err := s.backfillWalletKey(ctx, &wallets[i], dryRun, report); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+func (s *Service) backfillWalletKey(ctx context.Context, wallet *Wallet, dryRun bool, report *KeyReport) error {
+	if wallet.State() == WalletClosed {
+		return nil
+	}
+
+	key, err := s.getWalletKey(ctx, wallet.UserID, wallet.Currency)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case key == nil:
+	case key.WalletID == wallet.ID:
+		return nil
+	default:
+		report.Duplicates = append(report.Duplicates, wallet.ID)
+
+		return nil
+	}
+
+	if dryRun {
+		report.Written++
+
+		return nil
+	}
+
+	put, err := s.putWalletKey(wallet)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           put.Put.TableName,
+		Item:                put.Put.Item,
+		ConditionExpression: put.Put.ConditionExpression,
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			report.Duplicates = append(report.Duplicates, wallet.ID)
+
+			return nil
+		}
+
+		return fmt.Errorf("put wallet key of %s: %w", wallet.ID, err)
+	}
+
+	report.Written++
+
+	return nil
+}
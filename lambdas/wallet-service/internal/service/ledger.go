@@ -0,0 +1,369 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// Ledger accounts. Every wallet has an available and a held account and its
+// balance is their sum. Settlement and funding stand for money leaving to
+// merchants and coming from outside, and transfer for money moving between
+// wallets, so that every movement balances within each wallet.
+const (
+	AccountAvailable  = "available"
+	AccountHeld       = "held"
+	AccountSettlement = "settlement"
+	AccountFunding    = "funding"
+	AccountTransfer   = "transfer"
+)
+
+// Entry directions. A credit increases a wallet account and a debit
+// decreases it.
+const (
+	DirectionDebit  = "debit"
+	DirectionCredit = "credit"
+)
+
+// Movement types.
+const (
+	EntryReserve   = "reserve"
+	EntryRelease   = "release"
+	EntryDeduction = "deduction"
+	EntryRefund    = "refund"
+	EntryTopUp     = "top_up"
+	EntryTransfer  = "transfer"
+	EntryOpening   = "opening"
+)
+
+// LedgerEntry is one side of a wallet movement. Entries are written in the
+// same transaction as the balance change they explain and never updated.
+// The entries of a movement share MovementID and their debits equal their
+// credits.
+type LedgerEntry struct {
+	CreatedAt     time.Time    `dynamodbav:"created_at"`
+	ID            string       `dynamodbav:"id"`
+	MovementID    string       `dynamodbav:"movement_id"`
+	WalletID      string       `dynamodbav:"wallet_id"`
+	PaymentID     string       `dynamodbav:"payment_id,omitempty"`
+	ReservationID string       `dynamodbav:"reservation_id,omitempty"`
+	Type          string       `dynamodbav:"type"`
+	Account       string       `dynamodbav:"account"`
+	Direction     string       `dynamodbav:"direction"`
+	Amount        money.Amount `dynamodbav:"amount"`
+	Currency      string       `dynamodbav:"currency"`
+}
+
+// effect is what the entry adds to its wallet's balance and held amount.
+// Entries on accounts outside the wallet add nothing.
+func (e *LedgerEntry) effect() (balance, held decimal.Decimal) {
+	signed := e.Amount.Decimal
+	if e.Direction == DirectionDebit {
+		signed = signed.Neg()
+	}
+
+	switch e.Account {
+	case AccountAvailable:
+		return signed, decimal.Zero
+	case AccountHeld:
+		return signed, signed
+	default:
+		return decimal.Zero, decimal.Zero
+	}
+}
+
+// movementID derives the ID of a movement from what caused it, so a retried
+// movement cannot write its entries twice.
+func movementID(entryType, sourceID string) string {
+	return entryType + "#" + sourceID
+}
+
+// newMovement returns the fields every entry of a movement shares.
+func newMovement(entryType, sourceID, walletID, currency string) LedgerEntry {
+	return LedgerEntry{
+		MovementID: movementID(entryType, sourceID),
+		WalletID:   walletID,
+		Type:       entryType,
+		Currency:   currency,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// reservationMovement is newMovement for a reservation, linked to its payment.
+func reservationMovement(entryType string, reservation *Reservation, walletID string) LedgerEntry {
+	m := newMovement(entryType, reservation.ID, walletID, reservation.Currency)
+	m.PaymentID = reservation.PaymentID
+	m.ReservationID = reservation.ID
+
+	return m
+}
+
+// transfer returns the debit and credit that move amount between two
+// accounts. seq numbers the pair within the movement to keep IDs stable.
+func transfer(m LedgerEntry, seq int, from, to string, amount decimal.Decimal) []LedgerEntry {
+	debit, credit := m, m
+
+	debit.ID = fmt.Sprintf("%s#%d#%s", m.MovementID, seq, DirectionDebit)
+	debit.Account = from
+	debit.Direction = DirectionDebit
+	debit.Amount = money.New(amount)
+
+	credit.ID = fmt.Sprintf("%s#%d#%s", m.MovementID, seq, DirectionCredit)
+	credit.Account = to
+	credit.Direction = DirectionCredit
+	credit.Amount = money.New(amount)
+
+	return []LedgerEntry{debit, credit}
+}
+
+// ledgerWrites turns entries into puts for the movement's transaction. An
+// entry that already exists cancels the transaction, so a movement is
+// applied once.
+func (s *Service) ledgerWrites(entries []LedgerEntry) ([]types.TransactWriteItem, error) {
+	writes := make([]types.TransactWriteItem, 0, len(entries))
+
+	for i := range entries {
+		item, err := attributevalue.MarshalMap(&entries[i])
+		if err != nil {
+			return nil, fmt.Errorf("marshal ledger entry: %w", err)
+		}
+
+		writes = append(writes, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           aws.String(s.ledgerTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+
+	return writes, nil
+}
+
+// ledgerEntry reads one entry by ID.
+func (s *Service) ledgerEntry(ctx context.Context, id string) (*LedgerEntry, error) {
+	entry, err := s.findLedgerEntry(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, fmt.Errorf("ledger entry %s not found", id)
+	}
+
+	return entry, nil
+}
+
+// findLedgerEntry reads one entry by ID, or nil if it was never written.
+func (s *Service) findLedgerEntry(ctx context.Context, id string) (*LedgerEntry, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.ledgerTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get ledger entry: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var entry LedgerEntry
+	if err := attributevalue.UnmarshalMap(result.Item, &entry); err != nil {
+		return nil, fmt.Errorf("unmarshal ledger entry: %w", err)
+	}
+
+	return &entry, nil
+}
+
+// BalanceCheck compares a wallet with the balances its ledger entries add up
+// to.
+type BalanceCheck struct {
+	WalletID      string
+	Balance       decimal.Decimal
+	Held          decimal.Decimal
+	LedgerBalance decimal.Decimal
+	LedgerHeld    decimal.Decimal
+	Entries       int
+	// Unbalanced lists the movements whose debits and credits differ.
+	Unbalanced []string
+}
+
+// Drifted reports whether the wallet and its ledger disagree.
+func (c *BalanceCheck) Drifted() bool {
+	return !c.Balance.Equal(c.LedgerBalance) || !c.Held.Equal(c.LedgerHeld) || len(c.Unbalanced) > 0
+}
+
+// VerifyWallet recomputes a wallet's balance and held amount from its ledger
+// entries and logs an error when they drift from the stored wallet.
+func (s *Service) VerifyWallet(ctx context.Context, walletID string) (*BalanceCheck, error) {
+	wallet, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := s.walletEntries(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	check := reconcile(wallet, entries)
+	if check.Drifted() {
+		slog.Error(
+			"ledger drift",
+			"wallet_id", walletID,
+			"balance", check.Balance.String(),
+			"ledger_balance", check.LedgerBalance.String(),
+			"held", check.Held.String(),
+			"ledger_held", check.LedgerHeld.String(),
+			"unbalanced", check.Unbalanced,
+		)
+	}
+
+	return check, nil
+}
+
+// VerifyWallets runs VerifyWallet on every wallet and returns the checks
+// that drifted.
+func (s *Service) VerifyWallets(ctx context.Context) ([]*BalanceCheck, error) {
+	var (
+		drifted []*BalanceCheck
+		checked int
+		start   map[string]types.AttributeValue
+	)
+
+	for {
+		page, err := s.db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:            aws.String(s.walletsTable),
+			ProjectionExpression: aws.String("id"),
+			ExclusiveStartKey:    start,
+		})
+		if err != nil {
+			return drifted, fmt.Errorf("scan wallets: %w", err)
+		}
+
+		for _, item := range page.Items {
+			id, _ := item["id"].(*types.AttributeValueMemberS)
+			if id == nil {
+				continue
+			}
+
+			check, err := s.VerifyWallet(ctx, id.Value)
+			if err != nil {
+				return drifted, err
+			}
+
+			checked++
+
+			if check.Drifted() {
+				drifted = append(drifted, check)
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		start = page.LastEvaluatedKey
+	}
+
+	slog.Info("ledger verified", "wallets", checked, "drifted", len(drifted))
+
+	return drifted, nil
+}
+
+// walletEntries pages through the wallet_id-index entries of a wallet and
+// returns them oldest first. created_at is stored as RFC3339 with as many
+// fractional digits as it needs, which does not sort as text in time order,
+// so the index order is not relied on and ranges are not left to key
+// conditions.
+func (s *Service) walletEntries(ctx context.Context, walletID string) ([]LedgerEntry, error) {
+	var (
+		entries []LedgerEntry
+		start   map[string]types.AttributeValue
+	)
+
+	for {
+		page, err := s.db.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.ledgerTable),
+			IndexName:              aws.String("wallet_id-index"),
+			KeyConditionExpression: aws.String("wallet_id = :wid"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":wid": &types.AttributeValueMemberS{Value: walletID},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("query ledger entries: %w", err)
+		}
+
+		var batch []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("unmarshal ledger entries: %w", err)
+		}
+
+		entries = append(entries, batch...)
+
+		if len(page.LastEvaluatedKey) == 0 {
+			slices.SortStableFunc(entries, func(a, b LedgerEntry) int {
+				return a.CreatedAt.Compare(b.CreatedAt)
+			})
+
+			return entries, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+// reconcile adds up the wallet accounts of entries and checks every movement
+// balances.
+func reconcile(wallet *Wallet, entries []LedgerEntry) *BalanceCheck {
+	check := &BalanceCheck{
+		WalletID:      wallet.ID,
+		Balance:       wallet.Balance.Decimal,
+		Held:          wallet.Held.Decimal,
+		LedgerBalance: decimal.Zero,
+		LedgerHeld:    decimal.Zero,
+		Entries:       len(entries),
+	}
+
+	movements := make(map[string]decimal.Decimal)
+	order := make([]string, 0)
+
+	for _, e := range entries {
+		signed := e.Amount.Decimal
+		if e.Direction == DirectionDebit {
+			signed = signed.Neg()
+		}
+
+		if _, seen := movements[e.MovementID]; !seen {
+			order = append(order, e.MovementID)
+		}
+
+		movements[e.MovementID] = movements[e.MovementID].Add(signed)
+
+		balanceDelta, heldDelta := e.effect()
+		check.LedgerBalance = check.LedgerBalance.Add(balanceDelta)
+		check.LedgerHeld = check.LedgerHeld.Add(heldDelta)
+	}
+
+	for _, id := range order {
+		if !movements[id].IsZero() {
+			check.Unbalanced = append(check.Unbalanced, id)
+		}
+	}
+
+	return check
+}
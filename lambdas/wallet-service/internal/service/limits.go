@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// ReasonLimitExceeded is the wallet.reservation_failed reason for payments
+// that would take a wallet over one of its spending limits.
+const ReasonLimitExceeded = "limit_exceeded"
+
+const (
+	dailyWindow  = 24 * time.Hour
+	weeklyWindow = 7 * 24 * time.Hour
+)
+
+// Limits caps what a wallet may spend, in the wallet's currency. Daily and
+// Weekly cap the reservations made in the last 24 hours and 7 days. A nil
+// limit does not apply.
+type Limits struct {
+	PerTransaction *money.Amount `dynamodbav:"per_transaction,omitempty" json:"per_transaction,omitempty"`
+	Daily          *money.Amount `dynamodbav:"daily,omitempty"           json:"daily,omitempty"`
+	Weekly         *money.Amount `dynamodbav:"weekly,omitempty"          json:"weekly,omitempty"`
+}
+
+// LoadLimits reads the default limits per currency from a JSON file of the
+// form {"USD": {"per_transaction": 500, "daily": 1000, "weekly": 2500}}.
+func LoadLimits(path string) (map[string]Limits, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read limits: %w", err)
+	}
+
+	var raw map[string]Limits
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parse limits: %w", err)
+	}
+
+	limits := make(map[string]Limits, len(raw))
+
+	for code, l := range raw {
+		c, err := currency.Lookup(code)
+		if err != nil {
+			return nil, fmt.Errorf("limits: %w", err)
+		}
+
+		if err := l.validate(c); err != nil {
+			return nil, fmt.Errorf("limits for %s: %w", c.Code, err)
+		}
+
+		limits[c.Code] = l
+	}
+
+	return limits, nil
+}
+
+func (l Limits) validate(c currency.Currency) error {
+	for _, limit := range []*money.Amount{l.PerTransaction, l.Daily, l.Weekly} {
+		if limit == nil {
+			continue
+		}
+
+		if limit.IsNegative() {
+			return ErrInvalidLimit
+		}
+
+		if err := c.CheckPrecision(limit.Decimal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rolling reports whether the limits need the wallet's recent spending.
+func (l Limits) rolling() bool {
+	return l.Daily != nil || l.Weekly != nil
+}
+
+// Limits returns the limits that apply to a wallet: its own, and the default
+// of its currency for any it does not set.
+func (s *Service) Limits(wallet *Wallet) Limits {
+	limits := s.defaultLimits[wallet.Currency]
+
+	if wallet.Limits == nil {
+		return limits
+	}
+
+	if wallet.Limits.PerTransaction != nil {
+		limits.PerTransaction = wallet.Limits.PerTransaction
+	}
+
+	if wallet.Limits.Daily != nil {
+		limits.Daily = wallet.Limits.Daily
+	}
+
+	if wallet.Limits.Weekly != nil {
+		limits.Weekly = wallet.Limits.Weekly
+	}
+
+	return limits
+}
+
+// SetLimits replaces a wallet's own limits. Limits it leaves nil fall back to
+// the currency's default. The wallet version is bumped, so a reservation that
+// read the old limits is retried against the new ones.
+func (s *Service) SetLimits(ctx context.Context, walletID string, limits Limits) (*Wallet, error) {
+	wallet, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := currency.Lookup(wallet.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limits.validate(c); err != nil {
+		return nil, err
+	}
+
+	value, err := attributevalue.Marshal(limits)
+	if err != nil {
+		return nil, fmt.Errorf("marshal limits: %w", err)
+	}
+
+	now := time.Now().UTC()
+
+	_, err = s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.walletsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: walletID},
+		},
+		UpdateExpression:    aws.String("SET limits = :limits, updated_at = :now, version = version + :one"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":limits": value,
+			":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("set limits: %w", err)
+	}
+
+	wallet.Limits = &limits
+	wallet.Version++
+	wallet.UpdatedAt = now
+
+	return wallet, nil
+}
+
+// checkLimits fails with ErrLimitExceeded when holding amount would take the
+// wallet over one of its limits. Daily and weekly limits count what the
+// active and confirmed reservations of the wallet made in the window hold or
+// took (see spent).
+func (s *Service) checkLimits(ctx context.Context, wallet *Wallet, amount decimal.Decimal) error {
+	limits := s.Limits(wallet)
+
+	if limits.PerTransaction != nil && amount.GreaterThan(limits.PerTransaction.Decimal) {
+		return fmt.Errorf("%w: per transaction limit %s", ErrLimitExceeded, limits.PerTransaction)
+	}
+
+	if !limits.rolling() {
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	reservations, err := s.walletReservations(ctx, wallet.ID, now.Add(-weeklyWindow))
+	if err != nil {
+		return err
+	}
+
+	daily, weekly := amount, amount
+
+	for i := range reservations {
+		spent := reservations[i].spent()
+		weekly = weekly.Add(spent)
+
+		if reservations[i].CreatedAt.After(now.Add(-dailyWindow)) {
+			daily = daily.Add(spent)
+		}
+	}
+
+	if limits.Daily != nil && daily.GreaterThan(limits.Daily.Decimal) {
+		return fmt.Errorf("%w: daily limit %s", ErrLimitExceeded, limits.Daily)
+	}
+
+	if limits.Weekly != nil && weekly.GreaterThan(limits.Weekly.Decimal) {
+		return fmt.Errorf("%w: weekly limit %s", ErrLimitExceeded, limits.Weekly)
+	}
+
+	return nil
+}
+
+// spent is what a reservation counts against the spending limits, in the
+// wallet's currency: an active one what it holds, a confirmed one what it
+// deducted, which a partial capture leaves below the hold. Released
+// reservations count nothing. Reservations confirmed before the deducted
+// amount was kept count their hold.
+func (r *Reservation) spent() decimal.Decimal {
+	switch {
+	case r.Status == "confirmed" && r.DeductedAmount != nil:
+		return r.settle(r.DeductedAmount.Decimal)
+	case r.Status == "active" || r.Status == "confirmed":
+		return r.Amount.Decimal
+	default:
+		return decimal.Zero
+	}
+}
+
+// walletReservations returns the reservations of a wallet created since the
+// given time. Reservations made before wallet_id was recorded are not found.
+// created_at does not sort as text in time order within a second (see
+// walletEntries), so the query starts a second early and the rest is
+// filtered here.
+func (s *Service) walletReservations(
+	ctx context.Context,
+	walletID string,
+	since time.Time,
+) ([]Reservation, error) {
+	var (
+		reservations []Reservation
+		start        map[string]types.AttributeValue
+	)
+
+	for {
+		page, err := s.db.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.reservationsTable),
+			IndexName:              aws.String("wallet_id-index"),
+			KeyConditionExpression: aws.String("wallet_id = :wid AND created_at >= :since"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":wid":   &types.AttributeValueMemberS{Value: walletID},
+				":since": &types.AttributeValueMemberS{Value: since.Add(-time.Second).UTC().Format(time.RFC3339)},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("query wallet reservations: %w", err)
+		}
+
+		var batch []Reservation
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("unmarshal reservations: %w", err)
+		}
+
+		for i := range batch {
+			if !batch[i].CreatedAt.Before(since) {
+				reservations = append(reservations, batch[i])
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return reservations, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
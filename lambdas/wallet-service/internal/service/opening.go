@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// OpeningReport is what OpenLedgers found in the wallets table.
+type OpeningReport struct {
+	Scanned int
+	Opened  int
+	// Changed lists the wallets that moved between being read and being
+	// opened. They are left alone; running it again picks them up.
+	Changed []string
+	// Unbalanced lists the wallets with a movement whose debits and credits
+	// differ, which no opening entry explains.
+	Unbalanced []string
+}
+
+// OpenLedgers gives every wallet whose balance predates the ledger an opening
+// movement from funding for the part of its available and held amounts its
+// entries do not add up to, so VerifyWallet and statements account for it.
+// The movement is dated when the wallet was created and keyed by the wallet,
+// so a wallet is opened once. Each write is conditioned on the wallet version
+// that was read. With dryRun it only counts.
+func (s *Service) OpenLedgers(ctx context.Context, dryRun bool) (*OpeningReport, error) {
+	report := &OpeningReport{}
+
+	var start map[string]types.AttributeValue
+
+	for {
+		page, err := s.db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(s.walletsTable),
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan wallets: %w", err)
+		}
+
+		var wallets []Wallet
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &wallets); err != nil {
+			return nil, fmt.Errorf("unmarshal wallets: %w", err)
+		}
+
+		for i := range wallets {
+			report.Scanned++
+
+			if err := s.openLedger(ctx, &wallets[i], dryRun, report); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+func (s *Service) openLedger(ctx context.Context, wallet *Wallet, dryRun bool, report *OpeningReport) error {
+	entries, err := s.walletEntries(ctx, wallet.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		if entries[i].Type == EntryOpening {
+			return nil
+		}
+	}
+
+	check := reconcile(wallet, entries)
+	if len(check.Unbalanced) > 0 {
+		report.Unbalanced = append(report.Unbalanced, wallet.ID)
+
+		return nil
+	}
+
+	if !check.Drifted() {
+		return nil
+	}
+
+	movement := newMovement(EntryOpening, wallet.ID, wallet.ID, wallet.Currency)
+	movement.CreatedAt = wallet.CreatedAt
+
+	available := check.Balance.Sub(check.Held).Sub(check.LedgerBalance.Sub(check.LedgerHeld))
+	held := check.Held.Sub(check.LedgerHeld)
+
+	var opening []LedgerEntry
+
+	for seq, account := range []struct {
+		name   string
+		amount decimal.Decimal
+	}{{AccountAvailable, available}, {AccountHeld, held}} {
+		switch {
+		case account.amount.IsPositive():
+			opening = append(opening, transfer(movement, seq, AccountFunding, account.name, account.amount)...)
+		case account.amount.IsNegative():
+			opening = append(opening, transfer(movement, seq, account.name, AccountFunding, account.amount.Neg())...)
+		}
+	}
+
+	if dryRun {
+		report.Opened++
+
+		return nil
+	}
+
+	writes, err := s.ledgerWrites(opening)
+	if err != nil {
+		return err
+	}
+
+	items := append([]types.TransactWriteItem{{
+		ConditionCheck: &types.ConditionCheck{
+			TableName: aws.String(s.walletsTable),
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: wallet.ID},
+			},
+			ConditionExpression: aws.String("version = :v"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{Value: strconv.Itoa(wallet.Version)},
+			},
+		},
+	}}, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			report.Changed = append(report.Changed, wallet.ID)
+
+			return nil
+		}
+
+		return fmt.Errorf("open ledger of %s: %w", wallet.ID, err)
+	}
+
+	report.Opened++
+
+	return nil
+}
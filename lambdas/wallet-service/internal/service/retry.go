@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// conflictAttempts bounds how many times a wallet write is tried when
+	// other writers keep changing the wallet's version.
+	conflictAttempts = 4
+	// conflictBaseDelay is the upper bound of the first wait between
+	// attempts; it doubles on each retry.
+	conflictBaseDelay = 20 * time.Millisecond
+)
+
+// retryOnConflict runs op until it stops failing with ErrWalletConflict, at
+// most conflictAttempts times. op must read the wallet again on every call.
+// Waits are jittered so writers that collided do not collide again.
+func retryOnConflict(ctx context.Context, op func() error) error {
+	var err error
+
+	for attempt := range conflictAttempts {
+		if attempt > 0 {
+			timer := time.NewTimer(conflictBackoff(attempt))
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		err = op()
+		if !errors.Is(err, ErrWalletConflict) {
+			return err
+		}
+
+		slog.Warn("wallet version conflict", "attempt", attempt+1, "error", err)
+	}
+
+	return err
+}
+
+// conflictBackoff is a random wait of up to conflictBaseDelay doubled for
+// each retry already made.
+func conflictBackoff(retry int) time.Duration {
+	return time.Duration(rand.Int63n(int64(conflictBaseDelay << (retry - 1))))
+}
+
+// walletCheckFailed explains why the condition of a write on wallet failed,
+// from the item DynamoDB returned with the failure. A version that moved on
+// is a conflict worth retrying; otherwise the funds were not there.
+func walletCheckFailed(item map[string]types.AttributeValue, wallet *Wallet) error {
+	var current Wallet
+	if item == nil || attributevalue.UnmarshalMap(item, &current) != nil || current.Version != wallet.Version {
+		return fmt.Errorf("%w: wallet %s", ErrWalletConflict, wallet.ID)
+	}
+
+	return fmt.Errorf("%w: wallet %s", ErrInsufficientFunds, wallet.ID)
+}
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"time"
 
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/fx"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -17,8 +21,34 @@ import (
 )
 
 var (
-	ErrWalletNotFound    = errors.New("wallet not found")
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrWalletNotFound            = errors.New("wallet not found")
+	ErrNoWalletForCurrency       = errors.New("no wallet for currency")
+	ErrInsufficientFunds         = errors.New("insufficient funds")
+	ErrReservationNotActive      = errors.New("reservation is not active")
+	ErrCaptureExceedsReservation = errors.New("capture exceeds the reserved amount")
+	ErrWalletConflict            = errors.New("wallet was modified concurrently")
+	ErrWalletExists              = errors.New("user already has a wallet in this currency")
+	ErrAmbiguousWallet           = errors.New("user has more than one open wallet in this currency")
+	ErrCurrencyMismatch          = errors.New("currency does not match the wallet")
+	ErrInvalidAmount             = errors.New("amount must be positive")
+	ErrDepositKeyReused          = errors.New("idempotency key was used for a different deposit")
+	ErrSameWallet                = errors.New("cannot transfer to the same wallet")
+	ErrTransferKeyReused         = errors.New("idempotency key was used for a different transfer")
+	ErrLimitExceeded             = errors.New("spending limit exceeded")
+	ErrInvalidLimit              = errors.New("limits must not be negative")
+	ErrWalletFrozen              = errors.New("wallet is frozen")
+	ErrWalletClosed              = errors.New("wallet is closed")
+	ErrInvalidTransition         = errors.New("wallet cannot move to that status")
+	ErrWalletNotEmpty            = errors.New("wallet must be empty to close")
+	ErrInvalidRange              = errors.New("statement range must end after it starts")
+)
+
+const (
+	// reservationTTL is how long an automatic-capture reservation holds funds.
+	reservationTTL = 15 * time.Minute
+	// authorizationTTL is how long a manual-capture reservation waits for
+	// capture or void.
+	authorizationTTL = 7 * 24 * time.Hour
 )
 
 // DynamoDBClient defines the DynamoDB operations we need.
@@ -43,6 +73,16 @@ type DynamoDBClient interface {
 		params *dynamodb.QueryInput,
 		optFns ...func(*dynamodb.Options),
 	) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(
+		ctx context.Context,
+		params *dynamodb.TransactWriteItemsInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.TransactWriteItemsOutput, error)
+	Scan(
+		ctx context.Context,
+		params *dynamodb.ScanInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.ScanOutput, error)
 }
 
 // EventPublisher defines the event publishing operations we need.
@@ -50,100 +90,263 @@ type EventPublisher interface {
 	Publish(ctx context.Context, queueURL string, event *events.Event) error
 }
 
+// Wallet is a user's balance. Held is the part of Balance promised to active
+// reservations; only the rest is available for new payments. Limits are the
+// wallet's own spending limits, if any (see Service.Limits). Status decides
+// which movements the wallet accepts (see State).
 type Wallet struct {
-	UpdatedAt time.Time `dynamodbav:"updated_at"`
-	ID        string    `dynamodbav:"id"`
-	UserID    string    `dynamodbav:"user_id"`
-	Balance   string    `dynamodbav:"balance"`
-	Currency  string    `dynamodbav:"currency"`
-	Version   int       `dynamodbav:"version"`
+	UpdatedAt time.Time    `dynamodbav:"updated_at"`
+	CreatedAt time.Time    `dynamodbav:"created_at"`
+	Limits    *Limits      `dynamodbav:"limits,omitempty"`
+	ID        string       `dynamodbav:"id"`
+	UserID    string       `dynamodbav:"user_id"`
+	Balance   money.Amount `dynamodbav:"balance"`
+	Held      money.Amount `dynamodbav:"held"`
+	Currency  string       `dynamodbav:"currency"`
+	Status    string       `dynamodbav:"status,omitempty"`
+	Version   int          `dynamodbav:"version"`
 }
 
+// Available is the balance that is not held by any reservation.
+func (w *Wallet) Available() decimal.Decimal {
+	return w.Balance.Sub(w.Held.Decimal)
+}
+
+// Reservation holds Amount, in the wallet's currency, for a payment. When the
+// payment is in another currency the reservation keeps the payment's amount
+// and the quote it was converted at (see lockQuote). ReleaseReason is why a
+// released reservation was released.
 type Reservation struct {
-	ExpiresAt time.Time `dynamodbav:"expires_at"`
-	CreatedAt time.Time `dynamodbav:"created_at"`
-	ID        string    `dynamodbav:"id"`
-	PaymentID string    `dynamodbav:"payment_id"`
-	UserID    string    `dynamodbav:"user_id"`
-	Amount    string    `dynamodbav:"amount"`
-	Currency  string    `dynamodbav:"currency"`
-	Status    string    `dynamodbav:"status"`
+	ExpiresAt       time.Time     `dynamodbav:"expires_at"`
+	CreatedAt       time.Time     `dynamodbav:"created_at"`
+	QuoteExpiresAt  *time.Time    `dynamodbav:"quote_expires_at,omitempty"`
+	PaymentAmount   *money.Amount `dynamodbav:"payment_amount,omitempty"`
+	ID              string        `dynamodbav:"id"`
+	PaymentID       string        `dynamodbav:"payment_id"`
+	UserID          string        `dynamodbav:"user_id"`
+	WalletID        string        `dynamodbav:"wallet_id,omitempty"`
+	Amount          money.Amount  `dynamodbav:"amount"`
+	Currency        string        `dynamodbav:"currency"`
+	Status          string        `dynamodbav:"status"`
+	CaptureMode     string        `dynamodbav:"capture_mode,omitempty"`
+	PaymentCurrency string        `dynamodbav:"payment_currency,omitempty"`
+	FXRate          string        `dynamodbav:"fx_rate,omitempty"`
+	ReleaseReason   string        `dynamodbav:"release_reason,omitempty"`
+	// DeductedAmount is what a confirmed reservation charged, in the
+	// payment's currency, and GatewayRef the charge it settled. They let a
+	// lost funds_deducted be sent again.
+	DeductedAmount *money.Amount `dynamodbav:"deducted_amount,omitempty"`
+	GatewayRef     string        `dynamodbav:"gateway_ref,omitempty"`
+}
+
+// Config holds the resources the service works with.
+type Config struct {
+	// FX quotes exchange rates for payments in a currency the user has no
+	// wallet in. Without it such payments fail.
+	FX fx.Provider
+	// DefaultLimits are the spending limits, per currency code, of wallets
+	// that do not set their own.
+	DefaultLimits        map[string]Limits
+	WalletsTable         string
+	WalletKeysTable      string
+	ReservationsTable    string
+	LedgerTable          string
+	AuditTable           string
+	GatewayQueueURL      string
+	OrchestratorQueueURL string
+	EventBusName         string
 }
 
 type Service struct {
-	db                DynamoDBClient
-	publisher         EventPublisher
-	walletsTable      string
-	reservationsTable string
-	gatewayQueueURL   string
-}
-
-func New(
-	db DynamoDBClient,
-	pub EventPublisher,
-	walletsTable, reservationsTable, gatewayQueueURL string,
-) *Service {
+	db                   DynamoDBClient
+	publisher            EventPublisher
+	bus                  EventPublisher
+	rates                fx.Provider
+	defaultLimits        map[string]Limits
+	walletsTable         string
+	walletKeysTable      string
+	reservationsTable    string
+	ledgerTable          string
+	auditTable           string
+	gatewayQueueURL      string
+	orchestratorQueueURL string
+	eventBusName         string
+}
+
+// New creates a service that sends events to other services through pub
+// (SQS) and broadcasts how reservations end through bus (EventBridge).
+func New(db DynamoDBClient, pub, bus EventPublisher, cfg Config) *Service {
 	return &Service{
-		db:                db,
-		publisher:         pub,
-		walletsTable:      walletsTable,
-		reservationsTable: reservationsTable,
-		gatewayQueueURL:   gatewayQueueURL,
+		db:                   db,
+		publisher:            pub,
+		bus:                  bus,
+		rates:                cfg.FX,
+		defaultLimits:        cfg.DefaultLimits,
+		walletsTable:         cfg.WalletsTable,
+		walletKeysTable:      cfg.WalletKeysTable,
+		reservationsTable:    cfg.ReservationsTable,
+		ledgerTable:          cfg.LedgerTable,
+		auditTable:           cfg.AuditTable,
+		gatewayQueueURL:      cfg.GatewayQueueURL,
+		orchestratorQueueURL: cfg.OrchestratorQueueURL,
+		eventBusName:         cfg.EventBusName,
 	}
 }
 
+// ReserveFunds holds amount for a payment. The reservation and the increase
+// of the wallet's held balance are written in one transaction conditioned on
+// the wallet version, so concurrent payments cannot hold the same funds.
+// Manual-capture reservations are kept for authorizationTTL so the merchant
+// can capture or void them later. Payments from a wallet that is not active,
+// or over its spending limits, fail. A version conflict reads the wallet again
+// and retries. A payment has one reservation: when the request is delivered
+// again the reservation already made is published again, if still active.
 func (s *Service) ReserveFunds(
 	ctx context.Context,
 	paymentID, userID string,
 	amount decimal.Decimal,
-	currency string,
+	currency, captureMode string,
 ) error {
-	wallet, err := s.getWalletByUser(ctx, userID)
-	if err != nil {
+	if err := checkAmount(currency, amount); err != nil {
 		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, err.Error())
 	}
 
-	balance, _ := decimal.NewFromString(wallet.Balance)
-	if balance.LessThan(amount) {
-		return s.publishReservationFailed(
-			ctx,
-			paymentID,
-			userID,
-			amount,
-			currency,
-			"insufficient funds",
-		)
-	}
+	var reservation *Reservation
 
-	reservation := &Reservation{
-		ID:        uuid.New().String(),
-		PaymentID: paymentID,
-		UserID:    userID,
-		Amount:    amount.String(),
-		Currency:  currency,
-		Status:    "active",
-		ExpiresAt: time.Now().Add(15 * time.Minute),
-		CreatedAt: time.Now().UTC(),
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		reservation, err = s.reserve(ctx, paymentID, userID, amount, currency, captureMode)
+
+		return err
+	})
+
+	switch {
+	case errors.Is(err, ErrNoWalletForCurrency):
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ErrNoWalletForCurrency.Error())
+	case errors.Is(err, ErrAmbiguousWallet):
+		slog.Error("user has duplicate wallets", "payment_id", paymentID, "user_id", userID, "currency", currency)
+
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ErrAmbiguousWallet.Error())
+	case errors.Is(err, ErrInsufficientFunds):
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ErrInsufficientFunds.Error())
+	case errors.Is(err, ErrWalletFrozen):
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ErrWalletFrozen.Error())
+	case errors.Is(err, ErrWalletClosed):
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ErrWalletClosed.Error())
+	case errors.Is(err, ErrLimitExceeded):
+		slog.Warn("spending limit exceeded", "payment_id", paymentID, "error", err)
+
+		return s.publishReservationFailed(ctx, paymentID, userID, amount, currency, ReasonLimitExceeded)
+	case err != nil:
+		return err
 	}
 
-	if err := s.saveReservation(ctx, reservation); err != nil {
-		return fmt.Errorf("save reservation: %w", err)
+	if reservation.Status != "active" {
+		slog.Info("reservation already settled", "payment_id", paymentID, "status", reservation.Status)
+
+		return nil
 	}
 
-	event := events.New(events.FundsReserved, paymentID, userID)
-	event.WithAmount(amount, currency).WithReservation(reservation.ID)
+	event := reservationEvent(events.FundsReserved, reservation, amount)
+	event.WithCaptureMode(captureMode)
 
+	// Either failure sends the request back to the queue; the redelivery finds
+	// the reservation and publishes it to both again.
 	if err := s.publisher.Publish(ctx, s.gatewayQueueURL, &event); err != nil {
-		slog.Error("failed to publish funds reserved", "error", err)
+		return fmt.Errorf("publish %s to gateway: %w", event.Type, err)
+	}
 
-		return err
+	if err := s.publisher.Publish(ctx, s.orchestratorQueueURL, &event); err != nil {
+		return fmt.Errorf("publish %s to orchestrator: %w", event.Type, err)
 	}
 
-	slog.Info("funds reserved", "payment_id", paymentID, "reservation_id", reservation.ID)
+	slog.Info(
+		"funds reserved",
+		"payment_id", paymentID,
+		"reservation_id", reservation.ID,
+		"wallet_id", reservation.WalletID,
+		"held", reservation.Amount.String(),
+		"wallet_currency", reservation.Currency,
+	)
 
 	return nil
 }
 
+// reserve returns the payment's reservation if it already has one.
+// Otherwise it reads the wallet that funds the payment, checks the available
+// balance and the spending limits and holds amount, converted to the wallet's
+// currency when needed, in a new reservation.
+func (s *Service) reserve(
+	ctx context.Context,
+	paymentID, userID string,
+	amount decimal.Decimal,
+	currency, captureMode string,
+) (*Reservation, error) {
+	existing, err := s.findReservation(ctx, reservationID(paymentID))
+	if err != nil || existing != nil {
+		return existing, err
+	}
+
+	wallet, quote, err := s.fundingWallet(ctx, userID, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wallet.checkSend(); err != nil {
+		return nil, err
+	}
+
+	ttl := reservationTTL
+	if captureMode == events.CaptureManual {
+		ttl = authorizationTTL
+	}
+
+	reservation := &Reservation{
+		ID:          reservationID(paymentID),
+		PaymentID:   paymentID,
+		UserID:      userID,
+		WalletID:    wallet.ID,
+		Amount:      money.New(amount),
+		Currency:    currency,
+		Status:      "active",
+		CaptureMode: captureMode,
+		ExpiresAt:   expiryTime(time.Now().Add(ttl)),
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if quote != nil {
+		reservation.lockQuote(quote)
+	}
+
+	held := reservation.Amount.Decimal
+	if wallet.Available().LessThan(held) {
+		return nil, ErrInsufficientFunds
+	}
+
+	if err := s.checkLimits(ctx, wallet, held); err != nil {
+		return nil, err
+	}
+
+	if err := s.holdFunds(ctx, wallet, reservation, held); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// reservationID is the ID of a payment's reservation. It is derived from the
+// payment so that a reservation request delivered twice cannot hold the funds
+// twice: the second hold finds the ID taken.
+func reservationID(paymentID string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte("reservation:"+paymentID)).String()
+}
+
+// ConfirmDeduction deducts a reservation once the gateway approves the
+// payment. Manual-capture reservations are left active until CaptureFunds or
+// ReleaseFunds. The gateway has charged by then, so a reservation that expired
+// is still deducted while it is active; if the sweeper already released it,
+// the payment failed and the charge is reversed at the gateway instead.
 func (s *Service) ConfirmDeduction(
 	ctx context.Context,
 	paymentID, reservationID, gatewayRef string,
@@ -153,108 +356,811 @@ func (s *Service) ConfirmDeduction(
 		return err
 	}
 
-	amount, _ := decimal.NewFromString(reservation.Amount)
-	if err := s.deductFromWallet(ctx, reservation.UserID, amount); err != nil {
-		return err
+	if reservation.CaptureMode == events.CaptureManual {
+		slog.Info("authorization held", "payment_id", paymentID, "reservation_id", reservationID)
+
+		return nil
 	}
 
-	reservation.Status = "confirmed"
-	if err := s.updateReservation(ctx, reservation); err != nil {
+	amount, _ := reservation.payment()
+
+	if err := s.deduct(ctx, reservation, amount, gatewayRef); err != nil {
 		return err
 	}
 
-	slog.Info("funds deducted", "payment_id", paymentID, "amount", reservation.Amount)
+	if reservation.Status == "active" {
+		// Settled between the read and the deduction; find out how.
+		if reservation, err = s.getReservation(ctx, reservationID); err != nil {
+			return err
+		}
+	}
+
+	if reservation.Status == "released" && reservation.ReleaseReason == ReasonExpired {
+		return s.reverseApproval(ctx, reservation, gatewayRef)
+	}
 
 	return nil
 }
 
+// reverseApproval asks the gateway to give back a charge it approved for a
+// reservation that had already expired and been released. The payment failed
+// with the reservation, so nothing else returns the money.
+func (s *Service) reverseApproval(ctx context.Context, reservation *Reservation, gatewayRef string) error {
+	slog.Warn(
+		"gateway approved an expired reservation, reversing",
+		"payment_id", reservation.PaymentID,
+		"reservation_id", reservation.ID,
+		"gateway_ref", gatewayRef,
+	)
+
+	amount, code := reservation.payment()
+	event := events.New(events.ReversalRequested, reservation.PaymentID, reservation.UserID)
+	event.WithAmount(amount, code).
+		WithGatewayRef(gatewayRef).
+		WithCaptureMode(reservation.CaptureMode).
+		WithReason(ReasonExpired)
+
+	if err := s.publisher.Publish(ctx, s.gatewayQueueURL, &event); err != nil {
+		return fmt.Errorf("publish %s: %w", event.Type, err)
+	}
+
+	return nil
+}
+
+// CaptureFunds deducts amount from a manual-capture reservation and closes it.
+// The uncaptured remainder is no longer held. The gateway has captured by
+// then, so an authorization past its expiry is still captured while active.
+func (s *Service) CaptureFunds(
+	ctx context.Context,
+	paymentID, reservationID string,
+	amount decimal.Decimal,
+) error {
+	reservation, err := s.getReservation(ctx, reservationID)
+	if err != nil {
+		return err
+	}
+
+	if reservation.Status == "released" {
+		return ErrReservationNotActive
+	}
+
+	reserved, _ := reservation.payment()
+	if amount.GreaterThan(reserved) {
+		return ErrCaptureExceedsReservation
+	}
+
+	slog.Info("capturing funds", "payment_id", paymentID, "amount", amount.String())
+
+	return s.deduct(ctx, reservation, amount, "")
+}
+
+// deduct charges amount, in the payment currency, to the wallet at the
+// reservation's locked rate, releases the whole hold of the reservation, which
+// may be larger when a capture is partial, and reports wallet.funds_deducted.
+// A confirmed reservation is not charged again: the request is redelivered
+// when reporting the deduction failed, so the report is sent again instead.
+// A released reservation is left alone. A reservation on a wallet frozen since
+// it was made is deducted too: the gateway has already taken the payment.
+func (s *Service) deduct(
+	ctx context.Context,
+	reservation *Reservation,
+	amount decimal.Decimal,
+	gatewayRef string,
+) error {
+	switch reservation.Status {
+	case "active":
+	case "confirmed":
+		slog.Info("funds already deducted, reporting again", "reservation_id", reservation.ID)
+
+		return s.notifyDeducted(ctx, reservation)
+	default:
+		slog.Info("reservation already settled", "reservation_id", reservation.ID, "status", reservation.Status)
+
+		return nil
+	}
+
+	var deducted bool
+
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		deducted, err = s.deductFromWallet(ctx, reservation, amount, gatewayRef)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !deducted {
+		slog.Info("reservation already settled", "reservation_id", reservation.ID)
+
+		return nil
+	}
+
+	deductedAmount := money.New(amount)
+	reservation.Status = "confirmed"
+	reservation.DeductedAmount = &deductedAmount
+	reservation.GatewayRef = gatewayRef
+
+	slog.Info("funds deducted", "payment_id", reservation.PaymentID, "amount", amount.String())
+
+	return s.notifyDeducted(ctx, reservation)
+}
+
+// notifyDeducted reports the deduction of a confirmed reservation.
+// Reservations confirmed before the deducted amount was kept report the whole
+// payment.
+func (s *Service) notifyDeducted(ctx context.Context, reservation *Reservation) error {
+	amount, _ := reservation.payment()
+	if reservation.DeductedAmount != nil {
+		amount = reservation.DeductedAmount.Decimal
+	}
+
+	event := reservationEvent(events.FundsDeducted, reservation, amount)
+	event.WithGatewayRef(reservation.GatewayRef)
+
+	return s.notify(ctx, &event)
+}
+
+// ReleaseFunds releases an active reservation and gives its amount back to the
+// wallet's available balance. Reservations that are no longer active are left
+// alone.
 func (s *Service) ReleaseFunds(ctx context.Context, reservationID, reason string) error {
 	reservation, err := s.getReservation(ctx, reservationID)
 	if err != nil {
 		return err
 	}
 
-	reservation.Status = "released"
-	if err := s.updateReservation(ctx, reservation); err != nil {
+	_, err = s.release(ctx, reservation, reason)
+
+	return err
+}
+
+// CreditRefund returns a refunded amount to the wallet that paid and tells the
+// orchestrator the refund is settled. A payment converted from another currency
+// is refunded at the rate its reservation locked, rounded down. A version
+// conflict reads the wallet again and retries.
+func (s *Service) CreditRefund(
+	ctx context.Context,
+	paymentID, userID, refundID string,
+	amount decimal.Decimal,
+	currency string,
+) error {
+	reservation, err := s.confirmedReservation(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+
+	settled, walletCurrency, rate := amount, currency, decimal.NewFromInt(1)
+
+	if reservation != nil {
+		if _, code := reservation.payment(); code == currency {
+			settled, walletCurrency, rate = reservation.refund(amount), reservation.Currency, reservation.rate()
+		} else {
+			reservation = nil
+		}
+	}
+
+	var credited bool
+
+	err = retryOnConflict(ctx, func() error {
+		var err error
+
+		credited, err = s.credit(ctx, paymentID, userID, refundID, settled, walletCurrency, reservation)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !credited {
+		// Redelivered: the orchestrator may not have heard of it yet.
+		slog.Info("refund already credited", "refund_id", refundID)
+	}
+
+	event := events.New(events.FundsRefunded, paymentID, userID)
+	event.WithAmount(amount, currency).
+		WithRefund(refundID).
+		WithSettlement(settled, walletCurrency, rate)
+
+	if err := s.publisher.Publish(ctx, s.orchestratorQueueURL, &event); err != nil {
+		slog.Error("failed to publish funds refunded", "error", err)
+
+		return err
+	}
+
+	slog.Info("refund credited", "payment_id", paymentID, "refund_id", refundID)
+
+	return nil
+}
+
+// credit adds amount, in the wallet's currency, to the balance of the wallet
+// the payment's reservation held funds in, or of the user's wallet in that
+// currency for payments without one, with its ledger entries, if no one
+// changed the wallet since it was read. It reports false when the refund was
+// already credited.
+func (s *Service) credit(
+	ctx context.Context,
+	paymentID, userID, refundID string,
+	amount decimal.Decimal,
+	currency string,
+	reservation *Reservation,
+) (bool, error) {
+	var (
+		wallet *Wallet
+		err    error
+	)
+
+	if reservation != nil {
+		wallet, err = s.reservationWallet(ctx, reservation)
+	} else {
+		wallet, err = s.userWallet(ctx, userID, currency)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if err := wallet.checkReceive(); err != nil {
+		return false, err
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.walletsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: wallet.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET balance = :balance, updated_at = :now, version = version + :one",
+				),
+				ConditionExpression: aws.String("version = :v"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":balance": &types.AttributeValueMemberN{Value: wallet.Balance.Add(amount).String()},
+					":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+					":one":     &types.AttributeValueMemberN{Value: "1"},
+					":v":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", wallet.Version)},
+				},
+			},
+		},
+	}
+
+	requireReceivable(items[0].Update)
+
+	movement := newMovement(EntryRefund, refundID, wallet.ID, wallet.Currency)
+	movement.PaymentID = paymentID
+
+	writes, err := s.ledgerWrites(transfer(movement, 0, AccountSettlement, AccountAvailable, amount))
+	if err != nil {
+		return false, err
+	}
+
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			if conditionFailed(tce, 1) {
+				return false, nil
+			}
+
+			return false, fmt.Errorf("%w: wallet %s", ErrWalletConflict, wallet.ID)
+		}
+
+		return false, fmt.Errorf("credit wallet: %w", err)
+	}
+
+	return true, nil
+}
+
+// ReleasePaymentFunds releases every active reservation of a payment. It is
+// used for cancellations, which may arrive before the orchestrator learned
+// the reservation ID, or even before the reservation exists. A reservation
+// the gateway's approval already deducted is paid back: the orchestrator has
+// the charge reversed at the gateway when the approval reaches it.
+func (s *Service) ReleasePaymentFunds(ctx context.Context, paymentID, reason string) error {
+	reservations, err := s.paymentReservations(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+
+	for i := range reservations {
+		if reservations[i].Status == "confirmed" {
+			if err := s.payBack(ctx, &reservations[i], reason); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if _, err := s.release(ctx, &reservations[i], reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// payBack credits a confirmed reservation's wallet with what it deducted, as
+// a refund identified by the reservation, so it is paid back once. It is
+// broadcast as wallet.funds_refunded with the reason; the orchestrator has no
+// refund to settle.
+func (s *Service) payBack(ctx context.Context, reservation *Reservation, reason string) error {
+	deducted, _ := reservation.payment()
+	if reservation.DeductedAmount != nil {
+		deducted = reservation.DeductedAmount.Decimal
+	}
+
+	settled := reservation.settle(deducted)
+
+	var credited bool
+
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		credited, err = s.credit(
+			ctx,
+			reservation.PaymentID,
+			reservation.UserID,
+			reservation.ID,
+			settled,
+			reservation.Currency,
+			reservation,
+		)
+
 		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !credited {
+		slog.Info("deduction already paid back", "reservation_id", reservation.ID)
+
+		return nil
 	}
 
-	slog.Info("funds released", "reservation_id", reservationID, "reason", reason)
+	slog.Warn(
+		"deducted funds paid back",
+		"payment_id", reservation.PaymentID,
+		"reservation_id", reservation.ID,
+		"amount", settled.String(),
+		"reason", reason,
+	)
+
+	event := reservationEvent(events.FundsRefunded, reservation, deducted)
+	event.WithRefund(reservation.ID).WithReason(reason)
+
+	s.broadcast(ctx, &event)
 
 	return nil
 }
 
-func (s *Service) getWalletByUser(ctx context.Context, userID string) (*Wallet, error) {
+func (s *Service) paymentReservations(ctx context.Context, paymentID string) ([]Reservation, error) {
 	result, err := s.db.Query(ctx, &dynamodb.QueryInput{
-		TableName:              aws.String(s.walletsTable),
-		IndexName:              aws.String("user_id-index"),
-		KeyConditionExpression: aws.String("user_id = :uid"),
+		TableName:              aws.String(s.reservationsTable),
+		IndexName:              aws.String("payment_id-index"),
+		KeyConditionExpression: aws.String("payment_id = :pid"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":uid": &types.AttributeValueMemberS{Value: userID},
+			":pid": &types.AttributeValueMemberS{Value: paymentID},
 		},
-		Limit: aws.Int32(1),
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("query reservations: %w", err)
 	}
 
-	if len(result.Items) == 0 {
-		return nil, ErrWalletNotFound
+	var reservations []Reservation
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &reservations); err != nil {
+		return nil, fmt.Errorf("unmarshal reservations: %w", err)
 	}
 
-	var wallet Wallet
-	if err := attributevalue.UnmarshalMap(result.Items[0], &wallet); err != nil {
+	return reservations, nil
+}
+
+// confirmedReservation returns the reservation a payment was charged from,
+// or nil for payments charged before reservations recorded their wallet.
+func (s *Service) confirmedReservation(ctx context.Context, paymentID string) (*Reservation, error) {
+	reservations, err := s.paymentReservations(ctx, paymentID)
+	if err != nil {
 		return nil, err
 	}
 
-	return &wallet, nil
+	for i := range reservations {
+		if reservations[i].Status == "confirmed" && reservations[i].WalletID != "" {
+			return &reservations[i], nil
+		}
+	}
+
+	return nil, nil
 }
 
-func (s *Service) deductFromWallet(
+// holdFunds saves a new reservation and adds its amount to the wallet's held
+// balance in one transaction. The wallet must still be at the version that
+// was read, so the available balance checked by the caller is still valid,
+// and the reservation must not exist yet; either conflict is retried, and the
+// retry finds a reservation made concurrently.
+func (s *Service) holdFunds(
 	ctx context.Context,
-	userID string,
+	wallet *Wallet,
+	reservation *Reservation,
 	amount decimal.Decimal,
 ) error {
-	wallet, err := s.getWalletByUser(ctx, userID)
+	item, err := attributevalue.MarshalMap(reservation)
+	if err != nil {
+		return fmt.Errorf("marshal reservation: %w", err)
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName:           aws.String(s.reservationsTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.walletsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: wallet.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET held = if_not_exists(held, :zero) + :amount, updated_at = :now, " +
+						"version = version + :one",
+				),
+				ConditionExpression: aws.String("version = :v"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount": &types.AttributeValueMemberN{Value: amount.String()},
+					":zero":   &types.AttributeValueMemberN{Value: "0"},
+					":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+					":one":    &types.AttributeValueMemberN{Value: "1"},
+					":v":      &types.AttributeValueMemberN{Value: strconv.Itoa(wallet.Version)},
+				},
+			},
+		},
+	}
+
+	requireSendable(items[1].Update)
+
+	movement := reservationMovement(EntryReserve, reservation, wallet.ID)
+
+	writes, err := s.ledgerWrites(transfer(movement, 0, AccountAvailable, AccountHeld, amount))
 	if err != nil {
 		return err
 	}
 
-	_, err = s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(s.walletsTable),
-		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: wallet.ID},
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return fmt.Errorf("%w: wallet %s", ErrWalletConflict, wallet.ID)
+		}
+
+		return fmt.Errorf("hold funds: %w", err)
+	}
+
+	return nil
+}
+
+// release marks an active reservation released and takes its amount off the
+// wallet's held balance in one transaction. A reservation that is no longer
+// active, or stops being active concurrently, is skipped and release reports
+// false. One already released is reported again, with the reason it was
+// released for: the request is redelivered when reporting it failed.
+func (s *Service) release(ctx context.Context, reservation *Reservation, reason string) (bool, error) {
+	switch reservation.Status {
+	case "active":
+	case "released":
+		slog.Info("funds already released, reporting again", "reservation_id", reservation.ID)
+
+		return false, s.notifyReleased(ctx, reservation)
+	default:
+		slog.Info("reservation already settled", "reservation_id", reservation.ID, "status", reservation.Status)
+
+		return false, nil
+	}
+
+	wallet, err := s.reservationWallet(ctx, reservation)
+	if err != nil {
+		return false, err
+	}
+
+	now := &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	amount := reservation.Amount.Decimal
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.reservationsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: reservation.ID},
+				},
+				UpdateExpression:         aws.String("SET #status = :released, release_reason = :reason"),
+				ConditionExpression:      aws.String("#status = :active"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":released": &types.AttributeValueMemberS{Value: "released"},
+					":reason":   &types.AttributeValueMemberS{Value: reason},
+					":active":   &types.AttributeValueMemberS{Value: "active"},
+				},
+			},
 		},
-		UpdateExpression: aws.String(
-			"SET balance = balance - :amount, updated_at = :now, version = version + :one",
-		),
-		ConditionExpression: aws.String("version = :v AND balance >= :amount"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":amount": &types.AttributeValueMemberN{Value: amount.String()},
-			":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
-			":one":    &types.AttributeValueMemberN{Value: "1"},
-			":v":      &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", wallet.Version)},
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.walletsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: wallet.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET held = held - :amount, updated_at = :now, version = version + :one",
+				),
+				ConditionExpression: aws.String("held >= :amount"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount": &types.AttributeValueMemberN{Value: amount.String()},
+					":now":    now,
+					":one":    &types.AttributeValueMemberN{Value: "1"},
+				},
+			},
 		},
-	})
+	}
 
-	return err
+	movement := reservationMovement(EntryRelease, reservation, wallet.ID)
+
+	writes, err := s.ledgerWrites(transfer(movement, 0, AccountHeld, AccountAvailable, amount))
+	if err != nil {
+		return false, err
+	}
+
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) && conditionFailed(tce, 0) {
+			slog.Info("reservation already settled", "reservation_id", reservation.ID)
+
+			return false, nil
+		}
+
+		return false, fmt.Errorf("release reservation: %w", err)
+	}
+
+	reservation.Status = "released"
+	reservation.ReleaseReason = reason
+
+	slog.Info("funds released", "reservation_id", reservation.ID, "reason", reason)
+
+	return true, s.notifyReleased(ctx, reservation)
 }
 
-func (s *Service) saveReservation(ctx context.Context, r *Reservation) error {
-	item, err := attributevalue.MarshalMap(r)
+// notifyReleased reports the release of a reservation.
+func (s *Service) notifyReleased(ctx context.Context, reservation *Reservation) error {
+	paid, _ := reservation.payment()
+	event := reservationEvent(events.FundsReleased, reservation, paid)
+	event.WithReason(reservation.ReleaseReason)
+
+	return s.notify(ctx, &event)
+}
+
+// conditionFailed reports whether item i of a cancelled transaction failed its
+// condition expression.
+func conditionFailed(tce *types.TransactionCanceledException, i int) bool {
+	return i < len(tce.CancellationReasons) &&
+		aws.ToString(tce.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
+
+// userWallet returns the user's wallet in the given currency, the one holding
+// its WalletKey. A user holds at most one open wallet per currency; closed
+// wallets are not returned.
+func (s *Service) userWallet(ctx context.Context, userID, code string) (*Wallet, error) {
+	code = currency.Normalize(code)
+
+	key, err := s.getWalletKey(ctx, userID, code)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(s.reservationsTable),
-		Item:      item,
-	})
+	if key != nil {
+		return s.GetWallet(ctx, key.WalletID)
+	}
 
-	return err
+	return s.unkeyedUserWallet(ctx, userID, code)
+}
+
+// unkeyedUserWallet finds the user's open wallet in a currency in
+// user_id-index, for wallets created before wallet keys existed. Such users
+// may have ended up with more than one, and then which one pays is not
+// guessed: it fails with ErrAmbiguousWallet.
+func (s *Service) unkeyedUserWallet(ctx context.Context, userID, code string) (*Wallet, error) {
+	var (
+		wallets []Wallet
+		start   map[string]types.AttributeValue
+	)
+
+	for {
+		result, err := s.db.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.walletsTable),
+			IndexName:              aws.String("user_id-index"),
+			KeyConditionExpression: aws.String("user_id = :uid"),
+			FilterExpression: aws.String(
+				"currency = :currency AND (attribute_not_exists(#status) OR #status <> :closed)",
+			),
+			ExpressionAttributeNames: map[string]string{"#status": "status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":uid":      &types.AttributeValueMemberS{Value: userID},
+				":currency": &types.AttributeValueMemberS{Value: code},
+				":closed":   &types.AttributeValueMemberS{Value: WalletClosed},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("query wallets: %w", err)
+		}
+
+		var batch []Wallet
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &batch); err != nil {
+			return nil, fmt.Errorf("unmarshal wallets: %w", err)
+		}
+
+		wallets = append(wallets, batch...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		start = result.LastEvaluatedKey
+	}
+
+	switch len(wallets) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNoWalletForCurrency, code)
+	case 1:
+		return &wallets[0], nil
+	default:
+		return nil, fmt.Errorf("%w: user %s, %s", ErrAmbiguousWallet, userID, code)
+	}
+}
+
+// reservationWallet returns the wallet a reservation holds funds in.
+// Reservations made before wallet_id was recorded are resolved by user and
+// currency.
+func (s *Service) reservationWallet(ctx context.Context, reservation *Reservation) (*Wallet, error) {
+	if reservation.WalletID == "" {
+		return s.userWallet(ctx, reservation.UserID, reservation.Currency)
+	}
+
+	return s.GetWallet(ctx, reservation.WalletID)
+}
+
+// deductFromWallet confirms a reservation, recording what it charged and for
+// which gateway charge, charges captured, converted at the locked rate, to its
+// wallet, takes the reserved amount off the held balance and writes the ledger
+// entry, all in one transaction. It reports false when the reservation stopped
+// being active before the transaction committed, and fails with
+// ErrWalletConflict or ErrInsufficientFunds when the wallet condition does not
+// hold.
+func (s *Service) deductFromWallet(
+	ctx context.Context,
+	reservation *Reservation,
+	captured decimal.Decimal,
+	gatewayRef string,
+) (bool, error) {
+	wallet, err := s.reservationWallet(ctx, reservation)
+	if err != nil {
+		return false, err
+	}
+
+	// Only closed wallets refuse it, and they hold nothing; a frozen wallet
+	// pays what it reserved before it was frozen.
+	if err := wallet.checkReceive(); err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	reserved := reservation.Amount.Decimal
+	amount := reservation.settle(captured)
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.reservationsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: reservation.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET #status = :confirmed, deducted_amount = :deducted, gateway_ref = :ref",
+				),
+				ConditionExpression:      aws.String("#status = :active"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":confirmed": &types.AttributeValueMemberS{Value: "confirmed"},
+					":deducted":  &types.AttributeValueMemberN{Value: captured.String()},
+					":ref":       &types.AttributeValueMemberS{Value: gatewayRef},
+					":active":    &types.AttributeValueMemberS{Value: "active"},
+				},
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.walletsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: wallet.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET balance = balance - :amount, held = held - :held, updated_at = :now, " +
+						"version = version + :one",
+				),
+				ConditionExpression:                 aws.String("version = :v AND balance >= :amount AND held >= :held"),
+				ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount": &types.AttributeValueMemberN{Value: amount.String()},
+					":held":   &types.AttributeValueMemberN{Value: reserved.String()},
+					":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+					":one":    &types.AttributeValueMemberN{Value: "1"},
+					":v":      &types.AttributeValueMemberN{Value: strconv.Itoa(wallet.Version)},
+				},
+			},
+		},
+	}
+
+	requireReceivable(items[1].Update)
+
+	// The captured amount leaves the held account; any uncaptured remainder
+	// goes back to available.
+	movement := reservationMovement(EntryDeduction, reservation, wallet.ID)
+	entries := transfer(movement, 0, AccountHeld, AccountSettlement, amount)
+
+	if remainder := reserved.Sub(amount); remainder.IsPositive() {
+		entries = append(entries, transfer(movement, 1, AccountHeld, AccountAvailable, remainder)...)
+	}
+
+	writes, err := s.ledgerWrites(entries)
+	if err != nil {
+		return false, err
+	}
+
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			if conditionFailed(tce, 0) {
+				return false, nil
+			}
+
+			if conditionFailed(tce, 1) {
+				return false, walletCheckFailed(tce.CancellationReasons[1].Item, wallet)
+			}
+		}
+
+		return false, fmt.Errorf("deduct funds: %w", err)
+	}
+
+	return true, nil
 }
 
 func (s *Service) getReservation(ctx context.Context, id string) (*Reservation, error) {
+	reservation, err := s.findReservation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if reservation == nil {
+		return nil, errors.New("reservation not found")
+	}
+
+	return reservation, nil
+}
+
+// findReservation returns the reservation with id, or nil if there is none.
+func (s *Service) findReservation(ctx context.Context, id string) (*Reservation, error) {
 	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.reservationsTable),
 		Key: map[string]types.AttributeValue{
@@ -262,38 +1168,37 @@ func (s *Service) getReservation(ctx context.Context, id string) (*Reservation,
 		},
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get reservation: %w", err)
 	}
 
 	if result.Item == nil {
-		return nil, errors.New("reservation not found")
+		return nil, nil
 	}
 
 	var r Reservation
+	if err := attributevalue.UnmarshalMap(result.Item, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal reservation: %w", err)
+	}
 
-	return &r, attributevalue.UnmarshalMap(result.Item, &r)
+	return &r, nil
 }
 
-func (s *Service) updateReservation(ctx context.Context, r *Reservation) error {
-	_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(s.reservationsTable),
-		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: r.ID},
-		},
-		UpdateExpression: aws.String("SET #status = :status"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status": &types.AttributeValueMemberS{Value: r.Status},
-		},
-	})
+// checkAmount rejects amounts the shared currency registry would not accept
+// for a payment, so a malformed event never holds funds.
+func checkAmount(code string, amount decimal.Decimal) error {
+	c, err := currency.Lookup(code)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return c.ValidateAmount(amount)
 }
 
+// publishReservationFailed reports a payment that cannot hold funds. The
+// failure is an outcome, not an error: once the orchestrator has been told,
+// the message is done with.
 func (s *Service) publishReservationFailed(
-	_ context.Context,
+	ctx context.Context,
 	paymentID, userID string,
 	amount decimal.Decimal,
 	currency, reason string,
@@ -303,5 +1208,31 @@ func (s *Service) publishReservationFailed(
 
 	slog.Warn("reservation failed", "payment_id", paymentID, "reason", reason)
 
-	return fmt.Errorf("reservation failed: %s", reason)
+	return s.notify(ctx, &event)
+}
+
+// notify tells the orchestrator how a reservation ended and broadcasts the
+// event on the bus for everyone else.
+func (s *Service) notify(ctx context.Context, event *events.Event) error {
+	if err := s.publisher.Publish(ctx, s.orchestratorQueueURL, event); err != nil {
+		return fmt.Errorf("publish %s: %w", event.Type, err)
+	}
+
+	s.broadcast(ctx, event)
+
+	return nil
+}
+
+// broadcast publishes a wallet event to the event bus. Failures are logged
+// rather than returned: the bus feeds observers, and the change it reports
+// has already been committed.
+func (s *Service) broadcast(ctx context.Context, event *events.Event) {
+	if err := s.bus.Publish(ctx, s.eventBusName, event); err != nil {
+		slog.Error(
+			"failed to publish event",
+			"error", err,
+			"event_type", event.Type,
+			"payment_id", event.PaymentID,
+		)
+	}
 }
@@ -2,9 +2,16 @@ package service
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/fx"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/shopspring/decimal"
@@ -60,6 +67,27 @@ func (m *mockDB) Query(
 	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
 }
 
+func (m *mockDB) TransactWriteItems(
+	ctx context.Context,
+	input *dynamodb.TransactWriteItemsInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+func (m *mockDB) Scan(
+	ctx context.Context,
+	input *dynamodb.ScanInput,
+	opts ...func(*dynamodb.Options),
+) (*dynamodb.ScanOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.ScanOutput), args.Error(1)
+}
+
 type mockPublisher struct {
 	mock.Mock
 }
@@ -69,6 +97,22 @@ func (m *mockPublisher) Publish(ctx context.Context, queueURL string, event *eve
 	return args.Error(0)
 }
 
+// noReservation has the payment's reservation lookup find nothing, as for a
+// payment seen for the first time.
+func noReservation(ctx context.Context, db *mockDB) {
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{}, nil)
+}
+
+// noWalletKey has the lookup of the user's wallet key find nothing, as for
+// wallets created before keys existed.
+func noWalletKey(ctx context.Context, db *mockDB) {
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallet-keys"
+	})).Return(&dynamodb.GetItemOutput{}, nil)
+}
+
 // Tests
 
 func TestReserveFunds_Success(t *testing.T) {
@@ -76,6 +120,8 @@ func TestReserveFunds_Success(t *testing.T) {
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
+	noReservation(ctx, db)
+
 	walletItem := map[string]types.AttributeValue{
 		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
 		"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
@@ -84,19 +130,213 @@ func TestReserveFunds_Success(t *testing.T) {
 		"version":  &types.AttributeValueMemberN{Value: "1"},
 	}
 
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallet-keys" &&
+			in.Key["id"].(*types.AttributeValueMemberS).Value == "user-456#USD"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "user-456#USD"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-123"},
+	}}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets" &&
+			in.Key["id"].(*types.AttributeValueMemberS).Value == "wallet-123"
+	})).Return(&dynamodb.GetItemOutput{Item: walletItem}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[1].Update
+		amount := wallet.ExpressionAttributeValues[":amount"].(*types.AttributeValueMemberN)
+		version := wallet.ExpressionAttributeValues[":v"].(*types.AttributeValueMemberN)
+		expiresAt := in.TransactItems[0].Put.Item["expires_at"].(*types.AttributeValueMemberS)
+		_, err := time.Parse(time.RFC3339, expiresAt.Value)
+
+		// The sweeper compares expires_at as text with whole UTC seconds.
+		return *in.TransactItems[0].Put.TableName == "reservations" &&
+			*wallet.TableName == "wallets" &&
+			amount.Value == "100" && version.Value == "1" &&
+			err == nil && strings.HasSuffix(expiresAt.Value, "Z") && !strings.Contains(expiresAt.Value, ".")
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	db.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
+	pub.AssertExpectations(t)
+}
+
+func TestReserveFunds_DuplicateUnkeyedWalletsFail(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{
+			{
+				"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+				"balance":  &types.AttributeValueMemberN{Value: "500"},
+				"currency": &types.AttributeValueMemberS{Value: "USD"},
+			},
+			{
+				"id":       &types.AttributeValueMemberS{Value: "wallet-124"},
+				"balance":  &types.AttributeValueMemberN{Value: "20"},
+				"currency": &types.AttributeValueMemberS{Value: "USD"},
+			},
+		},
+	}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed && e.Reason == ErrAmbiguousWallet.Error()
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+	pub.AssertExpectations(t)
+}
+
+func TestReserveFunds_HeldFundsAreNotAvailable(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-456"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "450"},
+		"version": &types.AttributeValueMemberN{Value: "4"},
+	}
+
 	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
 		Items: []map[string]types.AttributeValue{walletItem},
 	}, nil)
-	db.On("PutItem", ctx, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
-	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
 
-	svc := New(db, pub, "wallets", "reservations", "http://gateway-queue")
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed && e.Reason == "insufficient funds"
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
 
-	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD")
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
 
 	assert.NoError(t, err)
-	db.AssertExpectations(t)
 	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestReserveFunds_ConcurrentReservation(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-456"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"version": &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{walletItem},
+	}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{})
+
+	svc := New(db, nil, nil, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.ErrorIs(t, err, ErrWalletConflict)
+	db.AssertNumberOfCalls(t, "TransactWriteItems", conflictAttempts)
+}
+
+func TestReserveFunds_RetriesVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	stale := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-456"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"version": &types.AttributeValueMemberN{Value: "1"},
+	}
+	fresh := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-456"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+		"version": &types.AttributeValueMemberN{Value: "2"},
+	}
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{stale},
+	}, nil).Once()
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{fresh},
+	}, nil).Once()
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{}).Once()
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		v := in.TransactItems[1].Update.ExpressionAttributeValues[":v"].(*types.AttributeValueMemberN)
+
+		return v.Value == "2"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
 }
 
 func TestReserveFunds_InsufficientFunds(t *testing.T) {
@@ -104,6 +344,9 @@ func TestReserveFunds_InsufficientFunds(t *testing.T) {
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
 	walletItem := map[string]types.AttributeValue{
 		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
 		"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
@@ -115,34 +358,167 @@ func TestReserveFunds_InsufficientFunds(t *testing.T) {
 		Items: []map[string]types.AttributeValue{walletItem},
 	}, nil)
 
-	svc := New(db, pub, "wallets", "reservations", "http://gateway-queue")
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed &&
+			e.Reason == "insufficient funds" &&
+			e.Amount.Equal(decimal.NewFromInt(100))
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+}
+
+func TestReserveFunds_NoWalletForCurrency(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	// The user only has a USD wallet, which the currency filter leaves out.
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return in.ExpressionAttributeValues[":currency"].(*types.AttributeValueMemberS).Value == "MXN"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{},
+	}, nil)
+
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed && e.Reason == "no wallet for currency"
+	})).Return(nil)
+	pub.On("Publish", ctx, "", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "mxn", "")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestReserveFunds_RedeliveryPublishesExistingReservation(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	id := reservationID("pay-789")
+	assert.Equal(t, id, reservationID("pay-789"))
+	assert.NotEqual(t, id, reservationID("pay-790"))
 
-	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD")
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return in.Key["id"].(*types.AttributeValueMemberS).Value == id
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: id},
+		"payment_id": &types.AttributeValueMemberS{Value: "pay-789"},
+		"wallet_id":  &types.AttributeValueMemberS{Value: "wallet-123"},
+		"amount":     &types.AttributeValueMemberN{Value: "100"},
+		"currency":   &types.AttributeValueMemberS{Value: "USD"},
+		"status":     &types.AttributeValueMemberS{Value: "active"},
+	}}, nil)
+
+	reserved := mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReserved && e.ReservationID == id
+	})
+	pub.On("Publish", ctx, "http://gateway-queue", reserved).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", reserved).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "insufficient funds")
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
 }
 
-func TestReserveFunds_WalletNotFound(t *testing.T) {
+func TestReserveFunds_OrchestratorPublishErrorIsReturned(t *testing.T) {
 	ctx := context.Background()
 	db := new(mockDB)
 	pub := new(mockPublisher)
 
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
 	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
-		Items: []map[string]types.AttributeValue{},
+		Items: []map[string]types.AttributeValue{{
+			"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
+			"balance":  &types.AttributeValueMemberN{Value: "500"},
+			"currency": &types.AttributeValueMemberS{Value: "USD"},
+			"version":  &types.AttributeValueMemberN{Value: "1"},
+		}},
 	}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(errors.New("queue unavailable"))
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.ErrorContains(t, err, "queue unavailable")
+}
+
+func TestReserveFunds_RejectsInvalidAmount(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed &&
+			strings.Contains(e.Reason, "too many decimal places")
+	})).Return(nil)
+	pub.On("Publish", ctx, "", mock.Anything).Return(nil)
 
-	svc := New(db, pub, "wallets", "reservations", "http://gateway-queue")
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
 
-	err := svc.ReserveFunds(ctx, "pay-789", "unknown-user", decimal.NewFromInt(100), "USD")
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.RequireFromString("10.12345"), "JPY", "")
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "wallet not found")
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "Query", mock.Anything, mock.Anything)
 }
 
 func TestConfirmDeduction_Success(t *testing.T) {
 	ctx := context.Background()
 	db := new(mockDB)
+	pub := new(mockPublisher)
 
 	resItem := map[string]types.AttributeValue{
 		"id":         &types.AttributeValueMemberS{Value: "res-123"},
@@ -159,13 +535,187 @@ func TestConfirmDeduction_Success(t *testing.T) {
 		"version": &types.AttributeValueMemberN{Value: "1"},
 	}
 
+	noWalletKey(ctx, db)
 	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: resItem}, nil).Once()
 	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
 		Items: []map[string]types.AttributeValue{walletItem},
 	}, nil)
-	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil).Twice()
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		reservation := in.TransactItems[0].Update
+		wallet := in.TransactItems[1].Update
+		debit := in.TransactItems[2].Put
+
+		return len(in.TransactItems) == 4 &&
+			*reservation.ConditionExpression == "#status = :active" &&
+			*wallet.ConditionExpression == "version = :v AND balance >= :amount AND held >= :held AND "+
+				"(attribute_not_exists(#status) OR #status <> :closed)" &&
+			*debit.TableName == "ledger" &&
+			debit.Item["id"].(*types.AttributeValueMemberS).Value == "deduction#res-123#0#debit" &&
+			debit.Item["account"].(*types.AttributeValueMemberS).Value == AccountHeld
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsDeducted &&
+			e.ReservationID == "res-123" &&
+			e.GatewayRef == "gw-ref-xyz" &&
+			e.Amount.Equal(decimal.NewFromInt(100))
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsDeducted
+	})).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		LedgerTable:          "ledger",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestConfirmDeduction_SettledConcurrently(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	resItem := map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "res-123"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":    &types.AttributeValueMemberS{Value: "100"},
+		"status":    &types.AttributeValueMemberS{Value: "active"},
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberN{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("ConditionalCheckFailed")},
+			{Code: aws.String("None")},
+			{Code: aws.String("None")},
+		},
+	})
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:      "wallets",
+		ReservationsTable: "reservations",
+		LedgerTable:       "ledger",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
+
+	assert.NoError(t, err)
+	pub.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestConfirmDeduction_InsufficientFundsIsNotRetried(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	resItem := map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "res-123"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":    &types.AttributeValueMemberS{Value: "100"},
+		"status":    &types.AttributeValueMemberS{Value: "active"},
+	}
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberN{Value: "50"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+		"version": &types.AttributeValueMemberN{Value: "3"},
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: walletItem}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		return in.TransactItems[1].Update.ReturnValuesOnConditionCheckFailure ==
+			types.ReturnValuesOnConditionCheckFailureAllOld
+	})).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed"), Item: walletItem},
+			{Code: aws.String("None")},
+		},
+	})
+
+	svc := New(db, nil, nil, Config{
+		WalletsTable:      "wallets",
+		ReservationsTable: "reservations",
+		LedgerTable:       "ledger",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
+
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	db.AssertNumberOfCalls(t, "TransactWriteItems", 1)
+}
+
+func TestConfirmDeduction_RetriesVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	resItem := map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "res-123"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":    &types.AttributeValueMemberS{Value: "100"},
+		"status":    &types.AttributeValueMemberS{Value: "active"},
+	}
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberN{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+		"version": &types.AttributeValueMemberN{Value: "3"},
+	}
+	moved := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberN{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "150"},
+		"version": &types.AttributeValueMemberN{Value: "4"},
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: walletItem}, nil).Once()
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: moved}, nil).Once()
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed"), Item: moved},
+			{Code: aws.String("None")},
+		},
+	}).Once()
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
 
-	svc := New(db, nil, "wallets", "reservations", "")
+	svc := New(db, pub, pub, Config{
+		WalletsTable:      "wallets",
+		ReservationsTable: "reservations",
+		LedgerTable:       "ledger",
+	})
 
 	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
 
@@ -176,19 +726,1535 @@ func TestConfirmDeduction_Success(t *testing.T) {
 func TestReleaseFunds_Success(t *testing.T) {
 	ctx := context.Background()
 	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	resItem := map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "res-123"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":    &types.AttributeValueMemberS{Value: "100"},
+		"status":    &types.AttributeValueMemberS{Value: "active"},
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":   &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"held": &types.AttributeValueMemberN{Value: "100"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[1].Update
+		amount := wallet.ExpressionAttributeValues[":amount"].(*types.AttributeValueMemberN)
+
+		return *in.TransactItems[0].Update.ConditionExpression == "#status = :active" &&
+			*wallet.ConditionExpression == "held >= :amount" &&
+			amount.Value == "100"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReleased &&
+			e.ReservationID == "res-123" &&
+			e.Reason == "payment cancelled"
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReleaseFunds(ctx, "res-123", "payment cancelled")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestReleaseFunds_SettledReservationIsLeftAlone(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
 
 	resItem := map[string]types.AttributeValue{
 		"id":     &types.AttributeValueMemberS{Value: "res-123"},
-		"status": &types.AttributeValueMemberS{Value: "active"},
+		"amount": &types.AttributeValueMemberS{Value: "100"},
+		"status": &types.AttributeValueMemberS{Value: "confirmed"},
 	}
 
 	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
-	db.On("UpdateItem", ctx, mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
 
-	svc := New(db, nil, "wallets", "reservations", "")
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", ReservationsTable: "reservations"})
 
-	err := svc.ReleaseFunds(ctx, "res-123", "payment cancelled")
+	err := svc.ReleaseFunds(ctx, "res-123", "voided")
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestConfirmDeduction_ConfirmedReservationIsReportedAgain(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":              &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id":      &types.AttributeValueMemberS{Value: "pay-456"},
+		"amount":          &types.AttributeValueMemberN{Value: "100"},
+		"status":          &types.AttributeValueMemberS{Value: "confirmed"},
+		"deducted_amount": &types.AttributeValueMemberN{Value: "60"},
+		"gateway_ref":     &types.AttributeValueMemberS{Value: "gw-ref-xyz"},
+	}}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsDeducted &&
+			e.GatewayRef == "gw-ref-xyz" &&
+			e.Amount.Equal(decimal.NewFromInt(60))
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestReleaseFunds_ReleasedReservationIsReportedAgain(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":             &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id":     &types.AttributeValueMemberS{Value: "pay-456"},
+		"amount":         &types.AttributeValueMemberN{Value: "100"},
+		"status":         &types.AttributeValueMemberS{Value: "released"},
+		"release_reason": &types.AttributeValueMemberS{Value: "gateway_rejected"},
+	}}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReleased && e.Reason == "gateway_rejected"
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReleaseFunds(ctx, "res-123", "gateway_rejected")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestCreditRefund_Success(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noWalletKey(ctx, db)
+
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-789"},
+		"balance": &types.AttributeValueMemberS{Value: "400"},
+		"version": &types.AttributeValueMemberN{Value: "3"},
+	}
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "payment_id-index"
+	})).Return(&dynamodb.QueryOutput{}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "user_id-index"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{walletItem},
+	}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[0].Update
+		balance := wallet.ExpressionAttributeValues[":balance"].(*types.AttributeValueMemberN)
+		version := wallet.ExpressionAttributeValues[":v"].(*types.AttributeValueMemberN)
+		credit := in.TransactItems[2].Put.Item
+
+		return balance.Value == "440" && version.Value == "3" &&
+			credit["id"].(*types.AttributeValueMemberS).Value == "refund#ref-1#0#credit" &&
+			credit["account"].(*types.AttributeValueMemberS).Value == AccountAvailable
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.CreditRefund(ctx, "pay-456", "user-789", "ref-1", decimal.NewFromInt(40), "USD")
 
 	assert.NoError(t, err)
 	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.FundsRefunded, event.Type)
+	assert.Equal(t, "ref-1", event.RefundID)
+}
+
+func TestConfirmDeduction_ManualCaptureKeepsHold(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	resItem := map[string]types.AttributeValue{
+		"id":           &types.AttributeValueMemberS{Value: "res-123"},
+		"user_id":      &types.AttributeValueMemberS{Value: "user-789"},
+		"amount":       &types.AttributeValueMemberS{Value: "100"},
+		"status":       &types.AttributeValueMemberS{Value: "active"},
+		"capture_mode": &types.AttributeValueMemberS{Value: events.CaptureManual},
+	}
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", ReservationsTable: "reservations"})
+
+	err := svc.ConfirmDeduction(ctx, "pay-456", "res-123", "gw-ref-xyz")
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "UpdateItem", mock.Anything, mock.Anything)
+}
+
+func TestCaptureFunds_PartialAmount(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	resItem := map[string]types.AttributeValue{
+		"id":           &types.AttributeValueMemberS{Value: "res-123"},
+		"user_id":      &types.AttributeValueMemberS{Value: "user-789"},
+		"amount":       &types.AttributeValueMemberS{Value: "100"},
+		"status":       &types.AttributeValueMemberS{Value: "active"},
+		"capture_mode": &types.AttributeValueMemberS{Value: events.CaptureManual},
+	}
+
+	walletItem := map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"user_id": &types.AttributeValueMemberS{Value: "user-789"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"version": &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	noWalletKey(ctx, db)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{walletItem},
+	}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		values := in.TransactItems[1].Update.ExpressionAttributeValues
+		amount := values[":amount"].(*types.AttributeValueMemberN)
+		held := values[":held"].(*types.AttributeValueMemberN)
+
+		return amount.Value == "60" && held.Value == "100" && len(in.TransactItems) == 6
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{WalletsTable: "wallets", WalletKeysTable: "wallet-keys", ReservationsTable: "reservations"})
+
+	err := svc.CaptureFunds(ctx, "pay-456", "res-123", decimal.NewFromInt(60))
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+}
+
+func TestCaptureFunds_ExceedsReservation(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	resItem := map[string]types.AttributeValue{
+		"id":     &types.AttributeValueMemberS{Value: "res-123"},
+		"amount": &types.AttributeValueMemberS{Value: "100"},
+		"status": &types.AttributeValueMemberS{Value: "active"},
+	}
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", ReservationsTable: "reservations"})
+
+	err := svc.CaptureFunds(ctx, "pay-456", "res-123", decimal.NewFromInt(101))
+
+	assert.ErrorIs(t, err, ErrCaptureExceedsReservation)
+}
+
+func TestReleasePaymentFunds_ReleasesActiveReservations(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{
+			{
+				"id":        &types.AttributeValueMemberS{Value: "res-1"},
+				"wallet_id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+				"amount":    &types.AttributeValueMemberS{Value: "100"},
+				"status":    &types.AttributeValueMemberS{Value: "active"},
+			},
+			{
+				"id":     &types.AttributeValueMemberS{Value: "res-2"},
+				"status": &types.AttributeValueMemberS{Value: "released"},
+			},
+		},
+	}, nil)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: "wallet-abc"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		return in.TransactItems[0].Update.Key["id"].(*types.AttributeValueMemberS).Value == "res-1"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+
+	pub.On("Publish", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{WalletsTable: "wallets", ReservationsTable: "reservations"})
+
+	err := svc.ReleasePaymentFunds(ctx, "pay-456", "cancelled")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	db.AssertNumberOfCalls(t, "TransactWriteItems", 1)
+}
+
+func TestReleasePaymentFunds_PaysBackConfirmedReservation(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":              &types.AttributeValueMemberS{Value: "res-1"},
+			"payment_id":      &types.AttributeValueMemberS{Value: "pay-456"},
+			"wallet_id":       &types.AttributeValueMemberS{Value: "wallet-abc"},
+			"amount":          &types.AttributeValueMemberN{Value: "100"},
+			"currency":        &types.AttributeValueMemberS{Value: "USD"},
+			"status":          &types.AttributeValueMemberS{Value: "confirmed"},
+			"deducted_amount": &types.AttributeValueMemberN{Value: "100"},
+		}},
+	}, nil)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance":  &types.AttributeValueMemberN{Value: "400"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[0].Update
+		credit := in.TransactItems[2].Put
+
+		return *wallet.TableName == "wallets" &&
+			wallet.ExpressionAttributeValues[":balance"].(*types.AttributeValueMemberN).Value == "500" &&
+			credit.Item["id"].(*types.AttributeValueMemberS).Value == "refund#res-1#0#credit"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+	pub.On("Publish", ctx, "payment-events", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsRefunded && e.RefundID == "res-1" && e.Reason == "cancelled"
+	})).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:      "wallets",
+		ReservationsTable: "reservations",
+		LedgerTable:       "ledger",
+		EventBusName:      "payment-events",
+	})
+
+	err := svc.ReleasePaymentFunds(ctx, "pay-456", "cancelled")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestExpireReservations_ReleasesAndPublishes(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	expired := map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id": &types.AttributeValueMemberS{Value: "pay-123"},
+		"wallet_id":  &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":     &types.AttributeValueMemberS{Value: "100"},
+		"status":     &types.AttributeValueMemberS{Value: "active"},
+		"expires_at": &types.AttributeValueMemberS{Value: "2020-01-01T00:00:00Z"},
+	}
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "status-index" && *in.Limit == 10
+	})).Return(&dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{expired}}, nil)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":   &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"held": &types.AttributeValueMemberN{Value: "100"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReleased && e.Reason == ReasonExpired && e.ReservationID == "res-123"
+	})).Return(nil)
+	pub.On("Publish", ctx, "", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	released, err := svc.ExpireReservations(ctx, 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, released)
+	pub.AssertExpectations(t)
+}
+
+func TestConfirmDeduction_ExpiredReservationIsDeducted(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	resItem := map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id": &types.AttributeValueMemberS{Value: "pay-123"},
+		"wallet_id":  &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":     &types.AttributeValueMemberS{Value: "100"},
+		"status":     &types.AttributeValueMemberS{Value: "active"},
+		"expires_at": &types.AttributeValueMemberS{Value: "2020-01-01T00:00:00Z"},
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: resItem}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberN{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		confirmed := in.TransactItems[0].Update.ExpressionAttributeValues[":confirmed"]
+
+		return confirmed != nil
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsDeducted && e.GatewayRef == "gw-1"
+	})).Return(nil)
+	pub.On("Publish", ctx, "", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-123", "res-123", "gw-1")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+}
+
+func TestConfirmDeduction_ReleasedOnExpiryIsReversed(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":             &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id":     &types.AttributeValueMemberS{Value: "pay-123"},
+		"user_id":        &types.AttributeValueMemberS{Value: "user-456"},
+		"wallet_id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":         &types.AttributeValueMemberN{Value: "100"},
+		"currency":       &types.AttributeValueMemberS{Value: "USD"},
+		"status":         &types.AttributeValueMemberS{Value: "released"},
+		"release_reason": &types.AttributeValueMemberS{Value: ReasonExpired},
+	}}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.ReversalRequested &&
+			e.PaymentID == "pay-123" &&
+			e.GatewayRef == "gw-1" &&
+			e.Reason == ReasonExpired &&
+			e.Amount.Equal(decimal.NewFromInt(100)) && e.Currency == "USD"
+	})).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-123", "res-123", "gw-1")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestVerifyWallet(t *testing.T) {
+	ctx := context.Background()
+
+	funding := newMovement(EntryTopUp, "dep-1", "wallet-abc", "USD")
+	reserve := newMovement(EntryReserve, "res-123", "wallet-abc", "USD")
+	refund := newMovement(EntryRefund, "ref-1", "wallet-abc", "USD")
+
+	var entries []LedgerEntry
+	entries = append(entries, transfer(funding, 0, AccountFunding, AccountAvailable, decimal.NewFromInt(400))...)
+	entries = append(entries, transfer(reserve, 0, AccountAvailable, AccountHeld, decimal.NewFromInt(100))...)
+	entries = append(entries, transfer(refund, 0, AccountSettlement, AccountAvailable, decimal.NewFromInt(40))...)
+
+	items := make([]map[string]types.AttributeValue, 0, len(entries))
+	for i := range entries {
+		item, _ := attributevalue.MarshalMap(&entries[i])
+		items = append(items, item)
+	}
+
+	tests := []struct {
+		name    string
+		balance string
+		drifted bool
+	}{
+		{"matches ledger", "440", false},
+		{"balance drifted", "500", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := new(mockDB)
+
+			db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+				"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+				"balance": &types.AttributeValueMemberS{Value: tt.balance},
+				"held":    &types.AttributeValueMemberN{Value: "100"},
+			}}, nil)
+			db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+				return *in.TableName == "ledger" && *in.IndexName == "wallet_id-index"
+			})).Return(&dynamodb.QueryOutput{Items: items}, nil)
+
+			svc := New(db, nil, nil, Config{WalletsTable: "wallets", LedgerTable: "ledger"})
+
+			check, err := svc.VerifyWallet(ctx, "wallet-abc")
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.drifted, check.Drifted())
+			assert.True(t, check.LedgerBalance.Equal(decimal.NewFromInt(440)))
+			assert.True(t, check.LedgerHeld.Equal(decimal.NewFromInt(100)))
+			assert.Empty(t, check.Unbalanced)
+		})
+	}
+}
+
+func TestOpenLedgers_OpensWalletsOlderThanTheLedger(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	wallet := func(id, balance, held string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: id},
+			"balance":    &types.AttributeValueMemberN{Value: balance},
+			"held":       &types.AttributeValueMemberN{Value: held},
+			"currency":   &types.AttributeValueMemberS{Value: "USD"},
+			"version":    &types.AttributeValueMemberN{Value: "3"},
+			"created_at": &types.AttributeValueMemberS{Value: "2025-06-01T00:00:00Z"},
+		}
+	}
+	entries := func(movements ...[]LedgerEntry) []map[string]types.AttributeValue {
+		var items []map[string]types.AttributeValue
+
+		for _, m := range movements {
+			for i := range m {
+				item, _ := attributevalue.MarshalMap(&m[i])
+				items = append(items, item)
+			}
+		}
+
+		return items
+	}
+	walletIs := func(id string) any {
+		return mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+			return in.ExpressionAttributeValues[":wid"].(*types.AttributeValueMemberS).Value == id
+		})
+	}
+
+	// A legacy wallet with no entries, one deposited into after the ledger
+	// existed, and one already opened.
+	deposit := transfer(newMovement(EntryTopUp, "dep-1", "wallet-new", "USD"), 0,
+		AccountFunding, AccountAvailable, decimal.NewFromInt(50))
+	opened := transfer(newMovement(EntryOpening, "wallet-done", "wallet-done", "USD"), 0,
+		AccountFunding, AccountAvailable, decimal.NewFromInt(10))
+
+	db.On("Scan", ctx, mock.Anything).Return(&dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{
+		wallet("wallet-old", "500", "100"),
+		wallet("wallet-new", "80", "0"),
+		wallet("wallet-done", "10", "0"),
+	}}, nil)
+	db.On("Query", ctx, walletIs("wallet-old")).Return(&dynamodb.QueryOutput{}, nil)
+	db.On("Query", ctx, walletIs("wallet-new")).Return(&dynamodb.QueryOutput{Items: entries(deposit)}, nil)
+	db.On("Query", ctx, walletIs("wallet-done")).Return(&dynamodb.QueryOutput{Items: entries(opened)}, nil)
+
+	var written []LedgerEntry
+
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		check := in.TransactItems[0].ConditionCheck
+
+		return check != nil && *check.TableName == "wallets" &&
+			check.ExpressionAttributeValues[":v"].(*types.AttributeValueMemberN).Value == "3"
+	})).Run(func(args mock.Arguments) {
+		for _, item := range args.Get(1).(*dynamodb.TransactWriteItemsInput).TransactItems[1:] {
+			var e LedgerEntry
+			_ = attributevalue.UnmarshalMap(item.Put.Item, &e)
+			written = append(written, e)
+		}
+	}).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", LedgerTable: "ledger"})
+
+	report, err := svc.OpenLedgers(ctx, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, 2, report.Opened)
+	db.AssertNumberOfCalls(t, "TransactWriteItems", 2)
+
+	balances := map[string]*BalanceCheck{}
+
+	for _, id := range []string{"wallet-old", "wallet-new"} {
+		var own []LedgerEntry
+
+		for _, e := range written {
+			if e.WalletID == id {
+				assert.Equal(t, "opening#"+id, e.MovementID)
+				assert.Equal(t, "2025-06-01T00:00:00Z", e.CreatedAt.Format(time.RFC3339))
+				own = append(own, e)
+			}
+		}
+
+		if id == "wallet-new" {
+			own = append(own, deposit...)
+		}
+
+		w := &Wallet{ID: id}
+		balances[id] = reconcile(w, own)
+	}
+
+	assert.True(t, balances["wallet-old"].LedgerBalance.Equal(decimal.NewFromInt(500)))
+	assert.True(t, balances["wallet-old"].LedgerHeld.Equal(decimal.NewFromInt(100)))
+	assert.True(t, balances["wallet-new"].LedgerBalance.Equal(decimal.NewFromInt(80)))
+	assert.Empty(t, balances["wallet-old"].Unbalanced)
+}
+
+func TestCreateWallet_Success(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[0].Put
+		key := in.TransactItems[1].Put
+
+		return *wallet.TableName == "wallets" &&
+			*wallet.ConditionExpression == "attribute_not_exists(id)" &&
+			wallet.Item["currency"].(*types.AttributeValueMemberS).Value == "USD" &&
+			wallet.Item["balance"].(*types.AttributeValueMemberN).Value == "0" &&
+			*key.TableName == "wallet-keys" &&
+			*key.ConditionExpression == "attribute_not_exists(id)" &&
+			key.Item["id"].(*types.AttributeValueMemberS).Value == "user-789#USD" &&
+			key.Item["wallet_id"].(*types.AttributeValueMemberS).Value ==
+				wallet.Item["id"].(*types.AttributeValueMemberS).Value
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", WalletKeysTable: "wallet-keys"})
+
+	wallet, err := svc.CreateWallet(ctx, "user-789", "usd")
+
+	assert.NoError(t, err)
+	assert.NotEmpty(t, wallet.ID)
+	assert.Equal(t, "USD", wallet.Currency)
+	assert.Equal(t, 1, wallet.Version)
+	db.AssertExpectations(t)
+}
+
+func TestCreateWallet_ConcurrentCreateLoses(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+		CancellationReasons: []types.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		},
+	})
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", WalletKeysTable: "wallet-keys"})
+
+	_, err := svc.CreateWallet(ctx, "user-789", "USD")
+
+	assert.ErrorIs(t, err, ErrWalletExists)
+}
+
+func TestCreateWallet_UserHasWallet(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+			"user_id": &types.AttributeValueMemberS{Value: "user-789"},
+		}},
+	}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", WalletKeysTable: "wallet-keys"})
+
+	_, err := svc.CreateWallet(ctx, "user-789", "USD")
+
+	assert.ErrorIs(t, err, ErrWalletExists)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestDepositFunds_Success(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-789"},
+		"balance":  &types.AttributeValueMemberS{Value: "100"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "2"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[0].Update
+		balance := wallet.ExpressionAttributeValues[":balance"].(*types.AttributeValueMemberN)
+		debit := in.TransactItems[1].Put.Item
+		credit := in.TransactItems[2].Put.Item
+
+		return balance.Value == "125.5" &&
+			debit["account"].(*types.AttributeValueMemberS).Value == AccountFunding &&
+			credit["id"].(*types.AttributeValueMemberS).Value == "top_up#wallet-abc:dep-1#0#credit" &&
+			credit["account"].(*types.AttributeValueMemberS).Value == AccountAvailable
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, nil, bus, Config{
+		WalletsTable: "wallets",
+		LedgerTable:  "ledger",
+		EventBusName: "payment-events",
+	})
+
+	deposit, err := svc.DepositFunds(ctx, "wallet-abc", "dep-1", decimal.RequireFromString("25.50"), "USD")
+
+	assert.NoError(t, err)
+	assert.False(t, deposit.Replayed)
+	assert.Equal(t, "125.5", deposit.Wallet.Balance.String())
+	db.AssertExpectations(t)
+	bus.AssertExpectations(t)
+
+	event := bus.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.FundsDeposited, event.Type)
+	assert.Equal(t, "wallet-abc", event.WalletID)
+	assert.Equal(t, "dep-1", event.DepositID)
+}
+
+func TestDepositFunds_Duplicate(t *testing.T) {
+	ctx := context.Background()
+
+	walletItem := map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-789"},
+		"balance":  &types.AttributeValueMemberS{Value: "125.5"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+	}
+	movement := newMovement(EntryTopUp, "wallet-abc:dep-1", "wallet-abc", "USD")
+	credit, _ := attributevalue.MarshalMap(
+		&transfer(movement, 0, AccountFunding, AccountAvailable, decimal.RequireFromString("25.50"))[1],
+	)
+
+	tests := []struct {
+		name     string
+		amount   string
+		replayed bool
+		err      error
+	}{
+		{"same amount replays", "25.5", true, nil},
+		{"different amount is rejected", "30", false, ErrDepositKeyReused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := new(mockDB)
+
+			db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+				return *in.TableName == "wallets"
+			})).Return(&dynamodb.GetItemOutput{Item: walletItem}, nil)
+			db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+				return *in.TableName == "ledger"
+			})).Return(&dynamodb.GetItemOutput{Item: credit}, nil)
+			db.On("TransactWriteItems", ctx, mock.Anything).Return(nil, &types.TransactionCanceledException{
+				CancellationReasons: []types.CancellationReason{
+					{Code: aws.String("None")},
+					{Code: aws.String("ConditionalCheckFailed")},
+					{Code: aws.String("ConditionalCheckFailed")},
+				},
+			})
+
+			svc := New(db, nil, nil, Config{WalletsTable: "wallets", LedgerTable: "ledger"})
+
+			deposit, err := svc.DepositFunds(ctx, "wallet-abc", "dep-1", decimal.RequireFromString(tt.amount), "USD")
+
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.replayed, deposit.Replayed)
+			db.AssertNumberOfCalls(t, "TransactWriteItems", 1)
+		})
+	}
+}
+
+func TestReserveFunds_ConvertsToWalletCurrency(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	rates, _ := fx.NewStatic(map[string]decimal.Decimal{
+		"EUR/USD": decimal.RequireFromString("1.25"),
+	}, time.Minute)
+
+	// No EUR wallet: the currency filter finds nothing, the listing finds USD.
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return in.FilterExpression != nil
+	})).Return(&dynamodb.QueryOutput{}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return in.FilterExpression == nil
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":       &types.AttributeValueMemberS{Value: "wallet-usd"},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
+			"balance":  &types.AttributeValueMemberS{Value: "200"},
+			"currency": &types.AttributeValueMemberS{Value: "USD"},
+			"version":  &types.AttributeValueMemberN{Value: "1"},
+		}},
+	}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		var r Reservation
+		_ = attributevalue.UnmarshalMap(in.TransactItems[0].Put.Item, &r)
+		held := in.TransactItems[1].Update.ExpressionAttributeValues[":amount"].(*types.AttributeValueMemberN)
+		_, stored := in.TransactItems[0].Put.Item["payment_amount"].(*types.AttributeValueMemberN)
+
+		return r.WalletID == "wallet-usd" && stored &&
+			r.Amount.Equal(decimal.NewFromInt(100)) && r.Currency == "USD" &&
+			r.PaymentAmount.Equal(decimal.NewFromInt(80)) && r.PaymentCurrency == "EUR" &&
+			r.FXRate == "1.25" && r.QuoteExpiresAt != nil &&
+			!r.ExpiresAt.After(*r.QuoteExpiresAt) &&
+			held.Value == "100"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://gateway-queue", mock.Anything).Return(nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		FX:                   rates,
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		GatewayQueueURL:      "http://gateway-queue",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(80), "EUR", "")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.FundsReserved, event.Type)
+	assert.True(t, event.Amount.Equal(decimal.NewFromInt(80)))
+	assert.Equal(t, "EUR", event.Currency)
+	assert.True(t, event.SettledAmount.Equal(decimal.NewFromInt(100)))
+	assert.Equal(t, "USD", event.SettledCurrency)
+}
+
+func TestLockQuote_OnlyAutomaticCaptureExpiresWithQuote(t *testing.T) {
+	now := time.Now().UTC()
+	quote := &fx.Quote{
+		From:      "EUR",
+		To:        "USD",
+		Rate:      decimal.RequireFromString("1.25"),
+		ExpiresAt: now.Add(15 * time.Minute),
+	}
+
+	tests := []struct {
+		name        string
+		captureMode string
+		ttl         time.Duration
+		expiresAt   time.Time
+	}{
+		{"automatic", events.CaptureAutomatic, reservationTTL + time.Minute, expiryTime(quote.ExpiresAt)},
+		{"manual", events.CaptureManual, authorizationTTL, now.Add(authorizationTTL)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Reservation{
+				Amount:      money.New(decimal.NewFromInt(80)),
+				Currency:    "EUR",
+				CaptureMode: tt.captureMode,
+				ExpiresAt:   now.Add(tt.ttl),
+			}
+
+			r.lockQuote(quote)
+
+			assert.Equal(t, tt.expiresAt, r.ExpiresAt)
+			assert.Equal(t, quote.ExpiresAt, *r.QuoteExpiresAt)
+		})
+	}
+}
+
+func TestCreditRefund_SettlesAtLockedRate(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "payment_id-index"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":               &types.AttributeValueMemberS{Value: "res-123"},
+			"payment_id":       &types.AttributeValueMemberS{Value: "pay-456"},
+			"wallet_id":        &types.AttributeValueMemberS{Value: "wallet-usd"},
+			"amount":           &types.AttributeValueMemberS{Value: "100"},
+			"currency":         &types.AttributeValueMemberS{Value: "USD"},
+			"payment_amount":   &types.AttributeValueMemberS{Value: "80"},
+			"payment_currency": &types.AttributeValueMemberS{Value: "EUR"},
+			"fx_rate":          &types.AttributeValueMemberS{Value: "1.25"},
+			"status":           &types.AttributeValueMemberS{Value: "confirmed"},
+		}},
+	}, nil)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-usd"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-789"},
+		"balance":  &types.AttributeValueMemberS{Value: "400"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		balance := in.TransactItems[0].Update.ExpressionAttributeValues[":balance"].(*types.AttributeValueMemberN)
+		credit := in.TransactItems[2].Put.Item
+
+		return balance.Value == "450" &&
+			credit["currency"].(*types.AttributeValueMemberS).Value == "USD"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.CreditRefund(ctx, "pay-456", "user-789", "ref-1", decimal.NewFromInt(40), "EUR")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+
+	event := pub.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, "EUR", event.Currency)
+	assert.True(t, event.SettledAmount.Equal(decimal.NewFromInt(50)))
+	assert.Equal(t, "USD", event.SettledCurrency)
+}
+
+func TestCreditRefund_PartialRefundsDoNotExceedTheDeduction(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "payment_id-index"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":               &types.AttributeValueMemberS{Value: "res-123"},
+			"payment_id":       &types.AttributeValueMemberS{Value: "pay-456"},
+			"wallet_id":        &types.AttributeValueMemberS{Value: "wallet-usd"},
+			"amount":           &types.AttributeValueMemberN{Value: "108.42"},
+			"currency":         &types.AttributeValueMemberS{Value: "USD"},
+			"payment_amount":   &types.AttributeValueMemberN{Value: "100"},
+			"payment_currency": &types.AttributeValueMemberS{Value: "EUR"},
+			"fx_rate":          &types.AttributeValueMemberS{Value: "1.0842"},
+			"status":           &types.AttributeValueMemberS{Value: "confirmed"},
+		}},
+	}, nil)
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-usd"},
+		"balance":  &types.AttributeValueMemberN{Value: "0"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	// At the locked rate each third settles to 36.13..., rounded up 36.14.
+	refunds := []string{"33.33", "33.33", "33.34"}
+	credited := decimal.Zero
+
+	for i, amount := range refunds {
+		err := svc.CreditRefund(ctx, "pay-456", "user-789", "ref-"+amount, decimal.RequireFromString(amount), "EUR")
+		assert.NoError(t, err)
+
+		credited = credited.Add(*pub.Calls[i].Arguments[2].(*events.Event).SettledAmount)
+	}
+
+	assert.True(t, credited.Equal(decimal.RequireFromString("108.40")), credited.String())
+	assert.True(t, credited.LessThanOrEqual(decimal.RequireFromString("108.42")))
+
+	err := svc.CreditRefund(ctx, "pay-456", "user-789", "ref-full", decimal.NewFromInt(100), "EUR")
+
+	assert.NoError(t, err)
+	assert.True(t, pub.Calls[3].Arguments[2].(*events.Event).SettledAmount.Equal(decimal.RequireFromString("108.42")))
+}
+
+func transferWallets(ctx context.Context, db *mockDB, fromBalance string) {
+	wallets := map[string]map[string]types.AttributeValue{
+		"wallet-a": {
+			"id":       &types.AttributeValueMemberS{Value: "wallet-a"},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-a"},
+			"balance":  &types.AttributeValueMemberS{Value: fromBalance},
+			"currency": &types.AttributeValueMemberS{Value: "USD"},
+			"version":  &types.AttributeValueMemberN{Value: "4"},
+		},
+		"wallet-b": {
+			"id":       &types.AttributeValueMemberS{Value: "wallet-b"},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-b"},
+			"balance":  &types.AttributeValueMemberS{Value: "10"},
+			"currency": &types.AttributeValueMemberS{Value: "USD"},
+			"version":  &types.AttributeValueMemberN{Value: "7"},
+		},
+	}
+
+	for id, item := range wallets {
+		db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return in.Key["id"].(*types.AttributeValueMemberS).Value == id
+		})).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+	}
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "ledger"
+	})).Return(&dynamodb.GetItemOutput{}, nil)
+}
+
+func TestTransferFunds_Success(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	transferWallets(ctx, db, "100")
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		from := in.TransactItems[0].Update.ExpressionAttributeValues
+		to := in.TransactItems[1].Update.ExpressionAttributeValues
+
+		var entries []LedgerEntry
+		for _, item := range in.TransactItems[2:] {
+			var e LedgerEntry
+			_ = attributevalue.UnmarshalMap(item.Put.Item, &e)
+			entries = append(entries, e)
+		}
+
+		// Each wallet's entries balance on their own.
+		return from[":balance"].(*types.AttributeValueMemberN).Value == "70" &&
+			from[":v"].(*types.AttributeValueMemberN).Value == "4" &&
+			to[":balance"].(*types.AttributeValueMemberN).Value == "40" &&
+			to[":v"].(*types.AttributeValueMemberN).Value == "7" &&
+			len(entries) == 4 &&
+			!reconcile(&Wallet{ID: "wallet-a", Balance: money.New(decimal.NewFromInt(-30))}, entries[:2]).Drifted() &&
+			!reconcile(&Wallet{ID: "wallet-b", Balance: money.New(decimal.NewFromInt(30))}, entries[2:]).Drifted()
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, nil, bus, Config{WalletsTable: "wallets", LedgerTable: "ledger", EventBusName: "payment-events"})
+
+	transfer, err := svc.TransferFunds(ctx, "tr-1", "wallet-a", "wallet-b", decimal.NewFromInt(30), "USD")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "70", transfer.From.Balance.String())
+	db.AssertExpectations(t)
+
+	event := bus.Calls[0].Arguments[2].(*events.Event)
+	assert.Equal(t, events.TransferCompleted, event.Type)
+	assert.Equal(t, "tr-1", event.TransferID)
+	assert.Equal(t, "wallet-a", event.WalletID)
+	assert.Equal(t, "wallet-b", event.ToWalletID)
+}
+
+func TestTransferFunds_InsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	transferWallets(ctx, db, "20")
+	bus.On("Publish", ctx, "payment-events", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.TransferFailed && e.Reason == "insufficient funds"
+	})).Return(nil)
+
+	svc := New(db, nil, bus, Config{WalletsTable: "wallets", LedgerTable: "ledger", EventBusName: "payment-events"})
+
+	_, err := svc.TransferFunds(ctx, "tr-1", "wallet-a", "wallet-b", decimal.NewFromInt(30), "USD")
+
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+	bus.AssertExpectations(t)
+}
+
+func TestTransferFunds_ReplayIgnoresLaterState(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "ledger" &&
+			in.Key["id"].(*types.AttributeValueMemberS).Value == "transfer#wallet-a:tr-1#1#credit"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: "transfer#wallet-a:tr-1#1#credit"},
+		"wallet_id": &types.AttributeValueMemberS{Value: "wallet-b"},
+		"amount":    &types.AttributeValueMemberN{Value: "30"},
+		"currency":  &types.AttributeValueMemberS{Value: "USD"},
+	}}, nil)
+	// The transfer left too little in wallet-a to apply it again.
+	transferWallets(ctx, db, "20")
+
+	svc := New(db, nil, bus, Config{WalletsTable: "wallets", LedgerTable: "ledger", EventBusName: "payment-events"})
+
+	transfer, err := svc.TransferFunds(ctx, "tr-1", "wallet-a", "wallet-b", decimal.NewFromInt(30), "USD")
+
+	assert.NoError(t, err)
+	assert.True(t, transfer.Replayed)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+	bus.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestReserveFunds_DailyLimitExceeded(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	walletItem := map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
+		"balance":  &types.AttributeValueMemberS{Value: "500"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	recent := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	spent := func(amount, status string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: "res-" + status},
+			"wallet_id":  &types.AttributeValueMemberS{Value: "wallet-123"},
+			"amount":     &types.AttributeValueMemberS{Value: amount},
+			"status":     &types.AttributeValueMemberS{Value: status},
+			"created_at": &types.AttributeValueMemberS{Value: recent},
+		}
+	}
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "user_id-index"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{walletItem},
+	}, nil)
+	// Released reservations do not count towards the limit.
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.IndexName == "wallet_id-index" &&
+			in.ExpressionAttributeValues[":wid"].(*types.AttributeValueMemberS).Value == "wallet-123"
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{
+			spent("150", "confirmed"),
+			spent("50", "active"),
+			spent("400", "released"),
+		},
+	}, nil)
+
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed && e.Reason == ReasonLimitExceeded
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	daily := money.New(decimal.NewFromInt(250))
+	svc := New(db, pub, pub, Config{
+		DefaultLimits:        map[string]Limits{"USD": {Daily: &daily}},
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	db.AssertExpectations(t)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestLimits_PartialCaptureCountsWhatWasDeducted(t *testing.T) {
+	captured := money.New(decimal.NewFromInt(60))
+	paid := money.New(decimal.NewFromInt(80))
+
+	tests := []struct {
+		name        string
+		reservation Reservation
+		spent       string
+	}{
+		{"active", Reservation{Status: "active", Amount: money.New(decimal.NewFromInt(100))}, "100"},
+		{"captured in part", Reservation{
+			Status:         "confirmed",
+			Amount:         money.New(decimal.NewFromInt(100)),
+			DeductedAmount: &captured,
+		}, "60"},
+		{"captured in part at a locked rate", Reservation{
+			Status:          "confirmed",
+			Amount:          money.New(decimal.NewFromInt(100)),
+			Currency:        "USD",
+			PaymentAmount:   &paid,
+			PaymentCurrency: "EUR",
+			FXRate:          "1.25",
+			DeductedAmount:  &captured,
+		}, "75"},
+		{"confirmed before deductions were kept", Reservation{
+			Status: "confirmed",
+			Amount: money.New(decimal.NewFromInt(100)),
+		}, "100"},
+		{"released", Reservation{Status: "released", Amount: money.New(decimal.NewFromInt(100))}, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.spent, tt.reservation.spent().String())
+		})
+	}
+}
+
+func TestLimits_WalletOverridesCurrencyDefault(t *testing.T) {
+	perTransaction := money.New(decimal.NewFromInt(50))
+	weekly := money.New(decimal.NewFromInt(1000))
+	own := money.New(decimal.NewFromInt(200))
+
+	svc := New(nil, nil, nil, Config{
+		DefaultLimits: map[string]Limits{"USD": {PerTransaction: &perTransaction, Weekly: &weekly}},
+	})
+
+	limits := svc.Limits(&Wallet{Currency: "USD", Limits: &Limits{PerTransaction: &own}})
+
+	assert.True(t, limits.PerTransaction.Equal(own.Decimal))
+	assert.True(t, limits.Weekly.Equal(weekly.Decimal))
+	assert.Nil(t, limits.Daily)
+	assert.Nil(t, svc.Limits(&Wallet{Currency: "EUR"}).PerTransaction)
+}
+
+func TestSetWalletStatus_FreezeIsAudited(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	bus := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+		"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
+		"balance":  &types.AttributeValueMemberS{Value: "500"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[0].Update
+		audit := in.TransactItems[1].Put
+
+		return wallet.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value == WalletFrozen &&
+			wallet.ExpressionAttributeValues[":v"].(*types.AttributeValueMemberN).Value == "3" &&
+			*audit.TableName == "wallet-audit" &&
+			audit.Item["from_status"].(*types.AttributeValueMemberS).Value == WalletActive &&
+			audit.Item["to_status"].(*types.AttributeValueMemberS).Value == WalletFrozen &&
+			audit.Item["changed_by"].(*types.AttributeValueMemberS).Value == "ops@example.com"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	bus.On("Publish", ctx, "payment-events", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.WalletStatusChanged &&
+			e.FromStatus == WalletActive &&
+			e.ToStatus == WalletFrozen &&
+			e.Reason == "chargeback fraud"
+	})).Return(nil)
+
+	svc := New(db, nil, bus, Config{WalletsTable: "wallets", AuditTable: "wallet-audit", EventBusName: "payment-events"})
+
+	wallet, err := svc.SetWalletStatus(ctx, "wallet-123", WalletFrozen, "chargeback fraud", "ops@example.com")
+
+	assert.NoError(t, err)
+	assert.Equal(t, WalletFrozen, wallet.State())
+	assert.Equal(t, 4, wallet.Version)
+	db.AssertExpectations(t)
+	bus.AssertExpectations(t)
+}
+
+func TestSetWalletStatus_CloseRequiresEmptyWallet(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-123"},
+		"balance": &types.AttributeValueMemberS{Value: "0"},
+		"held":    &types.AttributeValueMemberN{Value: "20"},
+		"status":  &types.AttributeValueMemberS{Value: WalletFrozen},
+		"version": &types.AttributeValueMemberN{Value: "3"},
+	}}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", AuditTable: "wallet-audit"})
+
+	_, err := svc.SetWalletStatus(ctx, "wallet-123", WalletClosed, "user request", "ops@example.com")
+
+	assert.ErrorIs(t, err, ErrWalletNotEmpty)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestReserveFunds_FrozenWallet(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	noReservation(ctx, db)
+	noWalletKey(ctx, db)
+
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{{
+			"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+			"user_id":  &types.AttributeValueMemberS{Value: "user-456"},
+			"balance":  &types.AttributeValueMemberS{Value: "500"},
+			"currency": &types.AttributeValueMemberS{Value: "USD"},
+			"status":   &types.AttributeValueMemberS{Value: WalletFrozen},
+		}},
+	}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsReservationFailed && e.Reason == "wallet is frozen"
+	})).Return(nil)
+	pub.On("Publish", ctx, "payment-events", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		WalletKeysTable:      "wallet-keys",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+		EventBusName:         "payment-events",
+	})
+
+	err := svc.ReserveFunds(ctx, "pay-789", "user-456", decimal.NewFromInt(100), "USD", "")
+
+	assert.NoError(t, err)
+	pub.AssertExpectations(t)
+	db.AssertNotCalled(t, "TransactWriteItems", mock.Anything, mock.Anything)
+}
+
+func TestConfirmDeduction_FrozenWalletIsDeducted(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	pub := new(mockPublisher)
+
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: "res-123"},
+		"payment_id": &types.AttributeValueMemberS{Value: "pay-123"},
+		"wallet_id":  &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"amount":     &types.AttributeValueMemberS{Value: "100"},
+		"status":     &types.AttributeValueMemberS{Value: "active"},
+	}}, nil)
+	db.On("GetItem", ctx, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return *in.TableName == "wallets"
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":      &types.AttributeValueMemberS{Value: "wallet-abc"},
+		"balance": &types.AttributeValueMemberS{Value: "500"},
+		"held":    &types.AttributeValueMemberN{Value: "100"},
+		"status":  &types.AttributeValueMemberS{Value: WalletFrozen},
+	}}, nil)
+	db.On("TransactWriteItems", ctx, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		wallet := in.TransactItems[1].Update
+
+		return in.TransactItems[0].Update.ExpressionAttributeValues[":confirmed"] != nil &&
+			*wallet.ConditionExpression == "version = :v AND balance >= :amount AND held >= :held AND "+
+				"(attribute_not_exists(#status) OR #status <> :closed)"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	pub.On("Publish", ctx, "http://orchestrator-queue", mock.MatchedBy(func(e *events.Event) bool {
+		return e.Type == events.FundsDeducted && e.GatewayRef == "gw-1"
+	})).Return(nil)
+	pub.On("Publish", ctx, "", mock.Anything).Return(nil)
+
+	svc := New(db, pub, pub, Config{
+		WalletsTable:         "wallets",
+		ReservationsTable:    "reservations",
+		OrchestratorQueueURL: "http://orchestrator-queue",
+	})
+
+	err := svc.ConfirmDeduction(ctx, "pay-123", "res-123", "gw-1")
+
+	assert.NoError(t, err)
+	db.AssertNumberOfCalls(t, "TransactWriteItems", 1)
+	pub.AssertExpectations(t)
+}
+
+func TestStatement_RunningBalances(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	at := func(day int) time.Time {
+		return time.Date(2026, time.February, day, 10, 0, 0, 0, time.UTC)
+	}
+	movement := func(entryType, source string, day int) LedgerEntry {
+		m := newMovement(entryType, source, "wallet-123", "USD")
+		m.CreatedAt = at(day)
+
+		return m
+	}
+
+	reserve := movement(EntryReserve, "res-1", 2)
+	reserve.ReservationID = "res-1"
+	deduction := movement(EntryDeduction, "res-1", 3)
+	deduction.ReservationID = "res-1"
+
+	// The deposit before the range makes up the opening balance.
+	entries := transfer(movement(EntryTopUp, "wallet-123:dep-1", -3), 0, AccountFunding, AccountAvailable, decimal.NewFromInt(100))
+	entries = append(entries, transfer(reserve, 0, AccountAvailable, AccountHeld, decimal.NewFromInt(30))...)
+	entries = append(entries, transfer(deduction, 0, AccountHeld, AccountSettlement, decimal.NewFromInt(30))...)
+	entries = append(entries, transfer(movement(EntryRefund, "ref-1", 4), 0, AccountSettlement, AccountAvailable, decimal.NewFromInt(10))...)
+
+	items := make([]map[string]types.AttributeValue, 0, len(entries))
+	for i := range entries {
+		item, err := attributevalue.MarshalMap(&entries[i])
+		assert.NoError(t, err)
+
+		items = append(items, item)
+	}
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+		"balance":  &types.AttributeValueMemberS{Value: "80"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+	}}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.TableName == "ledger"
+	})).Return(&dynamodb.QueryOutput{Items: items}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{{
+		"id":               &types.AttributeValueMemberS{Value: "res-1"},
+		"amount":           &types.AttributeValueMemberS{Value: "30"},
+		"currency":         &types.AttributeValueMemberS{Value: "USD"},
+		"created_at":       &types.AttributeValueMemberS{Value: "2026-02-02T10:00:00Z"},
+		"payment_amount":   &types.AttributeValueMemberS{Value: "27.5"},
+		"payment_currency": &types.AttributeValueMemberS{Value: "EUR"},
+		"fx_rate":          &types.AttributeValueMemberS{Value: "1.0909"},
+	}}}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", ReservationsTable: "reservations", LedgerTable: "ledger"})
+
+	statement, err := svc.Statement(ctx, "wallet-123", at(1), at(28))
+
+	assert.NoError(t, err)
+	assert.True(t, statement.OpeningBalance.Equal(decimal.NewFromInt(100)))
+	assert.True(t, statement.ClosingBalance.Equal(decimal.NewFromInt(80)))
+	assert.True(t, statement.ClosingHeld.IsZero())
+	assert.Len(t, statement.Lines, 3)
+
+	balances := []int64{100, 70, 80}
+	held := []int64{30, 0, 0}
+
+	for i, line := range statement.Lines {
+		assert.True(t, line.Balance.Equal(decimal.NewFromInt(balances[i])), line.MovementID)
+		assert.True(t, line.Held.Equal(decimal.NewFromInt(held[i])), line.MovementID)
+	}
+
+	assert.Equal(t, "EUR", statement.Lines[1].PaymentCurrency)
+	assert.Equal(t, "27.5", statement.Lines[1].PaymentAmount)
+
+	var csv strings.Builder
+	assert.NoError(t, statement.WriteCSV(&csv))
+	assert.Contains(t, csv.String(), "2026-02-03T10:00:00Z,deduction,deduction#res-1,,res-1,-30.00,-30.00,70.00,0.00,27.5,EUR,1.0909")
+	assert.Contains(t, csv.String(), "2026-02-28T10:00:00Z,closing,,,,,,80.00,0.00,,,")
+}
+
+func TestStatement_OrdersEntriesByTimeNotText(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	deposit := func(id string, at time.Time, amount int64) []LedgerEntry {
+		m := newMovement(EntryTopUp, "wallet-123:"+id, "wallet-123", "USD")
+		m.CreatedAt = at
+
+		return transfer(m, 0, AccountFunding, AccountAvailable, decimal.NewFromInt(amount))
+	}
+
+	second := time.Date(2026, time.February, 5, 10, 0, 0, 0, time.UTC)
+
+	// As text "10:00:00.5Z" sorts before "10:00:00Z", which is the order the
+	// index returns them in.
+	entries := deposit("dep-2", second.Add(500*time.Millisecond), 50)
+	entries = append(entries, deposit("dep-1", second, 100)...)
+
+	items := make([]map[string]types.AttributeValue, 0, len(entries))
+	for i := range entries {
+		item, err := attributevalue.MarshalMap(&entries[i])
+		assert.NoError(t, err)
+
+		items = append(items, item)
+	}
+
+	db.On("GetItem", ctx, mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"id":       &types.AttributeValueMemberS{Value: "wallet-123"},
+		"balance":  &types.AttributeValueMemberN{Value: "150"},
+		"currency": &types.AttributeValueMemberS{Value: "USD"},
+	}}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.TableName == "ledger" && *in.KeyConditionExpression == "wallet_id = :wid"
+	})).Return(&dynamodb.QueryOutput{Items: items}, nil)
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.TableName == "reservations"
+	})).Return(&dynamodb.QueryOutput{}, nil)
+
+	svc := New(db, nil, nil, Config{WalletsTable: "wallets", ReservationsTable: "reservations", LedgerTable: "ledger"})
+
+	// "10:00:00Z" is not before "10:00:00.75Z" as text either.
+	statement, err := svc.Statement(ctx, "wallet-123", second.Add(-time.Hour), second.Add(750*time.Millisecond))
+
+	assert.NoError(t, err)
+	assert.Len(t, statement.Lines, 2)
+	assert.Equal(t, "top_up#wallet-123:dep-1", statement.Lines[0].MovementID)
+	assert.True(t, statement.Lines[0].Balance.Equal(decimal.NewFromInt(100)))
+	assert.True(t, statement.ClosingBalance.Equal(decimal.NewFromInt(150)))
 }
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/shopspring/decimal"
+)
+
+// Statement lists the movements of a wallet from From up to, not including,
+// To, with the wallet's balance and held amount before and after them.
+// Amounts are in the wallet's currency.
+type Statement struct {
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	WalletID       string          `json:"wallet_id"`
+	Currency       string          `json:"currency"`
+	OpeningBalance decimal.Decimal `json:"opening_balance"`
+	OpeningHeld    decimal.Decimal `json:"opening_held"`
+	ClosingBalance decimal.Decimal `json:"closing_balance"`
+	ClosingHeld    decimal.Decimal `json:"closing_held"`
+	Lines          []StatementLine `json:"lines"`
+}
+
+// StatementLine is one movement. Amount and HeldAmount are what it added to
+// the balance and to the held amount; Balance and Held are the running totals
+// after it. Payments converted from another currency also carry the payment's
+// amount and the rate locked on their reservation.
+type StatementLine struct {
+	Date            time.Time       `json:"date"`
+	MovementID      string          `json:"movement_id"`
+	Type            string          `json:"type"`
+	PaymentID       string          `json:"payment_id,omitempty"`
+	ReservationID   string          `json:"reservation_id,omitempty"`
+	Amount          decimal.Decimal `json:"amount"`
+	HeldAmount      decimal.Decimal `json:"held_amount"`
+	Balance         decimal.Decimal `json:"balance"`
+	Held            decimal.Decimal `json:"held"`
+	PaymentAmount   string          `json:"payment_amount,omitempty"`
+	PaymentCurrency string          `json:"payment_currency,omitempty"`
+	FXRate          string          `json:"fx_rate,omitempty"`
+}
+
+// Statement builds a wallet's statement for [from, to) from its ledger
+// entries. The opening balance is what the entries before from add up to, so
+// balances older than the ledger need an opening entry to show (see
+// OpenLedgers).
+func (s *Service) Statement(
+	ctx context.Context,
+	walletID string,
+	from, to time.Time,
+) (*Statement, error) {
+	if !from.Before(to) {
+		return nil, ErrInvalidRange
+	}
+
+	wallet, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The range is applied in buildStatement: created_at does not compare as
+	// text in time order (see walletEntries).
+	entries, err := s.walletEntries(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A payment deducted in the range may have been reserved up to
+	// authorizationTTL before it.
+	reservations, err := s.walletReservations(ctx, walletID, from.Add(-authorizationTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return buildStatement(wallet, entries, reservations, from, to), nil
+}
+
+// buildStatement adds up entries, oldest first, into the statement of wallet
+// for [from, to).
+func buildStatement(
+	wallet *Wallet,
+	entries []LedgerEntry,
+	reservations []Reservation,
+	from, to time.Time,
+) *Statement {
+	byID := make(map[string]*Reservation, len(reservations))
+	for i := range reservations {
+		byID[reservations[i].ID] = &reservations[i]
+	}
+
+	statement := &Statement{
+		From:           from,
+		To:             to,
+		WalletID:       wallet.ID,
+		Currency:       wallet.Currency,
+		OpeningBalance: decimal.Zero,
+		OpeningHeld:    decimal.Zero,
+		Lines:          []StatementLine{},
+	}
+
+	lines := make(map[string]int)
+
+	for i := range entries {
+		e := &entries[i]
+		balance, held := e.effect()
+
+		switch {
+		case !e.CreatedAt.Before(to):
+			continue
+		case e.CreatedAt.Before(from):
+			statement.OpeningBalance = statement.OpeningBalance.Add(balance)
+			statement.OpeningHeld = statement.OpeningHeld.Add(held)
+
+			continue
+		}
+
+		n, ok := lines[e.MovementID]
+		if !ok {
+			n = len(statement.Lines)
+			lines[e.MovementID] = n
+			statement.Lines = append(statement.Lines, newStatementLine(e, byID[e.ReservationID]))
+		}
+
+		statement.Lines[n].Amount = statement.Lines[n].Amount.Add(balance)
+		statement.Lines[n].HeldAmount = statement.Lines[n].HeldAmount.Add(held)
+	}
+
+	balance, held := statement.OpeningBalance, statement.OpeningHeld
+
+	for i := range statement.Lines {
+		balance = balance.Add(statement.Lines[i].Amount)
+		held = held.Add(statement.Lines[i].HeldAmount)
+		statement.Lines[i].Balance = balance
+		statement.Lines[i].Held = held
+	}
+
+	statement.ClosingBalance = balance
+	statement.ClosingHeld = held
+
+	return statement
+}
+
+func newStatementLine(e *LedgerEntry, reservation *Reservation) StatementLine {
+	line := StatementLine{
+		Date:          e.CreatedAt,
+		MovementID:    e.MovementID,
+		Type:          e.Type,
+		PaymentID:     e.PaymentID,
+		ReservationID: e.ReservationID,
+		Amount:        decimal.Zero,
+		HeldAmount:    decimal.Zero,
+	}
+
+	if reservation != nil && reservation.PaymentAmount != nil {
+		line.PaymentAmount = reservation.PaymentAmount.String()
+		line.PaymentCurrency = reservation.PaymentCurrency
+		line.FXRate = reservation.FXRate
+	}
+
+	return line
+}
+
+// WriteCSV renders the statement as CSV: a header, an opening row, one row
+// per movement and a closing row. Amounts have the currency's minor units.
+func (st *Statement) WriteCSV(w io.Writer) error {
+	c, err := currency.Lookup(st.Currency)
+	if err != nil {
+		return err
+	}
+
+	fixed := func(d decimal.Decimal) string {
+		return d.StringFixed(c.MinorUnits)
+	}
+
+	out := csv.NewWriter(w)
+
+	rows := [][]string{
+		{
+			"date", "type", "movement_id", "payment_id", "reservation_id", "amount", "held_amount",
+			"balance", "held", "payment_amount", "payment_currency", "fx_rate",
+		},
+		{
+			st.From.UTC().Format(time.RFC3339), "opening", "", "", "", "", "",
+			fixed(st.OpeningBalance), fixed(st.OpeningHeld), "", "", "",
+		},
+	}
+
+	for _, l := range st.Lines {
+		rows = append(rows, []string{
+			l.Date.UTC().Format(time.RFC3339), l.Type, l.MovementID, l.PaymentID, l.ReservationID,
+			fixed(l.Amount), fixed(l.HeldAmount), fixed(l.Balance), fixed(l.Held),
+			l.PaymentAmount, l.PaymentCurrency, l.FXRate,
+		})
+	}
+
+	rows = append(rows, []string{
+		st.To.UTC().Format(time.RFC3339), "closing", "", "", "", "", "",
+		fixed(st.ClosingBalance), fixed(st.ClosingHeld), "", "", "",
+	})
+
+	if err := out.WriteAll(rows); err != nil {
+		return fmt.Errorf("write statement: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Wallet states. Money leaves only active wallets; frozen wallets still
+// receive funds and settle the reservations made before they were frozen,
+// closed wallets take no movement at all. Wallets written before states
+// existed are active.
+const (
+	WalletActive = "active"
+	WalletFrozen = "frozen"
+	WalletClosed = "closed"
+)
+
+// transitions lists the states each state may move to. Closed is final.
+var transitions = map[string][]string{
+	WalletActive: {WalletFrozen, WalletClosed},
+	WalletFrozen: {WalletActive, WalletClosed},
+}
+
+// StatusChange is the audit record of a wallet state transition.
+type StatusChange struct {
+	CreatedAt time.Time `dynamodbav:"created_at"`
+	ID        string    `dynamodbav:"id"`
+	WalletID  string    `dynamodbav:"wallet_id"`
+	From      string    `dynamodbav:"from_status"`
+	To        string    `dynamodbav:"to_status"`
+	Reason    string    `dynamodbav:"reason"`
+	ChangedBy string    `dynamodbav:"changed_by"`
+}
+
+// State is the wallet's state, active for wallets that have none.
+func (w *Wallet) State() string {
+	if w.Status == "" {
+		return WalletActive
+	}
+
+	return w.Status
+}
+
+// checkSend fails unless money may leave the wallet.
+func (w *Wallet) checkSend() error {
+	switch w.State() {
+	case WalletFrozen:
+		return fmt.Errorf("%w: wallet %s", ErrWalletFrozen, w.ID)
+	case WalletClosed:
+		return fmt.Errorf("%w: wallet %s", ErrWalletClosed, w.ID)
+	default:
+		return nil
+	}
+}
+
+// checkReceive fails unless money may enter the wallet.
+func (w *Wallet) checkReceive() error {
+	if w.State() == WalletClosed {
+		return fmt.Errorf("%w: wallet %s", ErrWalletClosed, w.ID)
+	}
+
+	return nil
+}
+
+// requireSendable adds to a wallet update the condition that the wallet is
+// active, so a write prepared before the wallet was frozen or closed fails.
+func requireSendable(update *types.Update) {
+	requireState(update, "(attribute_not_exists(#status) OR #status = :active)", ":active", WalletActive)
+}
+
+// requireReceivable adds to a wallet update the condition that the wallet is
+// not closed.
+func requireReceivable(update *types.Update) {
+	requireState(update, "(attribute_not_exists(#status) OR #status <> :closed)", ":closed", WalletClosed)
+}
+
+func requireState(update *types.Update, condition, name, state string) {
+	if update.ExpressionAttributeNames == nil {
+		update.ExpressionAttributeNames = map[string]string{}
+	}
+
+	update.ExpressionAttributeNames["#status"] = "status"
+	update.ExpressionAttributeValues[name] = &types.AttributeValueMemberS{Value: state}
+	update.ConditionExpression = aws.String(aws.ToString(update.ConditionExpression) + " AND " + condition)
+}
+
+// SetWalletStatus moves a wallet to another state. The state change and its
+// audit record, with who made it and why, are written in one transaction
+// conditioned on the wallet version. Only an empty wallet, with nothing held,
+// can be closed; closing it gives up its WalletKey, so the user can open
+// another wallet in the currency. Moving a wallet to the state it is in
+// changes nothing. Each transition is broadcast as wallet.status_changed.
+func (s *Service) SetWalletStatus(
+	ctx context.Context,
+	walletID, status, reason, changedBy string,
+) (*Wallet, error) {
+	var (
+		wallet *Wallet
+		change *StatusChange
+	)
+
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		wallet, change, err = s.changeStatus(ctx, walletID, status, reason, changedBy)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if change == nil {
+		return wallet, nil
+	}
+
+	event := events.New(events.WalletStatusChanged, "", wallet.UserID)
+	event.WithWallet(walletID).
+		WithStatusChange(change.From, change.To).
+		WithReason(reason)
+
+	s.broadcast(ctx, &event)
+
+	slog.Info(
+		"wallet status changed",
+		"wallet_id", walletID,
+		"from", change.From,
+		"to", change.To,
+		"changed_by", changedBy,
+	)
+
+	return wallet, nil
+}
+
+func (s *Service) changeStatus(
+	ctx context.Context,
+	walletID, status, reason, changedBy string,
+) (*Wallet, *StatusChange, error) {
+	wallet, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	from := wallet.State()
+	if from == status {
+		return wallet, nil, nil
+	}
+
+	if !slices.Contains(transitions[from], status) {
+		return nil, nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, status)
+	}
+
+	if status == WalletClosed && (!wallet.Balance.IsZero() || !wallet.Held.IsZero()) {
+		return nil, nil, fmt.Errorf("%w: wallet %s", ErrWalletNotEmpty, wallet.ID)
+	}
+
+	now := time.Now().UTC()
+	change := &StatusChange{
+		ID:        uuid.New().String(),
+		WalletID:  walletID,
+		From:      from,
+		To:        status,
+		Reason:    reason,
+		ChangedBy: changedBy,
+		CreatedAt: now,
+	}
+
+	item, err := attributevalue.MarshalMap(change)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal status change: %w", err)
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(s.walletsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: wallet.ID},
+				},
+				UpdateExpression: aws.String(
+					"SET #status = :status, updated_at = :now, version = version + :one",
+				),
+				ConditionExpression:      aws.String("version = :v"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":status": &types.AttributeValueMemberS{Value: status},
+					":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+					":one":    &types.AttributeValueMemberN{Value: "1"},
+					":v":      &types.AttributeValueMemberN{Value: strconv.Itoa(wallet.Version)},
+				},
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String(s.auditTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		},
+	}
+
+	if status == WalletClosed {
+		key, err := s.getWalletKey(ctx, wallet.UserID, wallet.Currency)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Wallets opened before keys existed may not hold theirs.
+		if key != nil && key.WalletID == wallet.ID {
+			items = append(items, types.TransactWriteItem{
+				Delete: &types.Delete{
+					TableName: aws.String(s.walletKeysTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: key.ID},
+					},
+					ConditionExpression: aws.String("wallet_id = :wid"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":wid": &types.AttributeValueMemberS{Value: wallet.ID},
+					},
+				},
+			})
+		}
+	}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return nil, nil, fmt.Errorf("%w: wallet %s", ErrWalletConflict, wallet.ID)
+		}
+
+		return nil, nil, fmt.Errorf("change wallet status: %w", err)
+	}
+
+	wallet.Status = status
+	wallet.Version++
+	wallet.UpdatedAt = now
+
+	return wallet, change, nil
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// Transfer is the result of moving funds between two wallets. Replayed is set
+// when the transfer had already been applied and nothing changed.
+type Transfer struct {
+	ID       string
+	From     *Wallet
+	ToID     string
+	Amount   decimal.Decimal
+	Currency string
+	Replayed bool
+}
+
+// TransferFunds moves amount from an active wallet to another of the same
+// currency that is not closed. transferID is the client's idempotency key,
+// scoped to the source wallet: both balance changes and the ledger entries of
+// both wallets are written in one transaction conditioned on the version of
+// each wallet, so a transfer is applied once and never against a stale balance.
+// Repeating a transfer that was applied returns its result even if the wallets
+// have since been frozen or spent. A version conflict reads both wallets again
+// and retries. The outcome is broadcast as wallet.transfer_completed, or
+// wallet.transfer_failed when the transfer is refused.
+func (s *Service) TransferFunds(
+	ctx context.Context,
+	transferID, fromID, toID string,
+	amount decimal.Decimal,
+	code string,
+) (*Transfer, error) {
+	if !amount.IsPositive() {
+		return nil, ErrInvalidAmount
+	}
+
+	if fromID == toID {
+		return nil, ErrSameWallet
+	}
+
+	var result *Transfer
+
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		result, err = s.moveFunds(ctx, transferID, fromID, toID, amount, code)
+
+		return err
+	})
+
+	switch {
+	case errors.Is(err, ErrInsufficientFunds),
+		errors.Is(err, ErrWalletNotFound),
+		errors.Is(err, ErrCurrencyMismatch),
+		errors.Is(err, ErrWalletFrozen),
+		errors.Is(err, ErrWalletClosed):
+		s.publishTransferFailed(ctx, transferID, fromID, toID, amount, code, err)
+
+		return nil, err
+	case err != nil:
+		return nil, err
+	}
+
+	if result.Replayed {
+		return result, nil
+	}
+
+	event := events.New(events.TransferCompleted, "", result.From.UserID)
+	event.WithAmount(amount, result.Currency).
+		WithWallet(fromID).
+		WithTransfer(transferID, toID)
+
+	s.broadcast(ctx, &event)
+
+	slog.Info("funds transferred", "transfer_id", transferID, "from", fromID, "to", toID, "amount", amount.String())
+
+	return result, nil
+}
+
+func (s *Service) moveFunds(
+	ctx context.Context,
+	transferID, fromID, toID string,
+	amount decimal.Decimal,
+	code string,
+) (*Transfer, error) {
+	from, err := s.GetWallet(ctx, fromID)
+	if err != nil {
+		return nil, err
+	}
+
+	code = currency.Normalize(code)
+
+	// Each wallet's side balances on its own through the transfer account,
+	// so either wallet can be verified without the other.
+	source := walletKey(fromID, transferID)
+	out := newMovement(EntryTransfer, source, fromID, code)
+	in := newMovement(EntryTransfer, source, toID, code)
+
+	entries := transfer(out, 0, AccountAvailable, AccountTransfer, amount)
+	entries = append(entries, transfer(in, 1, AccountTransfer, AccountAvailable, amount)...)
+
+	applied, err := s.findLedgerEntry(ctx, entries[3].ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if applied != nil {
+		return replayTransfer(from, transferID, applied, toID, amount)
+	}
+
+	to, err := s.GetWallet(ctx, toID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := from.checkSend(); err != nil {
+		return nil, err
+	}
+
+	if err := to.checkReceive(); err != nil {
+		return nil, err
+	}
+
+	if from.Currency != code || to.Currency != code {
+		return nil, fmt.Errorf("%w: %s to %s", ErrCurrencyMismatch, from.Currency, to.Currency)
+	}
+
+	c, err := currency.Lookup(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.CheckPrecision(amount); err != nil {
+		return nil, err
+	}
+
+	if from.Available().LessThan(amount) {
+		return nil, fmt.Errorf("%w: wallet %s", ErrInsufficientFunds, from.ID)
+	}
+
+	writes, err := s.ledgerWrites(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	items := []types.TransactWriteItem{
+		s.balanceWrite(from, from.Balance.Sub(amount), now),
+		s.balanceWrite(to, to.Balance.Add(amount), now),
+	}
+	requireSendable(items[0].Update)
+	requireReceivable(items[1].Update)
+
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			if conditionFailed(tce, 2) {
+				applied, err := s.ledgerEntry(ctx, entries[3].ID)
+				if err != nil {
+					return nil, err
+				}
+
+				return replayTransfer(from, transferID, applied, toID, amount)
+			}
+
+			return nil, fmt.Errorf("%w: wallets %s, %s", ErrWalletConflict, from.ID, to.ID)
+		}
+
+		return nil, fmt.Errorf("transfer funds: %w", err)
+	}
+
+	from.Balance = money.New(from.Balance.Sub(amount))
+	from.Version++
+	from.UpdatedAt = now
+
+	return &Transfer{ID: transferID, From: from, ToID: toID, Amount: amount, Currency: code}, nil
+}
+
+// replayTransfer handles a transfer whose ledger entries already exist, entry
+// being the credit to the receiving wallet: the same amount to the same
+// wallet is a retry, anything else is a reused key.
+func replayTransfer(
+	from *Wallet,
+	transferID string,
+	entry *LedgerEntry,
+	toID string,
+	amount decimal.Decimal,
+) (*Transfer, error) {
+	if entry.WalletID != toID || !entry.Amount.Equal(amount) {
+		return nil, ErrTransferKeyReused
+	}
+
+	slog.Info("transfer replayed", "transfer_id", transferID, "from", from.ID)
+
+	return &Transfer{
+		ID:       transferID,
+		From:     from,
+		ToID:     toID,
+		Amount:   amount,
+		Currency: entry.Currency,
+		Replayed: true,
+	}, nil
+}
+
+// publishTransferFailed broadcasts a refused transfer. Like other bus events
+// it is informational, so failures to publish are only logged.
+func (s *Service) publishTransferFailed(
+	ctx context.Context,
+	transferID, fromID, toID string,
+	amount decimal.Decimal,
+	code string,
+	cause error,
+) {
+	reason := cause.Error()
+
+	sentinels := []error{
+		ErrInsufficientFunds,
+		ErrWalletNotFound,
+		ErrCurrencyMismatch,
+		ErrWalletFrozen,
+		ErrWalletClosed,
+	}
+
+	for _, sentinel := range sentinels {
+		if errors.Is(cause, sentinel) {
+			reason = sentinel.Error()
+		}
+	}
+
+	event := events.New(events.TransferFailed, "", "")
+	event.WithAmount(amount, currency.Normalize(code)).
+		WithWallet(fromID).
+		WithTransfer(transferID, toID).
+		WithReason(reason)
+
+	slog.Warn("transfer failed", "transfer_id", transferID, "reason", reason)
+
+	s.broadcast(ctx, &event)
+}
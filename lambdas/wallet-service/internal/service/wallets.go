@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Deposit is the result of a top-up. Replayed is set when the deposit had
+// already been applied and nothing changed.
+type Deposit struct {
+	ID       string
+	Wallet   *Wallet
+	Amount   decimal.Decimal
+	Replayed bool
+}
+
+// CreateWallet opens an empty wallet for a user in the given currency. A user
+// may hold one open wallet per currency: the wallet is written together with
+// its WalletKey, so of two concurrent requests only one succeeds.
+func (s *Service) CreateWallet(ctx context.Context, userID, code string) (*Wallet, error) {
+	c, err := currency.Lookup(code)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.userWallet(ctx, userID, c.Code)
+	if err == nil || errors.Is(err, ErrAmbiguousWallet) {
+		return nil, fmt.Errorf("%w: %s", ErrWalletExists, c.Code)
+	}
+
+	if !errors.Is(err, ErrNoWalletForCurrency) {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	wallet := &Wallet{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Balance:   money.New(decimal.Zero),
+		Held:      money.New(decimal.Zero),
+		Currency:  c.Code,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	item, err := attributevalue.MarshalMap(wallet)
+	if err != nil {
+		return nil, fmt.Errorf("marshal wallet: %w", err)
+	}
+
+	key, err := s.putWalletKey(wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName:           aws.String(s.walletsTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		},
+		key,
+	}
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) && conditionFailed(tce, 1) {
+			return nil, fmt.Errorf("%w: %s", ErrWalletExists, c.Code)
+		}
+
+		return nil, fmt.Errorf("put wallet: %w", err)
+	}
+
+	slog.Info("wallet created", "wallet_id", wallet.ID, "user_id", userID, "currency", wallet.Currency)
+
+	return wallet, nil
+}
+
+// GetWallet returns a wallet by ID.
+func (s *Service) GetWallet(ctx context.Context, id string) (*Wallet, error) {
+	result, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.walletsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get wallet: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrWalletNotFound
+	}
+
+	var wallet Wallet
+	if err := attributevalue.UnmarshalMap(result.Item, &wallet); err != nil {
+		return nil, fmt.Errorf("unmarshal wallet: %w", err)
+	}
+
+	return &wallet, nil
+}
+
+// ListUserWallets returns every wallet of a user.
+func (s *Service) ListUserWallets(ctx context.Context, userID string) ([]Wallet, error) {
+	var (
+		wallets []Wallet
+		start   map[string]types.AttributeValue
+	)
+
+	for {
+		page, err := s.db.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.walletsTable),
+			IndexName:              aws.String("user_id-index"),
+			KeyConditionExpression: aws.String("user_id = :uid"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":uid": &types.AttributeValueMemberS{Value: userID},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("query wallets: %w", err)
+		}
+
+		var batch []Wallet
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("unmarshal wallets: %w", err)
+		}
+
+		wallets = append(wallets, batch...)
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return wallets, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+// DepositFunds tops up a wallet that is not closed. depositID is the client's
+// idempotency key: the balance change and its ledger entries are written once
+// per wallet and key, and repeating the same deposit replays it. Each applied
+// deposit is broadcast as wallet.funds_deposited.
+func (s *Service) DepositFunds(
+	ctx context.Context,
+	walletID, depositID string,
+	amount decimal.Decimal,
+	code string,
+) (*Deposit, error) {
+	if !amount.IsPositive() {
+		return nil, ErrInvalidAmount
+	}
+
+	var deposit *Deposit
+
+	err := retryOnConflict(ctx, func() error {
+		var err error
+
+		deposit, err = s.deposit(ctx, walletID, depositID, amount, code)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if deposit.Replayed {
+		return deposit, nil
+	}
+
+	event := events.New(events.FundsDeposited, "", deposit.Wallet.UserID)
+	event.WithAmount(amount, deposit.Wallet.Currency).
+		WithWallet(walletID).
+		WithDeposit(depositID)
+
+	s.broadcast(ctx, &event)
+
+	slog.Info("funds deposited", "wallet_id", walletID, "deposit_id", depositID, "amount", amount.String())
+
+	return deposit, nil
+}
+
+func (s *Service) deposit(
+	ctx context.Context,
+	walletID, depositID string,
+	amount decimal.Decimal,
+	code string,
+) (*Deposit, error) {
+	wallet, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wallet.checkReceive(); err != nil {
+		return nil, err
+	}
+
+	if code != "" && currency.Normalize(code) != wallet.Currency {
+		return nil, fmt.Errorf("%w: %s", ErrCurrencyMismatch, wallet.Currency)
+	}
+
+	c, err := currency.Lookup(wallet.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.CheckPrecision(amount); err != nil {
+		return nil, err
+	}
+
+	movement := newMovement(EntryTopUp, walletKey(walletID, depositID), wallet.ID, wallet.Currency)
+	entries := transfer(movement, 0, AccountFunding, AccountAvailable, amount)
+
+	writes, err := s.ledgerWrites(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	items := []types.TransactWriteItem{s.balanceWrite(wallet, wallet.Balance.Add(amount), now)}
+	requireReceivable(items[0].Update)
+
+	items = append(items, writes...)
+
+	_, err = s.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			if conditionFailed(tce, 1) {
+				return s.replayDeposit(ctx, wallet, depositID, entries[1].ID, amount)
+			}
+
+			return nil, fmt.Errorf("%w: wallet %s", ErrWalletConflict, wallet.ID)
+		}
+
+		return nil, fmt.Errorf("deposit funds: %w", err)
+	}
+
+	wallet.Balance = money.New(wallet.Balance.Add(amount))
+	wallet.Version++
+	wallet.UpdatedAt = now
+
+	return &Deposit{ID: depositID, Wallet: wallet, Amount: amount}, nil
+}
+
+// balanceWrite sets a wallet's balance if the wallet is still at the version
+// that was read.
+func (s *Service) balanceWrite(wallet *Wallet, balance decimal.Decimal, now time.Time) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			TableName: aws.String(s.walletsTable),
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: wallet.ID},
+			},
+			UpdateExpression: aws.String(
+				"SET balance = :balance, updated_at = :now, version = version + :one",
+			),
+			ConditionExpression: aws.String("version = :v"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":balance": &types.AttributeValueMemberN{Value: balance.String()},
+				":now":     &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+				":one":     &types.AttributeValueMemberN{Value: "1"},
+				":v":       &types.AttributeValueMemberN{Value: strconv.Itoa(wallet.Version)},
+			},
+		},
+	}
+}
+
+// replayDeposit handles a deposit whose ledger entries already exist: the
+// same amount is a retry, anything else is a reused key.
+func (s *Service) replayDeposit(
+	ctx context.Context,
+	wallet *Wallet,
+	depositID, entryID string,
+	amount decimal.Decimal,
+) (*Deposit, error) {
+	entry, err := s.ledgerEntry(ctx, entryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.Amount.Equal(amount) {
+		return nil, ErrDepositKeyReused
+	}
+
+	slog.Info("deposit replayed", "wallet_id", wallet.ID, "deposit_id", depositID)
+
+	return &Deposit{ID: depositID, Wallet: wallet, Amount: amount, Replayed: true}, nil
+}
+
+// walletKey scopes a client's idempotency key to the wallet it acts on.
+func walletKey(walletID, key string) string {
+	return walletID + ":" + key
+}
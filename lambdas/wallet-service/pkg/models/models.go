@@ -0,0 +1,299 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+	"github.com/shopspring/decimal"
+)
+
+// CreateWalletRequest is the body of POST /wallets.
+type CreateWalletRequest struct {
+	UserID   string `json:"user_id"`
+	Currency string `json:"currency"`
+}
+
+// Validate checks the request and normalises the currency code to upper case.
+func (r *CreateWalletRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrValidation("user_id is required")
+	}
+
+	if r.Currency == "" {
+		return ErrValidation("currency is required")
+	}
+
+	c, err := currency.Lookup(r.Currency)
+	if err != nil {
+		return ErrValidation(err.Error())
+	}
+
+	r.Currency = c.Code
+
+	return nil
+}
+
+// DepositRequest is the body of POST /wallets/{id}/deposits. Currency must be
+// the wallet's.
+type DepositRequest struct {
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (r *DepositRequest) Validate() error {
+	code, err := validateAmount(r.Amount, r.Currency)
+	if err != nil {
+		return err
+	}
+
+	r.Currency = code
+
+	return nil
+}
+
+// TransferRequest is the body of POST /transfers. Both wallets must be in
+// Currency.
+type TransferRequest struct {
+	FromWalletID string          `json:"from_wallet_id"`
+	ToWalletID   string          `json:"to_wallet_id"`
+	Amount       decimal.Decimal `json:"amount"`
+	Currency     string          `json:"currency"`
+}
+
+func (r *TransferRequest) Validate() error {
+	if r.FromWalletID == "" || r.ToWalletID == "" {
+		return ErrValidation("from_wallet_id and to_wallet_id are required")
+	}
+
+	if r.FromWalletID == r.ToWalletID {
+		return ErrValidation("cannot transfer to the same wallet")
+	}
+
+	code, err := validateAmount(r.Amount, r.Currency)
+	if err != nil {
+		return err
+	}
+
+	r.Currency = code
+
+	return nil
+}
+
+// StatusRequest is the body of PUT /wallets/{id}/status. Reason and ChangedBy
+// are kept in the wallet's audit trail.
+type StatusRequest struct {
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+	ChangedBy string `json:"changed_by"`
+}
+
+func (r *StatusRequest) Validate() error {
+	switch r.Status {
+	case "active", "frozen", "closed":
+	case "":
+		return ErrValidation("status is required")
+	default:
+		return ErrValidation("status must be active, frozen or closed")
+	}
+
+	if r.Reason == "" || r.ChangedBy == "" {
+		return ErrValidation("reason and changed_by are required")
+	}
+
+	return nil
+}
+
+// Statement formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// maxStatementRange bounds how much history one statement reads.
+const maxStatementRange = 366 * 24 * time.Hour
+
+// StatementRequest asks for a wallet statement. From and To are dates
+// (2006-01-02), both included, or RFC 3339 times, To excluded. Format is json
+// (the default) or csv.
+type StatementRequest struct {
+	From   string
+	To     string
+	Format string
+	// Start and End are the parsed range, End excluded. Validate sets them.
+	Start time.Time
+	End   time.Time
+}
+
+func (r *StatementRequest) Validate() error {
+	if r.From == "" || r.To == "" {
+		return ErrValidation("from and to are required")
+	}
+
+	start, _, err := parseStatementTime(r.From)
+	if err != nil {
+		return ErrValidation("from must be a date or an RFC 3339 time")
+	}
+
+	end, isDate, err := parseStatementTime(r.To)
+	if err != nil {
+		return ErrValidation("to must be a date or an RFC 3339 time")
+	}
+
+	if isDate {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	if !start.Before(end) {
+		return ErrValidation("to must not be before from")
+	}
+
+	if end.Sub(start) > maxStatementRange {
+		return ErrValidation("range must not exceed 366 days")
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = FormatJSON
+	case FormatJSON, FormatCSV:
+	default:
+		return ErrValidation("format must be json or csv")
+	}
+
+	r.Start, r.End = start, end
+
+	return nil
+}
+
+// parseStatementTime reads a date or an RFC 3339 time, and reports which.
+func parseStatementTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, true, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+
+	return t, false, err
+}
+
+// LimitsRequest is the body of PUT /wallets/{id}/limits. It replaces the
+// wallet's own limits; a limit left out falls back to the currency default.
+type LimitsRequest struct {
+	PerTransaction *decimal.Decimal `json:"per_transaction"`
+	Daily          *decimal.Decimal `json:"daily"`
+	Weekly         *decimal.Decimal `json:"weekly"`
+}
+
+func (r *LimitsRequest) Validate() error {
+	for _, limit := range []*decimal.Decimal{r.PerTransaction, r.Daily, r.Weekly} {
+		if limit != nil && limit.IsNegative() {
+			return ErrValidation("limits must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// validateAmount checks that amount is positive and fits the minor units of a
+// supported currency, and returns the normalised currency code.
+func validateAmount(amount decimal.Decimal, code string) (string, error) {
+	if amount.LessThanOrEqual(decimal.Zero) {
+		return "", ErrValidation("amount must be positive")
+	}
+
+	if code == "" {
+		return "", ErrValidation("currency is required")
+	}
+
+	c, err := currency.Lookup(code)
+	if err != nil {
+		return "", ErrValidation(err.Error())
+	}
+
+	if err := c.CheckPrecision(amount); err != nil {
+		return "", ErrValidation(err.Error())
+	}
+
+	return c.Code, nil
+}
+
+type Response struct {
+	Data    any    `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Success bool   `json:"success"`
+}
+
+// WalletDTO is a wallet as the API returns it. Available is the balance not
+// held by active reservations.
+type WalletDTO struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	Balance   string    `json:"balance"`
+	Held      string    `json:"held"`
+	Available string    `json:"available"`
+}
+
+// LimitsDTO is the spending limits that apply to a wallet, its own or its
+// currency's default. A limit that is not set does not apply.
+type LimitsDTO struct {
+	WalletID       string `json:"wallet_id"`
+	Currency       string `json:"currency"`
+	PerTransaction string `json:"per_transaction,omitempty"`
+	Daily          string `json:"daily,omitempty"`
+	Weekly         string `json:"weekly,omitempty"`
+}
+
+type WalletListDTO struct {
+	Wallets []WalletDTO `json:"wallets"`
+}
+
+// DepositDTO is the response of POST /wallets/{id}/deposits. ID is the
+// request's Idempotency-Key.
+type DepositDTO struct {
+	ID       string    `json:"id"`
+	Amount   string    `json:"amount"`
+	Currency string    `json:"currency"`
+	Wallet   WalletDTO `json:"wallet"`
+}
+
+// TransferDTO is the response of POST /transfers. ID is the request's
+// Idempotency-Key and Wallet is the source wallet after the transfer.
+type TransferDTO struct {
+	ID           string    `json:"id"`
+	FromWalletID string    `json:"from_wallet_id"`
+	ToWalletID   string    `json:"to_wallet_id"`
+	Amount       string    `json:"amount"`
+	Currency     string    `json:"currency"`
+	Wallet       WalletDTO `json:"wallet"`
+}
+
+func SuccessJSON(data any) string {
+	b, _ := json.Marshal(Response{Success: true, Data: data})
+
+	return string(b)
+}
+
+func ErrorJSON(msg string) string {
+	b, _ := json.Marshal(Response{Success: false, Error: msg})
+
+	return string(b)
+}
+
+func Headers() map[string]string {
+	return map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type, Idempotency-Key",
+	}
+}
+
+type ValidationError struct{ msg string }
+
+func (e ValidationError) Error() string { return e.msg }
+
+func ErrValidation(msg string) error { return ValidationError{msg} }
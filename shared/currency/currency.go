@@ -0,0 +1,110 @@
+// Package currency is the registry of ISO 4217 currencies the system accepts,
+// with the number of minor units each one allows and the range of amounts a
+// single payment may have.
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrUnsupported   = errors.New("unsupported currency")
+	ErrTooPrecise    = errors.New("amount has too many decimal places")
+	ErrAmountTooLow  = errors.New("amount is below the currency minimum")
+	ErrAmountTooHigh = errors.New("amount is above the currency maximum")
+)
+
+// Currency describes one supported currency. MinorUnits is the ISO 4217
+// exponent: 2 for USD (cents), 0 for JPY, 3 for KWD.
+type Currency struct {
+	Code       string
+	MinorUnits int32
+	MinAmount  decimal.Decimal
+	MaxAmount  decimal.Decimal
+}
+
+func define(code string, minorUnits int32, minAmount, maxAmount string) Currency {
+	return Currency{
+		Code:       code,
+		MinorUnits: minorUnits,
+		MinAmount:  decimal.RequireFromString(minAmount),
+		MaxAmount:  decimal.RequireFromString(maxAmount),
+	}
+}
+
+var registry = map[string]Currency{
+	"USD": define("USD", 2, "0.50", "999999.99"),
+	"EUR": define("EUR", 2, "0.50", "999999.99"),
+	"GBP": define("GBP", 2, "0.30", "999999.99"),
+	"CAD": define("CAD", 2, "0.50", "999999.99"),
+	"CHF": define("CHF", 2, "0.50", "999999.99"),
+	"MXN": define("MXN", 2, "10.00", "19999999.99"),
+	"BRL": define("BRL", 2, "0.50", "4999999.99"),
+	"ARS": define("ARS", 2, "1.00", "999999999.99"),
+	"COP": define("COP", 2, "1000.00", "3999999999.99"),
+	"PEN": define("PEN", 2, "2.00", "3999999.99"),
+	"CLP": define("CLP", 0, "50", "999999999"),
+	"JPY": define("JPY", 0, "50", "99999999"),
+	"KWD": define("KWD", 3, "0.100", "299999.999"),
+	"BHD": define("BHD", 3, "0.200", "399999.999"),
+}
+
+// Normalize returns code trimmed and upper-cased, the form used everywhere
+// currencies are stored or compared.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Lookup returns the currency for code, in any case.
+func Lookup(code string) (Currency, error) {
+	c, ok := registry[Normalize(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("%w: %q", ErrUnsupported, code)
+	}
+
+	return c, nil
+}
+
+// Codes returns the supported currency codes in alphabetical order.
+func Codes() []string {
+	codes := make([]string, 0, len(registry))
+	for code := range registry {
+		codes = append(codes, code)
+	}
+
+	slices.Sort(codes)
+
+	return codes
+}
+
+// CheckPrecision reports whether amount can be expressed in the currency's
+// minor units. Trailing zeros are fine: 10.10 is a valid USD amount.
+func (c Currency) CheckPrecision(amount decimal.Decimal) error {
+	if !amount.Equal(amount.Truncate(c.MinorUnits)) {
+		return fmt.Errorf("%w: %s allows %d", ErrTooPrecise, c.Code, c.MinorUnits)
+	}
+
+	return nil
+}
+
+// ValidateAmount checks that amount is a valid payment amount in the currency.
+func (c Currency) ValidateAmount(amount decimal.Decimal) error {
+	if err := c.CheckPrecision(amount); err != nil {
+		return err
+	}
+
+	if amount.LessThan(c.MinAmount) {
+		return fmt.Errorf("%w: %s %s", ErrAmountTooLow, c.MinAmount.StringFixed(c.MinorUnits), c.Code)
+	}
+
+	if amount.GreaterThan(c.MaxAmount) {
+		return fmt.Errorf("%w: %s %s", ErrAmountTooHigh, c.MaxAmount.StringFixed(c.MinorUnits), c.Code)
+	}
+
+	return nil
+}
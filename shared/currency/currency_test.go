@@ -0,0 +1,56 @@
+package currency
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup_NormalisesCase(t *testing.T) {
+	c, err := Lookup(" usd ")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", c.Code)
+	assert.Equal(t, int32(2), c.MinorUnits)
+}
+
+func TestLookup_Unknown(t *testing.T) {
+	_, err := Lookup("XXX")
+
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestValidateAmount(t *testing.T) {
+	usd, _ := Lookup("USD")
+	jpy, _ := Lookup("JPY")
+	kwd, _ := Lookup("KWD")
+
+	tests := []struct {
+		name     string
+		currency Currency
+		amount   string
+		err      error
+	}{
+		{"cents", usd, "10.12", nil},
+		{"trailing zeros", usd, "10.100", nil},
+		{"sub-cent", usd, "10.123", ErrTooPrecise},
+		{"whole yen", jpy, "1000", nil},
+		{"fractional yen", jpy, "10.12345", ErrTooPrecise},
+		{"three decimals", kwd, "1.125", nil},
+		{"below minimum", usd, "0.10", ErrAmountTooLow},
+		{"above maximum", usd, "1000000", ErrAmountTooHigh},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.currency.ValidateAmount(decimal.RequireFromString(tt.amount))
+
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -18,6 +18,26 @@ const (
 	FundsReleased          = "wallet.funds_released"
 	GatewayPaymentApproved = "gateway.payment_approved"
 	GatewayPaymentRejected = "gateway.payment_rejected"
+	RefundRequested        = "payment.refund_requested"
+	FundsRefunded          = "wallet.funds_refunded"
+	FundsDeposited         = "wallet.funds_deposited"
+	TransferCompleted      = "wallet.transfer_completed"
+	TransferFailed         = "wallet.transfer_failed"
+	WalletStatusChanged    = "wallet.status_changed"
+	GatewayRefundCompleted = "gateway.refund_completed"
+	GatewayRefundFailed    = "gateway.refund_failed"
+	CaptureCompleted       = "gateway.capture_completed"
+	CaptureRequested       = "payment.capture_requested"
+	PaymentVoided          = "payment.voided"
+	PaymentCancelled       = "payment.cancelled"
+	ReversalRequested      = "payment.reversal_requested"
+)
+
+// Capture modes. In manual mode the gateway only authorizes the payment and the
+// wallet keeps the reservation until the payment is captured or voided.
+const (
+	CaptureAutomatic = "automatic"
+	CaptureManual    = "manual"
 )
 
 // Event is the base structure for all events.
@@ -32,6 +52,19 @@ type Event struct {
 	Reason        string          `json:"reason,omitempty"`
 	ReservationID string          `json:"reservation_id,omitempty"`
 	GatewayRef    string          `json:"gateway_ref,omitempty"`
+	RefundID      string          `json:"refund_id,omitempty"`
+	CaptureMode   string          `json:"capture_mode,omitempty"`
+	WalletID      string          `json:"wallet_id,omitempty"`
+	DepositID     string          `json:"deposit_id,omitempty"`
+	TransferID    string          `json:"transfer_id,omitempty"`
+	ToWalletID    string          `json:"to_wallet_id,omitempty"`
+	FromStatus    string          `json:"from_status,omitempty"`
+	ToStatus      string          `json:"to_status,omitempty"`
+	// Settlement is set by wallet events: Amount and Currency stay those of
+	// the payment, the settled fields are what moved in the wallet.
+	SettledAmount   *decimal.Decimal `json:"settled_amount,omitempty"`
+	SettledCurrency string           `json:"settled_currency,omitempty"`
+	FXRate          *decimal.Decimal `json:"fx_rate,omitempty"`
 }
 
 // New creates a new event with common fields.
@@ -73,3 +106,58 @@ func (e *Event) WithGatewayRef(ref string) *Event {
 
 	return e
 }
+
+// WithRefund adds refund info to the event.
+func (e *Event) WithRefund(refundID string) *Event {
+	e.RefundID = refundID
+
+	return e
+}
+
+// WithCaptureMode adds the capture mode to the event.
+func (e *Event) WithCaptureMode(mode string) *Event {
+	e.CaptureMode = mode
+
+	return e
+}
+
+// WithWallet adds the wallet the event is about.
+func (e *Event) WithWallet(walletID string) *Event {
+	e.WalletID = walletID
+
+	return e
+}
+
+// WithDeposit adds deposit info to the event.
+func (e *Event) WithDeposit(depositID string) *Event {
+	e.DepositID = depositID
+
+	return e
+}
+
+// WithTransfer adds transfer info to the event. WalletID is the wallet the
+// funds leave.
+func (e *Event) WithTransfer(transferID, toWalletID string) *Event {
+	e.TransferID = transferID
+	e.ToWalletID = toWalletID
+
+	return e
+}
+
+// WithStatusChange adds the states a wallet moved between.
+func (e *Event) WithStatusChange(from, to string) *Event {
+	e.FromStatus = from
+	e.ToStatus = to
+
+	return e
+}
+
+// WithSettlement adds the amount that moved in the wallet, in the wallet's
+// currency, and the rate it was converted at from Amount.
+func (e *Event) WithSettlement(amount decimal.Decimal, currency string, rate decimal.Decimal) *Event {
+	e.SettledAmount = &amount
+	e.SettledCurrency = currency
+	e.FXRate = &rate
+
+	return e
+}
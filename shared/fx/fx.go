@@ -0,0 +1,141 @@
+// Package fx quotes exchange rates between supported currencies and converts
+// amounts at a quoted rate.
+package fx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/currency"
+)
+
+// rateScale is the number of decimal places kept when a rate is derived from
+// the inverse pair.
+const rateScale = 10
+
+var (
+	ErrNoRate      = errors.New("no exchange rate")
+	ErrInvalidRate = errors.New("invalid exchange rate")
+)
+
+// Quote is the rate at which one unit of From buys Rate units of To, valid
+// until ExpiresAt.
+type Quote struct {
+	ExpiresAt time.Time
+	From      string
+	To        string
+	Rate      decimal.Decimal
+}
+
+// Convert returns amount, in From, expressed in To. The result is rounded up
+// to To's minor units so a conversion never charges less than the rate says.
+func (q Quote) Convert(amount decimal.Decimal) decimal.Decimal {
+	converted := amount.Mul(q.Rate)
+
+	c, err := currency.Lookup(q.To)
+	if err != nil {
+		return converted
+	}
+
+	return converted.RoundCeil(c.MinorUnits)
+}
+
+// Expired reports whether the quote can no longer be used at now.
+func (q Quote) Expired(now time.Time) bool {
+	return now.After(q.ExpiresAt)
+}
+
+// Provider quotes exchange rates.
+type Provider interface {
+	Quote(ctx context.Context, from, to string) (Quote, error)
+}
+
+// Static is a Provider backed by a fixed table of rates, loaded in memory or
+// from a file. Each quote is valid for ttl from the moment it is given.
+type Static struct {
+	now   func() time.Time
+	rates map[string]decimal.Decimal
+	ttl   time.Duration
+}
+
+// NewStatic returns a provider for rates, keyed by pair as "EUR/USD" for the
+// price of one EUR in USD. A pair is also used for its inverse when the
+// inverse is not listed.
+func NewStatic(rates map[string]decimal.Decimal, ttl time.Duration) (*Static, error) {
+	s := &Static{
+		now:   time.Now,
+		rates: make(map[string]decimal.Decimal, len(rates)),
+		ttl:   ttl,
+	}
+
+	for key, rate := range rates {
+		from, to, ok := strings.Cut(key, "/")
+		if !ok {
+			return nil, fmt.Errorf("%w: pair %q is not FROM/TO", ErrInvalidRate, key)
+		}
+
+		for _, code := range []string{from, to} {
+			if _, err := currency.Lookup(code); err != nil {
+				return nil, fmt.Errorf("%w: pair %q: %w", ErrInvalidRate, key, err)
+			}
+		}
+
+		if !rate.IsPositive() {
+			return nil, fmt.Errorf("%w: pair %q must be positive", ErrInvalidRate, key)
+		}
+
+		s.rates[pair(from, to)] = rate
+	}
+
+	return s, nil
+}
+
+// LoadFile reads rates for NewStatic from a JSON object such as
+// {"EUR/USD": "1.0842"}.
+func LoadFile(path string, ttl time.Duration) (*Static, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rates: %w", err)
+	}
+
+	var rates map[string]decimal.Decimal
+	if err := json.Unmarshal(b, &rates); err != nil {
+		return nil, fmt.Errorf("parse rates: %w", err)
+	}
+
+	return NewStatic(rates, ttl)
+}
+
+// Quote implements Provider. A currency always converts to itself at 1.
+func (s *Static) Quote(_ context.Context, from, to string) (Quote, error) {
+	from, to = currency.Normalize(from), currency.Normalize(to)
+
+	q := Quote{From: from, To: to, ExpiresAt: s.now().Add(s.ttl)}
+
+	switch rate, ok := s.rates[pair(from, to)]; {
+	case from == to:
+		q.Rate = decimal.NewFromInt(1)
+	case ok:
+		q.Rate = rate
+	default:
+		inverse, ok := s.rates[pair(to, from)]
+		if !ok {
+			return Quote{}, fmt.Errorf("%w: %s to %s", ErrNoRate, from, to)
+		}
+
+		q.Rate = decimal.NewFromInt(1).DivRound(inverse, rateScale)
+	}
+
+	return q, nil
+}
+
+func pair(from, to string) string {
+	return currency.Normalize(from) + "/" + currency.Normalize(to)
+}
@@ -0,0 +1,91 @@
+package fx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatic_Quote(t *testing.T) {
+	rates, err := NewStatic(map[string]decimal.Decimal{
+		"EUR/USD": decimal.RequireFromString("1.25"),
+	}, time.Minute)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		from, to string
+		rate     string
+		err      error
+	}{
+		{"listed pair", "EUR", "USD", "1.25", nil},
+		{"inverse pair", "usd", "eur", "0.8", nil},
+		{"same currency", "MXN", "MXN", "1", nil},
+		{"unknown pair", "EUR", "MXN", "", ErrNoRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := rates.Quote(context.Background(), tt.from, tt.to)
+
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, q.Rate.Equal(decimal.RequireFromString(tt.rate)), q.Rate.String())
+			assert.False(t, q.Expired(time.Now()))
+			assert.True(t, q.Expired(time.Now().Add(2*time.Minute)))
+		})
+	}
+}
+
+func TestNewStatic_RejectsInvalidRates(t *testing.T) {
+	for _, key := range []string{"EURUSD", "EUR/XXX"} {
+		_, err := NewStatic(map[string]decimal.Decimal{key: decimal.NewFromInt(1)}, time.Minute)
+
+		assert.ErrorIs(t, err, ErrInvalidRate, key)
+	}
+
+	_, err := NewStatic(map[string]decimal.Decimal{"EUR/USD": decimal.Zero}, time.Minute)
+
+	assert.ErrorIs(t, err, ErrInvalidRate)
+}
+
+func TestQuote_ConvertRoundsUpToMinorUnits(t *testing.T) {
+	tests := []struct {
+		to, rate, amount, want string
+	}{
+		{"USD", "1.0842", "10.00", "10.85"},
+		{"JPY", "161.37", "10.00", "1614"},
+		{"USD", "1.25", "8.00", "10"},
+	}
+
+	for _, tt := range tests {
+		q := Quote{From: "EUR", To: tt.to, Rate: decimal.RequireFromString(tt.rate)}
+
+		got := q.Convert(decimal.RequireFromString(tt.amount))
+
+		assert.True(t, got.Equal(decimal.RequireFromString(tt.want)), got.String())
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"EUR/USD": "1.0842", "USD/MXN": 17.05}`), 0o600))
+
+	rates, err := LoadFile(path, time.Minute)
+	assert.NoError(t, err)
+
+	q, err := rates.Quote(context.Background(), "USD", "MXN")
+
+	assert.NoError(t, err)
+	assert.True(t, q.Rate.Equal(decimal.RequireFromString("17.05")))
+}
@@ -0,0 +1,221 @@
+// Package idempotency makes event consumers process each event once. Queues
+// deliver at least once, and a batch with one failed record is delivered
+// again whole, so consumers see the same event more than once.
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+)
+
+var (
+	// ErrInProgress is returned for an event another invocation is
+	// processing. The message should go back to the queue and be delivered
+	// again later.
+	ErrInProgress = errors.New("event is being processed")
+
+	errCompleted = errors.New("event already processed")
+)
+
+// Processed event statuses.
+const (
+	InProgress = "in_progress"
+	Completed  = "completed"
+	Failed     = "failed"
+)
+
+const (
+	// lockTTL bounds how long an invocation holds an event, so one that
+	// crashed mid-way does not block the event forever. It is the longest a
+	// Lambda can run, so no invocation still working on an event loses it to
+	// a redelivery, whatever timeout the consumers are given.
+	lockTTL = 15 * time.Minute
+	// retention is how long a processed event is remembered: the longest an
+	// SQS queue keeps a message.
+	retention = 14 * 24 * time.Hour
+)
+
+// DynamoDBClient defines the DynamoDB operations we need.
+type DynamoDBClient interface {
+	PutItem(
+		ctx context.Context,
+		params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.PutItemOutput, error)
+	UpdateItem(
+		ctx context.Context,
+		params *dynamodb.UpdateItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.UpdateItemOutput, error)
+}
+
+// ProcessedEvent is what a consumer remembers of an event it has seen. ID is
+// consumer#event_id, since every consumer of an event processes it once.
+// ExpiresAt is the lock while the event is in progress and the TTL after.
+type ProcessedEvent struct {
+	CreatedAt time.Time `dynamodbav:"created_at"`
+	UpdatedAt time.Time `dynamodbav:"updated_at"`
+	ID        string    `dynamodbav:"id"`
+	EventID   string    `dynamodbav:"event_id"`
+	EventType string    `dynamodbav:"event_type"`
+	Consumer  string    `dynamodbav:"consumer"`
+	Status    string    `dynamodbav:"status"`
+	Error     string    `dynamodbav:"error,omitempty"`
+	ExpiresAt int64     `dynamodbav:"expires_at"`
+}
+
+// Handler processes one event.
+type Handler func(ctx context.Context, event *events.Event) error
+
+// Guard runs a consumer's handler at most once per event. Consumer names the
+// service consuming, so consumers can share the table.
+type Guard struct {
+	db       DynamoDBClient
+	table    string
+	consumer string
+}
+
+func NewGuard(db DynamoDBClient, table, consumer string) *Guard {
+	return &Guard{db: db, table: table, consumer: consumer}
+}
+
+// Process runs handle unless the event was already processed. The event is
+// claimed first, so a concurrent delivery gets ErrInProgress instead of
+// running it too. It ends completed when handle succeeds, and failed when it
+// returns an error, which Process returns; a failed event runs again when it
+// is delivered again.
+func (g *Guard) Process(ctx context.Context, event *events.Event, handle Handler) error {
+	if event.ID == "" {
+		slog.Warn("processing event without an id", "type", event.Type, "payment_id", event.PaymentID)
+
+		return handle(ctx, event)
+	}
+
+	lock, err := g.claim(ctx, event)
+	if errors.Is(err, errCompleted) {
+		slog.Info("skipping processed event", "event_id", event.ID, "type", event.Type, "consumer", g.consumer)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := handle(ctx, event); err != nil {
+		g.finish(ctx, event, lock, Failed, err.Error())
+
+		return err
+	}
+
+	// The event was handled. Failing to record that is logged rather than
+	// returned, since returning it would have the queue deliver it again.
+	g.finish(ctx, event, lock, Completed, "")
+
+	return nil
+}
+
+// claim marks the event in progress, if it is new, failed, or its lock ran
+// out. It returns the lock, which finish must match.
+func (g *Guard) claim(ctx context.Context, event *events.Event) (int64, error) {
+	now := time.Now().UTC()
+	record := &ProcessedEvent{
+		ID:        g.key(event),
+		EventID:   event.ID,
+		EventType: event.Type,
+		Consumer:  g.consumer,
+		Status:    InProgress,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(lockTTL).Unix(),
+	}
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return 0, fmt.Errorf("marshal processed event: %w", err)
+	}
+
+	_, err = g.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(g.table),
+		Item:      item,
+		ConditionExpression: aws.String(
+			"attribute_not_exists(id) OR #status = :failed OR (#status = :in_progress AND expires_at < :now)",
+		),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":failed":      &types.AttributeValueMemberS{Value: Failed},
+			":in_progress": &types.AttributeValueMemberS{Value: InProgress},
+			":now":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err == nil {
+		return record.ExpiresAt, nil
+	}
+
+	var ccf *types.ConditionalCheckFailedException
+	if !errors.As(err, &ccf) {
+		return 0, fmt.Errorf("claim event: %w", err)
+	}
+
+	var existing ProcessedEvent
+	if err := attributevalue.UnmarshalMap(ccf.Item, &existing); err != nil {
+		return 0, fmt.Errorf("unmarshal processed event: %w", err)
+	}
+
+	if existing.Status == Completed {
+		return 0, errCompleted
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrInProgress, event.ID)
+}
+
+// finish records how the event ended, if this invocation still holds its
+// lock. Failures are logged.
+func (g *Guard) finish(ctx context.Context, event *events.Event, lock int64, status, reason string) {
+	now := time.Now().UTC()
+
+	_, err := g.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(g.table),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: g.key(event)},
+		},
+		UpdateExpression: aws.String(
+			"SET #status = :status, #error = :error, updated_at = :now, expires_at = :exp",
+		),
+		ConditionExpression:      aws.String("#status = :in_progress AND expires_at = :lock"),
+		ExpressionAttributeNames: map[string]string{"#status": "status", "#error": "error"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":      &types.AttributeValueMemberS{Value: status},
+			":error":       &types.AttributeValueMemberS{Value: reason},
+			":in_progress": &types.AttributeValueMemberS{Value: InProgress},
+			":now":         &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			":exp":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(retention).Unix(), 10)},
+			":lock":        &types.AttributeValueMemberN{Value: strconv.FormatInt(lock, 10)},
+		},
+	})
+	if err != nil {
+		slog.Error(
+			"failed to record processed event",
+			"error", err,
+			"event_id", event.ID,
+			"status", status,
+			"consumer", g.consumer,
+		)
+	}
+}
+
+func (g *Guard) key(event *events.Event) string {
+	return g.consumer + "#" + event.ID
+}
@@ -0,0 +1,143 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+)
+
+type mockDB struct {
+	mock.Mock
+}
+
+func (m *mockDB) PutItem(
+	ctx context.Context,
+	input *dynamodb.PutItemInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+func (m *mockDB) UpdateItem(
+	ctx context.Context,
+	input *dynamodb.UpdateItemInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func finishedAs(status string) any {
+	return mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		return in.Key["id"].(*types.AttributeValueMemberS).Value == "wallet-service#evt-1" &&
+			in.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value == status
+	})
+}
+
+func alreadyClaimed(status string) error {
+	return &types.ConditionalCheckFailedException{Item: map[string]types.AttributeValue{
+		"id":         &types.AttributeValueMemberS{Value: "wallet-service#evt-1"},
+		"status":     &types.AttributeValueMemberS{Value: status},
+		"expires_at": &types.AttributeValueMemberN{Value: "1"},
+	}}
+}
+
+func TestProcess_RunsNewEventOnce(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+		return in.Item["id"].(*types.AttributeValueMemberS).Value == "wallet-service#evt-1" &&
+			in.Item["status"].(*types.AttributeValueMemberS).Value == InProgress
+	})).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("UpdateItem", ctx, finishedAs(Completed)).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	calls := 0
+	event := events.Event{ID: "evt-1", Type: events.GatewayPaymentApproved}
+
+	err := NewGuard(db, "processed-events", "wallet-service").Process(ctx, &event,
+		func(context.Context, *events.Event) error {
+			calls++
+
+			return nil
+		})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	db.AssertExpectations(t)
+}
+
+func TestProcess_SkipsCompletedEvent(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, alreadyClaimed(Completed))
+
+	event := events.Event{ID: "evt-1", Type: events.GatewayPaymentApproved}
+
+	err := NewGuard(db, "processed-events", "wallet-service").Process(ctx, &event,
+		func(context.Context, *events.Event) error {
+			t.Fatal("a processed event must not run again")
+
+			return nil
+		})
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "UpdateItem", mock.Anything, mock.Anything)
+}
+
+func TestProcess_EventInProgressIsRetriedLater(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, alreadyClaimed(InProgress))
+
+	event := events.Event{ID: "evt-1", Type: events.GatewayPaymentApproved}
+
+	err := NewGuard(db, "processed-events", "wallet-service").Process(ctx, &event,
+		func(context.Context, *events.Event) error {
+			t.Fatal("an event in progress must not run twice")
+
+			return nil
+		})
+
+	assert.ErrorIs(t, err, ErrInProgress)
+}
+
+func TestProcess_FailureIsRecordedAndReturned(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	boom := errors.New("wallet unavailable")
+
+	db.On("PutItem", ctx, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		return in.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value == Failed &&
+			in.ExpressionAttributeValues[":error"].(*types.AttributeValueMemberS).Value == boom.Error()
+	})).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	event := events.Event{ID: "evt-1", Type: events.GatewayPaymentApproved}
+
+	err := NewGuard(db, "processed-events", "wallet-service").Process(ctx, &event,
+		func(context.Context, *events.Event) error {
+			return boom
+		})
+
+	assert.ErrorIs(t, err, boom)
+	db.AssertExpectations(t)
+}
@@ -0,0 +1,200 @@
+package money
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// DynamoDBClient defines the DynamoDB operations a Migration needs.
+type DynamoDBClient interface {
+	Scan(
+		ctx context.Context,
+		params *dynamodb.ScanInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.ScanOutput, error)
+	UpdateItem(
+		ctx context.Context,
+		params *dynamodb.UpdateItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.UpdateItemOutput, error)
+}
+
+// Migration rewrites the amount attributes of every item in a table, keyed
+// by id, in the canonical encoding. Amounts written as strings (S) by older
+// code become numbers (N); numbers and missing attributes are left alone.
+type Migration struct {
+	Table      string
+	Attributes []string
+	// DryRun counts what would be rewritten without writing anything.
+	DryRun bool
+}
+
+// MigrationReport is what a Migration found in its table.
+type MigrationReport struct {
+	Scanned   int
+	Rewritten int
+	// Changed lists the items that were written to between the scan and
+	// their rewrite. They are left alone; running the migration again
+	// picks them up.
+	Changed []string
+	// Unreadable lists the items holding an amount that is neither a number
+	// nor a decimal string, which no encoding recovers, and those whose id
+	// is not a string, which cannot be addressed.
+	Unreadable []string
+}
+
+// Run scans the table and rewrites its items one at a time. Each rewrite is
+// conditioned on the attributes still holding the strings that were read,
+// so a write made while the migration runs is never overwritten. Running it
+// again once everything is migrated changes nothing.
+func (m Migration) Run(ctx context.Context, db DynamoDBClient) (*MigrationReport, error) {
+	names := map[string]string{"#id": "id"}
+	projection := []string{"#id"}
+
+	for i, attr := range m.Attributes {
+		name := "#a" + strconv.Itoa(i)
+		names[name] = attr
+		projection = append(projection, name)
+	}
+
+	report := &MigrationReport{}
+
+	var start map[string]types.AttributeValue
+
+	for {
+		page, err := db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:                aws.String(m.Table),
+			ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+			ExpressionAttributeNames: names,
+			ExclusiveStartKey:        start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan %s: %w", m.Table, err)
+		}
+
+		for _, item := range page.Items {
+			report.Scanned++
+
+			if err := m.migrate(ctx, db, item, report); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			return report, nil
+		}
+
+		start = page.LastEvaluatedKey
+	}
+}
+
+// migrate rewrites the string amounts of one item.
+func (m Migration) migrate(
+	ctx context.Context,
+	db DynamoDBClient,
+	item map[string]types.AttributeValue,
+	report *MigrationReport,
+) error {
+	key, ok := item["id"].(*types.AttributeValueMemberS)
+	if !ok {
+		report.Unreadable = append(report.Unreadable, describeID(item["id"]))
+
+		return nil
+	}
+
+	id := key.Value
+
+	var (
+		sets       []string
+		conditions []string
+		unreadable bool
+		names      = map[string]string{}
+		values     = map[string]types.AttributeValue{}
+	)
+
+	for i, attr := range m.Attributes {
+		raw, ok := item[attr].(*types.AttributeValueMemberS)
+		if !ok {
+			switch item[attr].(type) {
+			case nil, *types.AttributeValueMemberN, *types.AttributeValueMemberNULL:
+			default:
+				unreadable = true
+			}
+
+			continue
+		}
+
+		amount, err := decimal.NewFromString(raw.Value)
+		if err != nil {
+			unreadable = true
+
+			continue
+		}
+
+		n := strconv.Itoa(i)
+		names["#a"+n] = attr
+		values[":old"+n] = raw
+		values[":new"+n] = &types.AttributeValueMemberN{Value: amount.String()}
+		sets = append(sets, fmt.Sprintf("#a%s = :new%s", n, n))
+		conditions = append(conditions, fmt.Sprintf("#a%s = :old%s", n, n))
+	}
+
+	if unreadable {
+		report.Unreadable = append(report.Unreadable, id)
+	}
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	if m.DryRun {
+		report.Rewritten++
+
+		return nil
+	}
+
+	_, err := db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(m.Table),
+		Key: map[string]types.AttributeValue{
+			"id": item["id"],
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			report.Changed = append(report.Changed, id)
+
+			return nil
+		}
+
+		return fmt.Errorf("rewrite %s %s: %w", m.Table, id, err)
+	}
+
+	report.Rewritten++
+
+	return nil
+}
+
+// describeID names an item whose id is not a string in a report.
+func describeID(id types.AttributeValue) string {
+	switch v := id.(type) {
+	case nil:
+		return "<missing id>"
+	case *types.AttributeValueMemberN:
+		return v.Value
+	default:
+		return fmt.Sprintf("<%T id>", v)
+	}
+}
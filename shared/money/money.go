@@ -0,0 +1,54 @@
+// Package money provides the canonical DynamoDB encoding for monetary amounts
+// and the migration of amounts stored before it.
+package money
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+)
+
+// Amount is a decimal amount stored in DynamoDB as a number (N). Numbers keep
+// full decimal precision and can be used in update expression arithmetic.
+type Amount struct {
+	decimal.Decimal
+}
+
+// New wraps a decimal as an Amount.
+func New(d decimal.Decimal) Amount {
+	return Amount{Decimal: d}
+}
+
+// MarshalDynamoDBAttributeValue implements attributevalue.Marshaler.
+func (a Amount) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberN{Value: a.String()}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue implements attributevalue.Unmarshaler. It
+// also accepts amounts written as strings (S) by older code.
+func (a *Amount) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	var raw string
+
+	switch v := av.(type) {
+	case *types.AttributeValueMemberN:
+		raw = v.Value
+	case *types.AttributeValueMemberS:
+		raw = v.Value
+	case *types.AttributeValueMemberNULL:
+		a.Decimal = decimal.Zero
+
+		return nil
+	default:
+		return fmt.Errorf("money: cannot decode %T as an amount", av)
+	}
+
+	d, err := decimal.NewFromString(raw)
+	if err != nil {
+		return fmt.Errorf("money: %w", err)
+	}
+
+	a.Decimal = d
+
+	return nil
+}
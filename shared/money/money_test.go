@@ -0,0 +1,138 @@
+package money
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type record struct {
+	Amount Amount `dynamodbav:"amount"`
+}
+
+func TestAmount_RoundTripsAsNumber(t *testing.T) {
+	in := record{Amount: New(decimal.RequireFromString("100.55"))}
+
+	item, err := attributevalue.MarshalMap(in)
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "100.55"}, item["amount"])
+
+	var out record
+	assert.NoError(t, attributevalue.UnmarshalMap(item, &out))
+	assert.True(t, out.Amount.Equal(in.Amount.Decimal))
+}
+
+func TestAmount_DecodesLegacyString(t *testing.T) {
+	var out record
+
+	err := attributevalue.UnmarshalMap(map[string]types.AttributeValue{
+		"amount": &types.AttributeValueMemberS{Value: "42.10"},
+	}, &out)
+
+	assert.NoError(t, err)
+	assert.True(t, out.Amount.Equal(decimal.RequireFromString("42.1")))
+}
+
+func TestAmount_RejectsUnexpectedType(t *testing.T) {
+	var out record
+
+	err := attributevalue.UnmarshalMap(map[string]types.AttributeValue{
+		"amount": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+	}, &out)
+
+	assert.Error(t, err)
+}
+
+type mockDB struct {
+	mock.Mock
+}
+
+func (m *mockDB) Scan(
+	ctx context.Context,
+	input *dynamodb.ScanInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.ScanOutput, error) {
+	args := m.Called(ctx, input)
+
+	return args.Get(0).(*dynamodb.ScanOutput), args.Error(1)
+}
+
+func (m *mockDB) UpdateItem(
+	ctx context.Context,
+	input *dynamodb.UpdateItemInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func TestMigration_RewritesStringsAsNumbers(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("Scan", ctx, mock.Anything).Return(&dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{
+		{
+			"id":      &types.AttributeValueMemberS{Value: "wallet-legacy"},
+			"balance": &types.AttributeValueMemberS{Value: "100.50"},
+			"held":    &types.AttributeValueMemberN{Value: "20"},
+		},
+		{
+			"id":      &types.AttributeValueMemberS{Value: "wallet-migrated"},
+			"balance": &types.AttributeValueMemberN{Value: "40"},
+		},
+		{
+			"id":      &types.AttributeValueMemberS{Value: "wallet-broken"},
+			"balance": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+		},
+		{
+			"id":      &types.AttributeValueMemberN{Value: "17"},
+			"balance": &types.AttributeValueMemberS{Value: "5"},
+		},
+		{
+			"balance": &types.AttributeValueMemberS{Value: "5"},
+		},
+	}}, nil)
+	db.On("UpdateItem", ctx, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		return in.Key["id"].(*types.AttributeValueMemberS).Value == "wallet-legacy" &&
+			*in.UpdateExpression == "SET #a0 = :new0" &&
+			*in.ConditionExpression == "#a0 = :old0" &&
+			in.ExpressionAttributeNames["#a0"] == "balance" &&
+			in.ExpressionAttributeValues[":old0"].(*types.AttributeValueMemberS).Value == "100.50" &&
+			in.ExpressionAttributeValues[":new0"].(*types.AttributeValueMemberN).Value == "100.5"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+	report, err := Migration{Table: "wallets", Attributes: []string{"balance", "held"}}.Run(ctx, db)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Scanned)
+	assert.Equal(t, 1, report.Rewritten)
+	assert.Equal(t, []string{"wallet-broken", "17", "<missing id>"}, report.Unreadable)
+	db.AssertExpectations(t)
+}
+
+func TestMigration_LeavesItemsChangedSinceTheScan(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("Scan", ctx, mock.Anything).Return(&dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{{
+		"id":     &types.AttributeValueMemberS{Value: "res-1"},
+		"amount": &types.AttributeValueMemberS{Value: "30"},
+	}}}, nil)
+	db.On("UpdateItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{})
+
+	report, err := Migration{Table: "reservations", Attributes: []string{"amount"}}.Run(ctx, db)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Rewritten)
+	assert.Equal(t, []string{"res-1"}, report.Changed)
+}
@@ -0,0 +1,54 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+)
+
+// EventBridge wraps the EventBridge client for publishing events.
+type EventBridge struct {
+	client *eventbridge.Client
+	source string
+}
+
+// NewEventBridge creates a new EventBridge publisher. The source identifies
+// the producing service on every entry.
+func NewEventBridge(client *eventbridge.Client, source string) *EventBridge {
+	return &EventBridge{client: client, source: source}
+}
+
+// Publish puts an event on the specified bus, using the event type as detail
+// type.
+func (p *EventBridge) Publish(ctx context.Context, busName string, event *events.Event) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	out, err := p.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []types.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(busName),
+				Source:       aws.String(p.source),
+				DetailType:   aws.String(event.Type),
+				Detail:       aws.String(string(detail)),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if out.FailedEntryCount > 0 {
+		return fmt.Errorf("put event %s: %s", event.ID, aws.ToString(out.Entries[0].ErrorMessage))
+	}
+
+	return nil
+}
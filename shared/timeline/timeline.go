@@ -0,0 +1,184 @@
+// Package timeline keeps the history of every event seen or emitted for a
+// payment, so that a payment can be traced without going through the logs of
+// each service.
+package timeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+	"github.com/HELL0ANTHONY/payment-system/shared/money"
+)
+
+// sortKeyLayout is a fixed-width timestamp so that string order matches
+// chronological order.
+const sortKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// DynamoDBClient defines the DynamoDB operations we need.
+type DynamoDBClient interface {
+	PutItem(
+		ctx context.Context,
+		params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.PutItemOutput, error)
+	Query(
+		ctx context.Context,
+		params *dynamodb.QueryInput,
+		optFns ...func(*dynamodb.Options),
+	) (*dynamodb.QueryOutput, error)
+}
+
+// EventPublisher is the publishing interface every service already uses.
+type EventPublisher interface {
+	Publish(ctx context.Context, destination string, event *events.Event) error
+}
+
+// Entry is one event in a payment's timeline.
+type Entry struct {
+	OccurredAt    time.Time    `dynamodbav:"occurred_at"`
+	PaymentID     string       `dynamodbav:"payment_id"`
+	SortKey       string       `dynamodbav:"sort_key"`
+	EventID       string       `dynamodbav:"event_id"`
+	Type          string       `dynamodbav:"type"`
+	Source        string       `dynamodbav:"source"`
+	Amount        money.Amount `dynamodbav:"amount"`
+	Currency      string       `dynamodbav:"currency,omitempty"`
+	Reason        string       `dynamodbav:"reason,omitempty"`
+	ReservationID string       `dynamodbav:"reservation_id,omitempty"`
+	GatewayRef    string       `dynamodbav:"gateway_ref,omitempty"`
+	RefundID      string       `dynamodbav:"refund_id,omitempty"`
+}
+
+// Recorder stores events in the timeline table. Source names the service
+// doing the recording.
+type Recorder struct {
+	db     DynamoDBClient
+	table  string
+	source string
+}
+
+func NewRecorder(db DynamoDBClient, table, source string) *Recorder {
+	return &Recorder{db: db, table: table, source: source}
+}
+
+// Record adds an event to its payment's timeline. The same event is usually
+// recorded by its producer and by each consumer; the first write wins and
+// the others are no-ops.
+func (r *Recorder) Record(ctx context.Context, event *events.Event) error {
+	if event.PaymentID == "" {
+		return nil
+	}
+
+	item, err := attributevalue.MarshalMap(&Entry{
+		OccurredAt:    event.OccurredAt,
+		PaymentID:     event.PaymentID,
+		SortKey:       event.OccurredAt.UTC().Format(sortKeyLayout) + "#" + event.ID,
+		EventID:       event.ID,
+		Type:          event.Type,
+		Source:        r.source,
+		Amount:        money.New(event.Amount),
+		Currency:      event.Currency,
+		Reason:        event.Reason,
+		ReservationID: event.ReservationID,
+		GatewayRef:    event.GatewayRef,
+		RefundID:      event.RefundID,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal timeline entry: %w", err)
+	}
+
+	_, err = r.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(sort_key)"),
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return nil
+		}
+
+		return fmt.Errorf("save timeline entry: %w", err)
+	}
+
+	return nil
+}
+
+// Observe records an event and only logs failures, for callers where the
+// timeline must not get in the way of processing the event.
+func (r *Recorder) Observe(ctx context.Context, event *events.Event) {
+	if err := r.Record(ctx, event); err != nil {
+		slog.Error(
+			"failed to record timeline entry",
+			"error", err,
+			"event_type", event.Type,
+			"payment_id", event.PaymentID,
+		)
+	}
+}
+
+// List returns the timeline of a payment, oldest event first.
+func (r *Recorder) List(ctx context.Context, paymentID string) ([]Entry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.table),
+		KeyConditionExpression: aws.String("payment_id = :pid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pid": &types.AttributeValueMemberS{Value: paymentID},
+		},
+		ScanIndexForward: aws.Bool(true),
+	}
+
+	var entries []Entry
+
+	for {
+		result, err := r.db.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("query timeline: %w", err)
+		}
+
+		var page []Entry
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("unmarshal timeline: %w", err)
+		}
+
+		entries = append(entries, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// Publisher records every event it publishes.
+type Publisher struct {
+	next     EventPublisher
+	recorder *Recorder
+}
+
+// NewPublisher wraps next so that published events are also recorded.
+func NewPublisher(next EventPublisher, recorder *Recorder) *Publisher {
+	return &Publisher{next: next, recorder: recorder}
+}
+
+// Publish publishes the event and then records it. Recording failures are
+// logged, never returned, so the timeline cannot cause a redelivery.
+func (p *Publisher) Publish(ctx context.Context, destination string, event *events.Event) error {
+	if err := p.next.Publish(ctx, destination, event); err != nil {
+		return err
+	}
+
+	p.recorder.Observe(ctx, event)
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package timeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/HELL0ANTHONY/payment-system/shared/events"
+)
+
+type mockDB struct {
+	mock.Mock
+}
+
+func (m *mockDB) PutItem(
+	ctx context.Context,
+	input *dynamodb.PutItemInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(ctx, input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+func (m *mockDB) Query(
+	ctx context.Context,
+	input *dynamodb.QueryInput,
+	_ ...func(*dynamodb.Options),
+) (*dynamodb.QueryOutput, error) {
+	args := m.Called(ctx, input)
+
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+type mockPublisher struct {
+	mock.Mock
+}
+
+func (m *mockPublisher) Publish(ctx context.Context, destination string, event *events.Event) error {
+	return m.Called(ctx, destination, event).Error(0)
+}
+
+func TestRecord_DuplicateIsIgnored(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	db.On("PutItem", ctx, mock.Anything).Return(nil, &types.ConditionalCheckFailedException{})
+
+	event := events.New(events.FundsReserved, "pay-123", "user-456")
+
+	err := NewRecorder(db, "timeline", "wallet-service").Record(ctx, &event)
+
+	assert.NoError(t, err)
+}
+
+func TestRecord_SkipsEventsWithoutPayment(t *testing.T) {
+	db := new(mockDB)
+	event := events.New(events.FundsRefunded, "", "user-456")
+
+	err := NewRecorder(db, "timeline", "wallet-service").Record(context.Background(), &event)
+
+	assert.NoError(t, err)
+	db.AssertNotCalled(t, "PutItem", mock.Anything, mock.Anything)
+}
+
+func TestList_FollowsPages(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+
+	first, _ := attributevalue.MarshalMap(&Entry{PaymentID: "pay-123", Type: events.PaymentInitiated})
+	second, _ := attributevalue.MarshalMap(&Entry{PaymentID: "pay-123", Type: events.FundsReserved})
+	lastKey := map[string]types.AttributeValue{
+		"payment_id": &types.AttributeValueMemberS{Value: "pay-123"},
+	}
+
+	db.On("Query", ctx, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return in.ExclusiveStartKey == nil
+	})).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]types.AttributeValue{first},
+		LastEvaluatedKey: lastKey,
+	}, nil).Once()
+	db.On("Query", ctx, mock.Anything).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{second},
+	}, nil).Once()
+
+	entries, err := NewRecorder(db, "timeline", "payment-orchestrator").List(ctx, "pay-123")
+
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, events.PaymentInitiated, entries[0].Type)
+	assert.Equal(t, events.FundsReserved, entries[1].Type)
+}
+
+func TestPublisher_RecordsAfterPublishing(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	next := new(mockPublisher)
+
+	next.On("Publish", ctx, "http://queue", mock.Anything).Return(nil)
+	db.On("PutItem", ctx, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+		amount := in.Item["amount"].(*types.AttributeValueMemberN)
+		source := in.Item["source"].(*types.AttributeValueMemberS)
+
+		return amount.Value == "25" && source.Value == "gateway-processor"
+	})).Return(&dynamodb.PutItemOutput{}, nil)
+
+	event := events.New(events.GatewayPaymentApproved, "pay-123", "user-456")
+	event.WithAmount(decimal.NewFromInt(25), "USD")
+
+	pub := NewPublisher(next, NewRecorder(db, "timeline", "gateway-processor"))
+
+	assert.NoError(t, pub.Publish(ctx, "http://queue", &event))
+	db.AssertExpectations(t)
+}
+
+func TestPublisher_DoesNotRecordFailedPublish(t *testing.T) {
+	ctx := context.Background()
+	db := new(mockDB)
+	next := new(mockPublisher)
+
+	next.On("Publish", ctx, "http://queue", mock.Anything).Return(errors.New("throttled"))
+
+	event := events.New(events.GatewayPaymentApproved, "pay-123", "user-456")
+	pub := NewPublisher(next, NewRecorder(db, "timeline", "gateway-processor"))
+
+	assert.Error(t, pub.Publish(ctx, "http://queue", &event))
+	db.AssertNotCalled(t, "PutItem", mock.Anything, mock.Anything)
+}
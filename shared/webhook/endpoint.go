@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrEndpointNotPublic is returned for an endpoint that is not an https URL
+// on a public host. Webhooks are sent from inside the network, so an
+// endpoint on a private, loopback or link-local address would let whoever
+// registers it reach internal services.
+var ErrEndpointNotPublic = errors.New("webhook endpoint must be an https URL on a public host")
+
+// carrierNAT is the shared address space of RFC 6598, private in practice.
+var carrierNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+// CheckEndpoint reports whether raw is an absolute https URL whose host is
+// not a loopback, private or link-local address. Host names are checked
+// when they are dialled, since what they resolve to can change.
+func CheckEndpoint(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return ErrEndpointNotPublic
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrEndpointNotPublic
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil && !PublicAddr(addr) {
+		return ErrEndpointNotPublic
+	}
+
+	return nil
+}
+
+// PublicAddr reports whether addr is a public unicast address.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !carrierNAT.Contains(addr)
+}
+
+// NewPublicClient returns an HTTP client that only sends https requests to
+// public addresses, checked after name resolution, and does not follow
+// redirects.
+// It bypasses any proxy, which would hide the address dialled.
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !PublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: dialled %s", ErrEndpointNotPublic, address)
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: httpsOnly{&http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// httpsOnly refuses plain http requests, such as those to endpoints
+// registered before https was required.
+type httpsOnly struct {
+	base http.RoundTripper
+}
+
+func (t httpsOnly) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s", ErrEndpointNotPublic, req.URL.Redacted())
+	}
+
+	return t.base.RoundTrip(req)
+}
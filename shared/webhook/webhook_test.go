@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify_AcceptsOwnSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"id":"evt-1"}`)
+
+	err := Verify("secret", Sign("secret", now, body), body, DefaultTolerance, now)
+
+	assert.NoError(t, err)
+}
+
+func TestVerify_RejectsTamperedBody(t *testing.T) {
+	now := time.Now()
+	header := Sign("secret", now, []byte(`{"amount":"10"}`))
+
+	err := Verify("secret", header, []byte(`{"amount":"1000"}`), DefaultTolerance, now)
+
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestVerify_RejectsOldTimestamp(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{}`)
+	header := Sign("secret", now.Add(-time.Hour), body)
+
+	err := Verify("secret", header, body, DefaultTolerance, now)
+
+	assert.ErrorIs(t, err, ErrSignatureExpired)
+}
+
+func TestSend_SignsRequest(t *testing.T) {
+	var (
+		header string
+		got    []byte
+		id     string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(SignatureHeader)
+		id = r.Header.Get(IDHeader)
+		got, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	msg := &Message{ID: "evt-1", Event: "payment.completed", Body: []byte(`{"id":"evt-1"}`)}
+
+	result, err := NewSender(srv.Client()).Send(context.Background(), srv.URL, "secret", msg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.Equal(t, "evt-1", id)
+	assert.Equal(t, msg.Body, got)
+	assert.NoError(t, Verify("secret", header, got, DefaultTolerance, time.Now()))
+}
+
+func TestSend_NonSuccessStatusIsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	result, err := NewSender(srv.Client()).Send(
+		context.Background(),
+		srv.URL,
+		"secret",
+		&Message{ID: "evt-1", Body: []byte(`{}`)},
+	)
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"https://hooks.example.com/payments": true,
+		"https://93.184.216.34/hook":         true,
+		"http://hooks.example.com/payments":  false,
+		"https://localhost/hook":             false,
+		"https://127.0.0.1/hook":             false,
+		"https://10.0.0.7/hook":              false,
+		"https://169.254.169.254/latest":     false,
+		"https://[::1]/hook":                 false,
+		"https://[fe80::1]/hook":             false,
+		"https://[::ffff:192.168.1.1]/hook":  false,
+		"/relative":                          false,
+	} {
+		err := CheckEndpoint(raw)
+		if ok {
+			assert.NoError(t, err, raw)
+		} else {
+			assert.ErrorIs(t, err, ErrEndpointNotPublic, raw)
+		}
+	}
+}
+
+func TestSend_PublicClientRefusesLoopback(t *testing.T) {
+	called := false
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	result, err := NewSender(NewPublicClient(time.Second)).Send(
+		context.Background(),
+		srv.URL,
+		"secret",
+		&Message{ID: "evt-1", Body: []byte(`{}`)},
+	)
+
+	assert.ErrorIs(t, err, ErrEndpointNotPublic)
+	assert.Zero(t, result.StatusCode)
+	assert.False(t, called)
+}
+
+func TestSend_PublicClientRefusesPlainHTTP(t *testing.T) {
+	_, err := NewSender(NewPublicClient(time.Second)).Send(
+		context.Background(),
+		"http://hooks.example.com/payments",
+		"secret",
+		&Message{ID: "evt-1", Body: []byte(`{}`)},
+	)
+
+	assert.ErrorIs(t, err, ErrEndpointNotPublic)
+}